@@ -0,0 +1,561 @@
+// common.go
+//
+// Code the peer and the tracker share, built into both:
+//
+//	go run peer.go common.go
+//	go run tracker.go common.go
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// accessCheckInterval is how often the access file is checked for changes
+const accessCheckInterval = 5 * time.Second
+
+// accessRule matches a host by IP or CIDR, or a peer by its ID
+type accessRule struct {
+	network *net.IPNet // Nil for peer ID rules
+	peerID  string
+}
+
+// accessList decides who may connect from allow and deny rules read from a file, and
+// from temporary bans. Deny rules and bans win. When there are allow rules for hosts,
+// only hosts they match get in, and likewise for peer IDs.
+type accessList struct {
+	lock      sync.Mutex
+	path      string    // File the rules are read from, empty for none
+	modified  time.Time // Modification time of the file when it was read
+	allow     []accessRule
+	deny      []accessRule
+	temporary map[string]time.Time // IPs and peer IDs banned for a while, and until when
+}
+
+// newAccessList reads the rules in the file at path; an empty path allows everyone
+func newAccessList(path string) (*accessList, error) {
+	l := &accessList{path: path, temporary: make(map[string]time.Time)}
+	if path == "" {
+		return l, nil
+	}
+	return l, l.reload()
+}
+
+// parseAccessRules reads rules, one per line: "allow" or "deny", then an IP, a CIDR or
+// "peer <peer ID>". Blank lines and lines starting with # are skipped.
+func parseAccessRules(data string) (allow []accessRule, deny []accessRule, err error) {
+	for n, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var rule accessRule
+		switch {
+		case len(fields) == 3 && fields[1] == "peer":
+			rule.peerID = fields[2]
+		case len(fields) == 2 && strings.Contains(fields[1], "/"):
+			_, rule.network, err = net.ParseCIDR(fields[1])
+		case len(fields) == 2 && net.ParseIP(fields[1]) != nil:
+			ip := net.ParseIP(fields[1])
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		default:
+			err = errors.New("expected an IP, a CIDR or peer <ID>")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, rule)
+		case "deny":
+			deny = append(deny, rule)
+		default:
+			return nil, nil, fmt.Errorf("line %d: expected allow or deny, not %q", n+1, fields[0])
+		}
+	}
+	return allow, deny, nil
+}
+
+// reload reads the rules again. On error the rules in force are kept.
+func (l *accessList) reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	allow, deny, err := parseAccessRules(string(data))
+
+	// A broken file is remembered too, so it is only reported once
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.modified = info.ModTime()
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.path, err)
+	}
+	l.allow, l.deny = allow, deny
+	return nil
+}
+
+// watch reloads the rules on SIGHUP and whenever the file changes, until ctx is cancelled
+func (l *accessList) watch(ctx context.Context) {
+	if l.path == "" {
+		return
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(accessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		case <-ticker.C:
+			info, err := os.Stat(l.path)
+			l.lock.Lock()
+			unchanged := err == nil && info.ModTime().Equal(l.modified)
+			l.lock.Unlock()
+			if unchanged {
+				continue
+			}
+		}
+
+		err := l.reload()
+		if err != nil {
+			logger.Error("Error reloading access rules, keeping the old ones", "err", err)
+			continue
+		}
+		l.lock.Lock()
+		logger.Info("Reloaded access rules", "path", l.path, "allow", len(l.allow), "deny", len(l.deny))
+		l.lock.Unlock()
+	}
+}
+
+// banned reports whether a key is under a temporary ban, forgetting expired bans.
+// Caller must hold the lock.
+func (l *accessList) banned(key string) bool {
+	until, ok := l.temporary[key]
+	if ok && time.Now().After(until) {
+		delete(l.temporary, key)
+		return false
+	}
+	return ok
+}
+
+// allowsAddress reports whether a host, given as host:port or a bare IP, may connect
+func (l *accessList) allowsAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if ip == nil {
+		return true // Host names are checked once they are connected and have an IP
+	}
+	if l.banned(ip.String()) {
+		return false
+	}
+	for _, rule := range l.deny {
+		if rule.network != nil && rule.network.Contains(ip) {
+			return false
+		}
+	}
+	listed := false
+	for _, rule := range l.allow {
+		if rule.network != nil {
+			if rule.network.Contains(ip) {
+				return true
+			}
+			listed = true
+		}
+	}
+	return !listed
+}
+
+// allowsPeer reports whether a peer may talk to us, by the ID from its handshake
+func (l *accessList) allowsPeer(peerID string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.banned(peerID) {
+		return false
+	}
+	for _, rule := range l.deny {
+		if rule.network == nil && rule.peerID == peerID {
+			return false
+		}
+	}
+	listed := false
+	for _, rule := range l.allow {
+		if rule.network == nil {
+			if rule.peerID == peerID {
+				return true
+			}
+			listed = true
+		}
+	}
+	return !listed
+}
+
+// banFor refuses an IP or a peer ID for a while
+func (l *accessList) banFor(key string, d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.temporary[key] = time.Now().Add(d)
+}
+
+// connLimiter caps the connections a server handles at once, overall and per remote IP,
+// and counts the connections it turned away or closed for being too slow
+type connLimiter struct {
+	lock          sync.Mutex
+	max           int            // Most connections at once (0 = unlimited)
+	perIP         int            // Most connections at once from one IP (0 = unlimited)
+	active        int            // Connections being handled
+	byIP          map[string]int // Connections being handled by remote IP
+	rejectedFull  int64          // Connections refused because max was reached
+	rejectedPerIP int64          // Connections refused because their IP had perIP already
+	timedOut      int64          // Connections closed for missing a deadline
+}
+
+// newConnLimiter creates a limiter with the given caps
+func newConnLimiter(max int, perIP int) *connLimiter {
+	return &connLimiter{max: max, perIP: perIP, byIP: make(map[string]int)}
+}
+
+// admit reports whether a new connection may be handled, counting it if so.
+// Every admitted connection must be released.
+func (l *connLimiter) admit(conn net.Conn) bool {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.active >= l.max {
+		l.rejectedFull++
+		return false
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		l.rejectedPerIP++
+		return false
+	}
+	l.active++
+	l.byIP[ip]++
+	return true
+}
+
+// release forgets an admitted connection
+func (l *connLimiter) release(conn net.Conn) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+	l.byIP[ip]--
+	if l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// countTimeout records a connection closed for missing a deadline, if err says so
+func (l *connLimiter) countTimeout(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		l.lock.Lock()
+		l.timedOut++
+		l.lock.Unlock()
+	}
+}
+
+// stats returns the active connections and the rejection and timeout counters
+func (l *connLimiter) stats() (active int, rejectedFull int64, rejectedPerIP int64, timedOut int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.active, l.rejectedFull, l.rejectedPerIP, l.timedOut
+}
+
+// isFileName reports whether name can name a shared file: a single path element, so
+// it is safe to write to disk, without control characters that would garble lists and
+// the terminal
+func isFileName(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileManifest describes a file and is signed by its publisher with Ed25519, so peers can
+// tell who a file comes from
+type fileManifest struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash"`      // SHA-256 of the content, hex encoded
+	Publisher string `json:"publisher"` // Name the publisher goes by
+	Key       string `json:"key"`       // Publisher's public key, hex encoded
+	Signature string `json:"signature"` // Ed25519 signature of signedData, hex encoded
+}
+
+// signedData returns what the signature covers
+func (m *fileManifest) signedData() []byte {
+	return []byte(fmt.Sprintf("p2p manifest\n%s\n%d\n%s\n%s\n", m.Name, m.Size, m.Hash, m.Publisher))
+}
+
+// verify checks that the manifest is signed with the key it names
+func (m *fileManifest) verify() error {
+	if strings.Contains(m.Name, "\n") || strings.ContainsAny(m.Publisher, "\n:,") || m.Publisher == "" {
+		return errors.New("manifest has a bad file or publisher name")
+	}
+	key, err := hex.DecodeString(m.Key)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("manifest has a bad key")
+	}
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), m.signedData(), signature) {
+		return errors.New("manifest has a bad signature")
+	}
+	return nil
+}
+
+// publisherIdentity names a publisher for display, as "<name> (<first 16 hex digits of its key>)"
+func publisherIdentity(name string, key string) string {
+	return fmt.Sprintf("%s (%s)", name, key[:min(16, len(key))])
+}
+
+// swarmToken makes a token for a private swarm that is good until expires. Anyone with
+// the swarm's key can make one, so peers with the key make their own, and the owner can
+// hand out tokens to peers that shouldn't get the key.
+func swarmToken(swarm string, key string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(swarm + ":" + expiry))
+	return expiry + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// metricFamily describes one metric in the Prometheus text exposition format
+type metricFamily struct {
+	name  string
+	kind  string // counter, gauge or histogram
+	help  string
+	label string // Name of the family's one label, if it has one
+}
+
+// metricsRegistry holds metric samples and serves them in the Prometheus text
+// exposition format. Series are keyed by name and labels, e.g.
+// `requests_total{type="REGISTER"}`, and written in the order they first appeared.
+type metricsRegistry struct {
+	lock     sync.Mutex
+	families []metricFamily
+	values   map[string]float64 // Samples by series
+	order    []string           // Series in the order they first appeared
+	collect  func()             // Sets the gauges derived from live state before each scrape
+}
+
+// newMetricsRegistry creates a registry for the given metrics
+func newMetricsRegistry(families ...metricFamily) *metricsRegistry {
+	r := &metricsRegistry{families: families, values: make(map[string]float64)}
+	// Unlabelled series start at zero so they are scraped before their first event
+	for _, f := range families {
+		if f.kind != "histogram" && f.label == "" {
+			r.values[f.name] = 0
+			r.order = append(r.order, f.name)
+		}
+	}
+	return r
+}
+
+// label formats one label pair, escaping the value
+func label(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// series joins a metric name and its label pairs, skipping empty ones
+func series(name string, labels ...string) string {
+	var pairs []string
+	for _, l := range labels {
+		if l != "" {
+			pairs = append(pairs, l)
+		}
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// update applies a change to one sample. Caller must hold the lock.
+func (r *metricsRegistry) update(key string, change func(float64) float64) {
+	value, ok := r.values[key]
+	if !ok {
+		r.order = append(r.order, key)
+	}
+	r.values[key] = change(value)
+}
+
+// add increases a counter, or moves a gauge up or down
+func (r *metricsRegistry) add(name string, delta float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.update(series(name, labels...), func(v float64) float64 { return v + delta })
+}
+
+// set sets a gauge
+func (r *metricsRegistry) set(name string, value float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.update(series(name, labels...), func(float64) float64 { return value })
+}
+
+// reset drops every series of a metric, for gauges whose label sets come and go
+func (r *metricsRegistry) reset(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	kept := r.order[:0]
+	for _, key := range r.order {
+		if familyOf(key) == name {
+			delete(r.values, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	r.order = kept
+}
+
+// observe records a duration in a latency histogram
+func (r *metricsRegistry) observe(name string, d time.Duration, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	seconds := d.Seconds()
+	for _, bound := range latencyBuckets {
+		le := label("le", strconv.FormatFloat(bound, 'g', -1, 64))
+		r.update(series(name+"_bucket", append(slices.Clip(labels), le)...), func(v float64) float64 {
+			if seconds <= bound {
+				return v + 1
+			}
+			return v
+		})
+	}
+	r.update(series(name+"_bucket", append(slices.Clip(labels), label("le", "+Inf"))...), func(v float64) float64 { return v + 1 })
+	r.update(series(name+"_sum", labels...), func(v float64) float64 { return v + seconds })
+	r.update(series(name+"_count", labels...), func(v float64) float64 { return v + 1 })
+}
+
+// familyOf returns the metric a series belongs to, folding histogram series into theirs.
+// Counters and gauges therefore never end in _bucket, _sum or _count.
+func familyOf(key string) string {
+	name, _, _ := strings.Cut(key, "{")
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			return base
+		}
+	}
+	return name
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.collect != nil {
+		r.collect()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range r.families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, key := range r.order {
+			if familyOf(key) == family.name {
+				fmt.Fprintf(w, "%s %s\n", key, strconv.FormatFloat(r.values[key], 'g', -1, 64))
+			}
+		}
+	}
+}
+
+// metricsReadTimeout is how long a scraper may take to send its request headers
+const metricsReadTimeout = 10 * time.Second
+
+// serveMetrics serves the registry at /metrics on the given address until ctx is cancelled
+func serveMetrics(ctx context.Context, address string, registry *metricsRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: metricsReadTimeout}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("Serving metrics", "address", address+"/metrics")
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Error serving metrics", "err", err)
+	}
+}
+
+// newLogger builds a logger writing at the given level ("debug", "info", "warn" or "error")
+// as "text" or "json", to a file when path is set and to stderr otherwise
+func newLogger(level string, format string, path string) (*slog.Logger, error) {
+	var minimum slog.Level
+	err := minimum.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	var w io.Writer = os.Stderr
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file // Left open for the life of the process
+	}
+
+	options := &slog.HandlerOptions{Level: minimum}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
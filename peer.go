@@ -3,29 +3,223 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/bits"
 	"math/rand"
+	"mime"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const ChunkSize = 1024 // Size of each file chunk in bytes... not fully implemented
 
+const (
+	maxMessageSize     = 1 << 20               // Largest payload accepted on a peer connection
+	maxHeaderSize      = 4096                  // Largest header accepted on a peer connection
+	peerIdleTimeout    = 5 * time.Minute       // How long a connected peer may stay silent; above unchokeTimeout
+	writeTimeout       = 30 * time.Second      // How long sending one frame may take
+	dialTimeout        = 10 * time.Second      // How long connecting and handshaking with a peer may take
+	unchokeTimeout     = 2 * time.Minute       // How long a downloader waits for a peer to unchoke it
+	maxDownloadPeers   = 8                     // Most peers a single download fetches chunks from
+	corruptBanTime     = 10 * time.Minute      // Default ban for a peer that sent a corrupt chunk
+	swarmTokenTTL      = time.Hour             // Lifetime of the swarm tokens we make from a swarm key
+	rechokeInterval    = 10 * time.Second      // How often unchoke slots are reassigned
+	optimisticInterval = 30 * time.Second      // How often the optimistic unchoke rotates
+	pexInterval        = time.Minute           // How often peers of a download swap peer lists
+	reannounceInterval = 10 * time.Minute      // How often shared files are registered again; trackers expire them after 30 minutes
+	pexMinInterval     = 20 * time.Second      // PEX messages arriving faster than this from one peer are ignored
+	pexMaxPeers        = 50                    // Most addresses sent or accepted in one PEX message
+	pexMaxKnown        = 200                   // Most addresses remembered per file
+	pexMaxFiles        = 1000                  // Most files addresses are remembered for
+	pexPeerTTL         = 30 * time.Minute      // How long a learned address is passed on without being heard of again
+	discoveryGroup     = "239.255.42.99:29393" // UDP multicast group trackers and peers announce themselves on
+	discoveryInterval  = 5 * time.Second       // How often trackers and peers announce themselves on the LAN
+	discoveryTTL       = 30 * time.Second      // How long a LAN announcement stays valid
+	connectBackTimeout = 15 * time.Second      // How long to wait for a peer behind NAT to connect back
+	maxRelays          = 16                    // Most connections this peer relays at once
+	shutdownTimeout    = 10 * time.Second      // Default limit on how long a graceful shutdown may take
+
+	defaultControlAddress = "127.0.0.1:29394" // Where the daemon takes commands unless told otherwise
+)
+
+// logger receives everything the peer logs. It discards until main or an embedding
+// program sets one with SetLogger, so the peer writes nothing on its own.
+var logger = slog.New(slog.DiscardHandler)
+
+// SetLogger sends the peer's logs to l. Call it before creating peers.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 type P2PPeer struct {
-	peers          []net.Conn // Slice of network connections to other peers
-	availableFiles []string   // List of available files for sharing
+	id             string                     // Random peer ID announced in handshakes
+	port           string                     // Port of this peer's server
+	peers          []net.Conn                 // Slice of network connections to other peers
+	availableFiles []string                   // List of available files for sharing
+	files          map[string]*sharedFile     // Files we can serve chunks of, by name
+	filesLock      sync.Mutex                 // Guards availableFiles and files
+	limiter        *bandwidthLimiter          // Upload and download rate limits
+	uploads        *uploadSlots               // Cap on concurrent uploads with a wait queue
+	choker         *choker                    // Decides which peers we upload to
+	dht            *dhtNode                   // Kademlia node for trackerless lookups, nil when disabled
+	trackers       *trackerList               // Trackers to announce to and query, possibly none
+	pex            *peerExchange              // Peers known to hold each file, shared with other peers
+	lan            *lanDiscovery              // Trackers and peers found on the local network, nil when disabled
+	reachable      bool                       // Other peers can dial our server; false behind NAT
+	relay          bool                       // Join connections of peers that can't reach each other
+	relays         []string                   // Relays to fall back on for peers behind NAT
+	pending        *rendezvous                // Connections we or our relay clients are waiting for
+	transport      string                     // Transport for new connections to peers: "tcp" or "utp"
+	transportLock  sync.Mutex                 // Guards transport, which can be switched at the prompt
+	ctx            context.Context            // Cancelled when the peer starts shutting down
+	stop           context.CancelFunc         // Cancels ctx
+	shutdownOnce   sync.Once                  // Lets the EXIT command and a signal both call shutdown
+	downloads      sync.WaitGroup             // Downloads in progress
+	active         map[string]*activeDownload // Downloads in progress, by the path they are written to; nil while one starts
+	progress       *progressHub               // Progress events of the downloads in progress
+	queue          *downloadQueue             // Downloads waiting and running, nil until set up
+	activeLock     sync.Mutex                 // Guards active
+	drained        chan struct{}              // Closed once in-flight uploads finished during shutdown
+	connLimits     *connLimiter               // Caps on the connections our server handles at once
+	access         *accessList                // Hosts and peers we refuse to talk to
+	corruptBan     time.Duration              // How long a peer that sent a corrupt chunk is banned
+	swarm          *swarmCredentials          // Private swarm our files are registered in, nil for the public one
+	trusted        map[string]string          // Names of the publishers whose signed files we download, by key; nil to download any file
+	metrics        *metricsRegistry           // Counters and gauges served at /metrics
 }
 
 // NewP2PPeer creates and returns a new P2PPeer instance
 func NewP2PPeer() *P2PPeer {
-	return &P2PPeer{
+	ctx, stop := context.WithCancel(context.Background())
+	c := &P2PPeer{
+		id:             newPeerID(),
 		peers:          make([]net.Conn, 0),
 		availableFiles: make([]string, 0),
+		files:          make(map[string]*sharedFile),
+		limiter:        newBandwidthLimiter(),
+		uploads:        newUploadSlots(0, 0),
+		choker:         newChoker(4),
+		trackers:       &trackerList{},
+		pex:            newPeerExchange(),
+		reachable:      true,
+		pending:        newRendezvous(),
+		transport:      "tcp",
+		ctx:            ctx,
+		stop:           stop,
+		active:         make(map[string]*activeDownload),
+		progress:       newProgressHub(),
+		drained:        make(chan struct{}),
+		connLimits:     newConnLimiter(0, 0),
+		access:         &accessList{temporary: make(map[string]time.Time)},
+		corruptBan:     corruptBanTime,
+		metrics: newMetricsRegistry(
+			metricFamily{"peer_uploaded_bytes_total", "counter", "Chunk bytes sent to other peers.", ""},
+			metricFamily{"peer_downloaded_bytes_total", "counter", "Chunk bytes received from other peers.", ""},
+			metricFamily{"peer_chunks_served_total", "counter", "Chunks sent to other peers.", ""},
+			metricFamily{"peer_chunks_downloaded_total", "counter", "Chunks received and written.", ""},
+			metricFamily{"peer_active_uploads", "gauge", "Uploads holding an upload slot.", ""},
+			metricFamily{"peer_queued_uploads", "gauge", "Uploads waiting for an upload slot.", ""},
+			metricFamily{"peer_active_downloads", "gauge", "Downloads in progress.", ""},
+			metricFamily{"peer_shared_files", "gauge", "Files we serve chunks of, complete or not.", ""},
+			metricFamily{"peer_upload_rate_bytes", "gauge", "Recent upload rate to each connected peer, in bytes per second.", "peer"},
+			metricFamily{"peer_download_rate_bytes", "gauge", "Recent download rate from each connected peer, in bytes per second.", "peer"},
+			metricFamily{"peer_hash_failures_total", "counter", "Downloads discarded for not matching the requested hash.", ""},
+			metricFamily{"peer_errors_total", "counter", "Errors, by kind.", "kind"},
+			metricFamily{"peer_connections_active", "gauge", "Connections our server is handling.", ""},
+			metricFamily{"peer_connections_rejected_total", "counter", "Connections our server turned away, by reason.", "reason"},
+			metricFamily{"peer_connections_timed_out_total", "counter", "Connections closed for missing a deadline.", ""},
+		),
+	}
+	c.metrics.collect = c.collectMetrics
+	return c
+}
+
+// collectMetrics sets the gauges derived from live state
+func (c *P2PPeer) collectMetrics() {
+	active, queued := c.uploads.status()
+	c.metrics.set("peer_active_uploads", float64(active))
+	c.metrics.set("peer_queued_uploads", float64(queued))
+	c.metrics.set("peer_shared_files", float64(len(c.sharedFiles())))
+
+	// Peers come and go, so their series are rebuilt on every scrape
+	c.metrics.reset("peer_upload_rate_bytes")
+	c.metrics.reset("peer_download_rate_bytes")
+	for _, p := range c.choker.snapshot() {
+		c.metrics.set("peer_upload_rate_bytes", p.uploadRate, label("peer", p.id))
+		c.metrics.set("peer_download_rate_bytes", p.downloadRate, label("peer", p.id))
+	}
+
+	conns, rejectedFull, rejectedPerIP, timedOut := c.connLimits.stats()
+	c.metrics.set("peer_connections_active", float64(conns))
+	c.metrics.set("peer_connections_rejected_total", float64(rejectedFull), label("reason", "limit"))
+	c.metrics.set("peer_connections_rejected_total", float64(rejectedPerIP), label("reason", "per_ip"))
+	c.metrics.set("peer_connections_timed_out_total", float64(timedOut))
+}
+
+// newPeerID generates a random 160-bit peer ID encoded as hex
+func newPeerID() string {
+	id := make([]byte, 20)
+	if _, err := crand.Read(id); err != nil {
+		// Fall back to the pseudo-random generator if the system source is unavailable
+		rand.Read(id)
+	}
+	return hex.EncodeToString(id)
+}
+
+// isPeerID reports whether id looks like an ID from newPeerID. The IDs peers send in their
+// handshakes are checked with it before they are used as keys or shown.
+func isPeerID(id string) bool {
+	if len(id) != 40 {
+		return false
 	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// isHello reports whether msg is a well-formed handshake: "HELLO:<peer ID>:<port>", with
+// ":<swarm ID>:<token>" added by peers in a private swarm
+func isHello(msg message) bool {
+	return msg.kind == "HELLO" && (len(msg.args) == 2 || len(msg.args) == 4) && isPeerID(msg.args[0])
+}
+
+// shortID returns the start of a peer ID for display
+func shortID(id string) string {
+	return id[:min(8, len(id))]
 }
 
 // pickRandomFile selects a random file from a given directory
@@ -38,7 +232,7 @@ func (c *P2PPeer) pickRandomFile(directory string) (string, error) {
 	// Add file to array
 	var fileNames []string
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), manifestSuffix) {
 			fileNames = append(fileNames, entry.Name())
 		}
 	}
@@ -57,66 +251,612 @@ func (c *P2PPeer) pickRandomFile(directory string) (string, error) {
 	return selectedFile, nil
 }
 
-// startPeerServer starts a TCP server to listen for incoming connections
+// startPeerServer starts a TCP server to listen for incoming connections, on a free port
+// when port is "0". It returns the port it listens on.
 // This is the server aspect of the peer
-func (c *P2PPeer) startPeerServer(port string) string {
+func (c *P2PPeer) startPeerServer(port string) (string, error) {
 	// Create a server on user input port number
 	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		fmt.Println("Error starting my server:", err.Error())
-		return "error"
+		return "", err
+	}
+	port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	logger.Info("My server is running", "port", port)
+
+	// Periodically reassign unchoke slots among connected peers
+	go c.choker.run()
+
+	// Accept uTP connections on the UDP port of the same number
+	utp, err := listenUTP(port)
+	if err != nil {
+		logger.Error("Error starting my uTP server", "port", port, "err", err)
+	} else {
+		go c.acceptConnections(utp)
 	}
-	defer listener.Close()
 
-	fmt.Println("My server is running on port " + port)
+	// Stop taking connections as soon as shutdown begins
+	go func() {
+		<-c.ctx.Done()
+		listener.Close()
+		if utp != nil {
+			utp.Close()
+		}
+	}()
 
 	// Server listening for incoming connections
+	go c.acceptConnections(listener)
+	return port, nil
+}
+
+// acceptConnections serves every connection made to a listener
+func (c *P2PPeer) acceptConnections(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection:", err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("Error accepting connection", "err", err)
+			continue
+		}
+
+		// Turn away denied and banned hosts
+		if !c.access.allowsAddress(conn.RemoteAddr().String()) {
+			c.metrics.add("peer_connections_rejected_total", 1, label("reason", "denied"))
+			conn.Close()
 			continue
 		}
 
+		// Turn away connections beyond the limits rather than letting them pile up
+		if !c.connLimits.admit(conn) {
+			conn.Close()
+			continue
+		}
 		go func() {
-			defer conn.Close()
-			buffer := make([]byte, 1024)
-			n, err := conn.Read(buffer)
-			if err != nil {
-				fmt.Println("Error reading request:", err.Error())
-				return
+			defer c.connLimits.release(conn)
+			c.handlePeerConnection(conn)
+		}()
+	}
+}
+
+// dial connects to a peer's server over our transport. Peers that don't answer
+// over uTP are reached over TCP instead.
+func (c *P2PPeer) dial(address string) (net.Conn, error) {
+	c.transportLock.Lock()
+	transport := c.transport
+	c.transportLock.Unlock()
+
+	if transport == "utp" {
+		conn, err := dialUTP(address, dialTimeout/2)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout("tcp", address, dialTimeout)
+}
+
+// handlePeerConnection serves another peer for as long as it stays connected.
+// The peer has to introduce itself with HELLO before it can ask for chunks.
+func (c *P2PPeer) handlePeerConnection(conn net.Conn) {
+	session := newPeerSession(conn)
+
+	// Peers that connect have to introduce themselves promptly
+	msg, err := session.receiveWithin(dialTimeout)
+	if err != nil {
+		c.connLimits.countTimeout(err)
+		logger.Warn("Error reading request", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+
+	// Connections set up for NAT traversal are handed over to whoever waits for them
+	switch msg.kind {
+	case "REVERSE":
+		if len(msg.args) != 1 || !c.pending.deliver(msg.args[0], session) {
+			conn.Close()
+		}
+		return
+	case "RELAY":
+		c.relayFor(session, msg)
+		return
+	}
+
+	c.servePeer(session, msg, true)
+}
+
+// servePeer answers a peer's requests after its HELLO. When direct is false the
+// connection was made for NAT traversal and its remote address is not the peer's
+// own, so it isn't passed on to the DHT or PEX.
+func (c *P2PPeer) servePeer(session *peerSession, hello message, direct bool) {
+	conn := session.conn
+	defer conn.Close()
+
+	// Hang up once shutdown has drained the uploads in flight
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-c.drained:
+			conn.Close()
+		case <-served:
+		}
+	}()
+
+	// Exchange handshakes so both sides know who they are talking to
+	if !isHello(hello) {
+		logger.Warn("Unexpected handshake", "peer", conn.RemoteAddr().String())
+		return
+	}
+	session.peerID = hello.args[0]
+	session.listenPort = hello.args[1]
+	if !c.access.allowsPeer(session.peerID) {
+		c.metrics.add("peer_connections_rejected_total", 1, label("reason", "denied"))
+		logger.Debug("Refused denied peer", "peer", conn.RemoteAddr().String(), "peer_id", session.peerID)
+		return
+	}
+	if !c.swarm.admits(hello.args[2:]) {
+		c.metrics.add("peer_connections_rejected_total", 1, label("reason", "swarm"))
+		logger.Debug("Refused peer from another swarm", "peer", conn.RemoteAddr().String(), "peer_id", session.peerID)
+		return
+	}
+	err := session.send("HELLO", nil, append([]string{c.id, c.port}, c.swarm.hello()...)...)
+	if err != nil {
+		logger.Warn("Error sending handshake", "peer", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	// The address other peers can reach this peer's server on, passed on through PEX
+	serverAddress := ""
+	if direct && session.listenPort != "" {
+		remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		serverAddress = net.JoinHostPort(remoteHost, session.listenPort)
+	}
+
+	// Every peer that talks to us is a candidate for the DHT routing table
+	if c.dht != nil && serverAddress != "" {
+		c.dht.seen(session.peerID, serverAddress)
+	}
+	var lastPEX time.Time
+
+	// Peers join the choke rotation once they ask for file data, not for DHT requests
+	trading := false
+	defer func() {
+		if trading {
+			c.choker.disconnect(session)
+		}
+	}()
+
+	// Stop sending HAVE updates once the peer is gone
+	var watched []*sharedFile
+	defer func() {
+		for _, file := range watched {
+			file.unwatch(session)
+		}
+	}()
+
+	for {
+		msg, err := session.receiveWithin(peerIdleTimeout)
+		if err != nil {
+			c.connLimits.countTimeout(err)
+			if err != io.EOF {
+				logger.Warn("Error reading request", "peer", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+
+		// The choker tells the peer whether it may download from us right away
+		if !trading && (msg.kind == "INTERESTED" || msg.kind == "GET_BITFIELD" || msg.kind == "GET_CHUNK") {
+			trading = true
+			c.choker.connect(session)
+		}
+
+		switch msg.kind {
+		case "PING", "FIND_NODE", "FIND_VALUE", "STORE":
+			if c.dht == nil {
+				session.send("NO_DHT", nil)
+				continue
 			}
-			// Parse incoming message
-			request := string(buffer[:n])
-			parts := strings.Split(request, ":")
+			c.dht.handleRequest(session, msg)
 
-			// Read request for chunks
-			if len(parts) == 3 && parts[0] == "GET_CHUNK" {
-				fileName := parts[1]
-				chunkIndex, _ := strconv.Atoi(parts[2])
-				// Send over file chunk
-				c.serveFileChunk(conn, fileName, chunkIndex)
+		case "INTERESTED":
+			c.choker.setInterested(session, true)
+
+		case "NOT_INTERESTED":
+			c.choker.setInterested(session, false)
+
+		case "GET_BITFIELD":
+			if len(msg.args) != 1 {
+				continue
 			}
-		}()
+			file := c.lookupFile(msg.args[0])
+			if file == nil {
+				session.send("NO_FILE", nil, msg.args[0])
+				continue
+			}
+
+			// Send the chunks we hold and keep the peer posted as more arrive
+			size, bitfield := file.watch(session)
+			watched = append(watched, file)
+			session.send("BITFIELD", bitfield, file.name, strconv.FormatInt(size, 10))
+
+			// The peer is joining the swarm of this file
+			if serverAddress != "" {
+				c.pex.add(file.name, []string{serverAddress})
+			}
+
+		case "GET_HASHES":
+			if len(msg.args) != 1 {
+				continue
+			}
+			file := c.lookupFile(msg.args[0])
+			var hashes []byte
+			if file != nil {
+				hashes, err = file.getChunkHashes()
+				if err != nil {
+					logger.Error("Error hashing chunks", "file", file.name, "err", err)
+				}
+			}
+			if hashes == nil {
+				session.send("NO_HASHES", nil, msg.args[0])
+				continue
+			}
+			session.send("HASHES", hashes, msg.args[0])
+
+		case "GET_MANIFEST":
+			if len(msg.args) != 1 {
+				continue
+			}
+			var manifest []byte
+			if file := c.lookupFile(msg.args[0]); file != nil {
+				manifest = file.getManifest()
+			}
+			if manifest == nil {
+				session.send("NO_MANIFEST", nil, msg.args[0])
+				continue
+			}
+			session.send("MANIFEST", manifest, msg.args[0])
+
+		case "PEX":
+			if len(msg.args) != 1 {
+				continue
+			}
+
+			// Ignore peers that send lists too often rather than letting them flood us
+			if time.Since(lastPEX) < pexMinInterval {
+				continue
+			}
+			lastPEX = time.Now()
+
+			// Only lists for files we share or are downloading are kept, so a peer
+			// can't fill our memory with made up names
+			file := c.lookupFile(msg.args[0])
+			if file == nil {
+				continue
+			}
+
+			// Merge their list and answer with ours
+			c.pex.add(file.name, decodePeerList(msg.payload))
+			peers := c.pex.list(file.name, serverAddress, pexMaxPeers)
+			session.send("PEX", encodePeerList(peers), msg.args[0])
+
+		case "GET_CHUNK":
+			if len(msg.args) != 2 {
+				continue
+			}
+			fileName := msg.args[0]
+			chunkIndex, _ := strconv.Atoi(msg.args[1])
+
+			// Only chunks we actually hold can be served
+			file := c.lookupFile(fileName)
+			if file == nil || !file.hasChunk(chunkIndex) {
+				session.send("NO_CHUNK", nil, fileName, msg.args[1])
+				continue
+			}
+
+			// Choked peers are reminded that they have to wait for an unchoke, and
+			// while shutting down every peer is choked
+			if c.choker.isChoking(session) || c.ctx.Err() != nil {
+				session.send("CHOKE", nil)
+				continue
+			}
+
+			// Wait for a free upload slot, or tell the peer to retry if the queue is full
+			if !c.uploads.acquire() {
+				logger.Info("Upload queue full, rejecting request", "peer", conn.RemoteAddr().String())
+				session.send("BUSY", nil)
+				continue
+			}
+
+			// Send over file chunk
+			c.serveFileChunk(session, file, chunkIndex)
+			c.uploads.release()
+		}
+	}
+}
+
+// trackerAddresses returns the addresses to reach a tracker on, one for each IP family
+// its host resolves to, so registering on all of them gives the tracker both our IPv4
+// and our IPv6 endpoint
+func trackerAddresses(trackerHost string, trackerPort string) []string {
+	ips, err := net.LookupIP(trackerHost)
+	if err != nil || len(ips) == 0 {
+		return []string{net.JoinHostPort(trackerHost, trackerPort)}
+	}
+
+	var v4, v6 string
+	for _, ip := range ips {
+		if ip.To4() != nil && v4 == "" {
+			v4 = net.JoinHostPort(ip.String(), trackerPort)
+		}
+		if ip.To4() == nil && v6 == "" {
+			v6 = net.JoinHostPort(ip.String(), trackerPort)
+		}
+	}
+
+	var addrs []string
+	for _, address := range []string{v4, v6} {
+		if address != "" {
+			addrs = append(addrs, address)
+		}
+	}
+	return addrs
+}
+
+// manifestSuffix is added to a file's path to find its signed manifest
+const manifestSuffix = ".manifest"
+
+// sign fills in the key and signature
+func (m *fileManifest) sign(key ed25519.PrivateKey) {
+	m.Key = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	m.Signature = hex.EncodeToString(ed25519.Sign(key, m.signedData()))
+}
+
+// publisherLabels lists the publishers the trackers name for a file. Trackers only check
+// the signatures, not that the peers' files match the signed hash, so each is marked
+// unverified unless it signed the manifest we hold, which was checked against our copy.
+func (c *P2PPeer) publisherLabels(name string, publishers []string) string {
+	verified := ""
+	if file := c.lookupFile(name); file != nil && file.getManifest() != nil {
+		m, err := parseManifest(file.getManifest())
+		if err == nil {
+			verified = publisherIdentity(m.Publisher, m.Key)
+		}
+	}
+	labels := make([]string, len(publishers))
+	for i, publisher := range publishers {
+		labels[i] = publisher
+		if publisher != verified {
+			labels[i] += " (unverified)"
+		}
+	}
+	return strings.Join(labels, ", ")
+}
+
+// parseManifest reads a manifest and checks its signature
+func parseManifest(data []byte) (*fileManifest, error) {
+	var m fileManifest
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, m.verify()
+}
+
+// loadManifest reads the signed manifest kept next to a shared file, if there is one that
+// is signed and describes the file. It returns nil otherwise.
+func loadManifest(path string, name string, size int64, hash string) []byte {
+	data, err := os.ReadFile(path + manifestSuffix)
+	if err != nil {
+		return nil
+	}
+	m, err := parseManifest(data)
+	if err == nil && (m.Name != name || m.Size != size || m.Hash != hash) {
+		err = errors.New("manifest is for another file")
+	}
+	if err != nil {
+		logger.Warn("Ignoring manifest", "path", path+manifestSuffix, "err", err)
+		return nil
+	}
+	return data
+}
+
+// readTrustedKeys reads the publisher keys to trust from a file of "<hex key> <name>" lines.
+// Blank lines and lines starting with # are skipped. It returns the names by key.
+func readTrustedKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trusted := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: line %d: expected a public key of 64 hex digits", path, n+1)
+		}
+		trusted[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return trusted, nil
+}
+
+// requestManifest asks a peer for the signed manifest of a file. It returns nil if the
+// peer has none. Chunks the peer announces meanwhile are added to its bitfield.
+func (c *P2PPeer) requestManifest(session *peerSession, fileName string, bitfield []byte) ([]byte, error) {
+	err := session.send("GET_MANIFEST", nil, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(dialTimeout)
+	for {
+		msg, err := session.next(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.kind {
+		case "CHOKE":
+			session.choked = true
+		case "UNCHOKE":
+			session.choked = false
+		case "HAVE":
+			if len(msg.args) != 2 || msg.args[0] != fileName {
+				continue
+			}
+			chunkIndex, err := strconv.Atoi(msg.args[1])
+			if err == nil && chunkIndex >= 0 && chunkIndex/8 < len(bitfield) {
+				bitfield[chunkIndex/8] |= 0x80 >> (chunkIndex % 8)
+			}
+		case "NO_MANIFEST":
+			return nil, nil
+		case "MANIFEST":
+			if len(msg.args) == 1 && msg.args[0] == fileName {
+				return msg.payload, nil
+			}
+		}
+	}
+}
+
+// trustedManifest asks the peers for the manifest of a file until one comes signed by a
+// trusted publisher and matches the file. It returns the manifest as sent and parsed.
+func (c *P2PPeer) trustedManifest(fileName string, expectedHash string, size int64, sessions []*peerSession, bitfields [][]byte) ([]byte, *fileManifest, error) {
+	for i, session := range sessions {
+		data, err := c.requestManifest(session, fileName, bitfields[i])
+		if err != nil || data == nil {
+			continue
+		}
+
+		m, err := parseManifest(data)
+		if err == nil {
+			err = c.checkManifest(m, fileName, expectedHash, size)
+		}
+		if err != nil {
+			logger.Warn("Ignoring manifest", "peer", session.conn.RemoteAddr().String(), "file", fileName, "err", err)
+			continue
+		}
+		return data, m, nil
+	}
+	return nil, nil, errors.New("no peer has a manifest of the file signed by a trusted publisher")
+}
+
+// checkManifest checks that a manifest comes from a trusted publisher and describes the
+// file being downloaded: its size, and the hash it was requested by or else its name
+func (c *P2PPeer) checkManifest(m *fileManifest, fileName string, expectedHash string, size int64) error {
+	_, trusted := c.trusted[m.Key]
+	switch {
+	case !trusted:
+		return fmt.Errorf("publisher %s is not trusted", publisherIdentity(m.Publisher, m.Key))
+	case m.Size != size:
+		return fmt.Errorf("manifest is for a file of %d bytes, not %d", m.Size, size)
+	case expectedHash != "" && m.Hash != expectedHash:
+		return fmt.Errorf("manifest is for a file with hash %s", m.Hash)
+	case expectedHash == "" && m.Name != fileName:
+		return fmt.Errorf("manifest is for %s", m.Name)
+	}
+	return nil
+}
+
+// swarmCredentials let the peer into a private swarm on the trackers
+type swarmCredentials struct {
+	id    string // Swarm ID
+	key   string // Key the swarm's tokens are made with, if we have it
+	token string // Token from the swarm's owner, used when we have no key
+}
+
+// suffix returns what ends the tracker requests made in the swarm: its ID and a token.
+// Requests in the public swarm have none.
+func (s *swarmCredentials) suffix() string {
+	if s == nil {
+		return ""
+	}
+	token := s.token
+	if s.key != "" {
+		token = swarmToken(s.id, s.key, time.Now().Add(swarmTokenTTL))
+	}
+	return ":" + s.id + ":" + token
+}
+
+// hello returns what ends our handshake with other peers: the swarm's ID and a token.
+// A token from the owner goes out even when we have the key, so that peers holding
+// only that token take us in.
+func (s *swarmCredentials) hello() []string {
+	if s == nil {
+		return nil
+	}
+	token := s.token
+	if token == "" {
+		token = swarmToken(s.id, s.key, time.Now().Add(swarmTokenTTL))
+	}
+	return []string{s.id, token}
+}
+
+// admits reports whether a peer whose handshake ended with args belongs in our swarm.
+// With the key the token is checked the way trackers check it. Without the key it can't
+// be, so only a peer presenting our own token is taken in.
+func (s *swarmCredentials) admits(args []string) bool {
+	if s == nil {
+		return len(args) == 0
+	}
+	if len(args) != 2 || args[0] != s.id {
+		return false
+	}
+	token := args[1]
+	expiry, _, found := strings.Cut(token, ".")
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if !found || err != nil || time.Now().Unix() > seconds {
+		return false
+	}
+	if s.key != "" {
+		return hmac.Equal([]byte(token), []byte(swarmToken(s.id, s.key, time.Unix(seconds, 0))))
+	}
+	return hmac.Equal([]byte(token), []byte(s.token))
+}
+
+// connectToTracker registers a file with a tracker over every IP family it can be reached on
+func (c *P2PPeer) connectToTracker(trackerHost string, trackerPort string, fileName string, myServerPort string) error {
+	var err error
+	registered := false
+	for _, address := range trackerAddresses(trackerHost, trackerPort) {
+		if e := c.registerWithTracker(address, fileName, myServerPort); e != nil {
+			err = e
+			continue
+		}
+		registered = true
 	}
+	if !registered {
+		return err
+	}
+
+	logger.Info("Registered file with tracker", "tracker", net.JoinHostPort(trackerHost, trackerPort), "file", fileName)
+	return nil
 }
 
-// connectToTracker connects to a tracker server and registers the peer
-func (c *P2PPeer) connectToTracker(trackerHost string, trackerPort string, fileName string, myServerPort string) {
+// registerWithTracker registers a file with the tracker at one address
+func (c *P2PPeer) registerWithTracker(address string, fileName string, myServerPort string) error {
 	// Start a TCP connection with tracker
-	conn, err := net.Dial("tcp", trackerHost+":"+trackerPort)
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
 	if err != nil {
-		fmt.Println("Error connecting to tracker:", err.Error())
-		return
+		return err
 	}
 	defer conn.Close()
 
-	// Register to join the network
-	infoMessage := fmt.Sprintf("REGISTER:%s:%s", fileName, myServerPort)
+	// Register to join the network, along with the file's signed manifest if it has one
+	infoMessage := fmt.Sprintf("REGISTER:%s:%s", fileName, myServerPort) + c.swarm.suffix()
+	if file := c.lookupFile(fileName); file != nil && file.getManifest() != nil {
+		var manifest bytes.Buffer
+		json.Compact(&manifest, file.getManifest())
+		infoMessage = fmt.Sprintf("PUBLISH:%s:%s:%s", fileName, myServerPort, base64.StdEncoding.EncodeToString(manifest.Bytes())) + c.swarm.suffix()
+	}
 	_, err = conn.Write([]byte(infoMessage))
 	if err != nil {
-		fmt.Println("Error sending message to tracker:", err.Error())
-		return
+		return err
 	}
 
 	// Buffer for incoming data
@@ -125,50 +865,52 @@ func (c *P2PPeer) connectToTracker(trackerHost string, trackerPort string, fileN
 	// Read data into buffer
 	n, err := conn.Read(buffer)
 	if err != nil {
-		fmt.Println("Error receiving message from tracker:", err.Error())
+		return err
 	}
 
 	// Convert the received bytes to a string
 	receivedMsg := string(buffer[:n])
 
 	// Check if the received message is "OK"
-	if receivedMsg == "OK" {
-		fmt.Println("Received 'OK' from tracker")
-		fmt.Println("Sucessfully registered with tracker")
-	} else {
-		fmt.Println("Received different message:", receivedMsg)
+	if receivedMsg != "OK" {
+		return fmt.Errorf("tracker answered %q", receivedMsg)
 	}
+	return nil
 }
 
 // requestFileFromTracker asks the tracker for peers who have a specific file
 func (c *P2PPeer) requestFileFromTracker(trackerHost string, trackerPort string, fileName string) string {
 	// Start TCP connection with tracker
-	conn, err := net.Dial("tcp", trackerHost+":"+trackerPort)
+	conn, err := net.Dial("tcp", net.JoinHostPort(trackerHost, trackerPort))
 	if err != nil {
-		fmt.Println("Error connecting to tracker:", err.Error())
+		logger.Error("Error connecting to tracker", "tracker", net.JoinHostPort(trackerHost, trackerPort), "err", err)
 		return ""
 	}
 	defer conn.Close()
 
 	// Send a file request message to tracker
-	requestMessage := fmt.Sprintf("REQUEST_FILE:%s", fileName)
+	requestMessage := fmt.Sprintf("REQUEST_FILE:%s", fileName) + c.swarm.suffix()
 	_, err = conn.Write([]byte(requestMessage))
 	if err != nil {
-		fmt.Println("Error sending request to tracker:", err.Error())
+		logger.Error("Error sending request to tracker", "tracker", net.JoinHostPort(trackerHost, trackerPort), "err", err)
 		return ""
 	}
 
 	buffer := make([]byte, 1024)
 	n, err := conn.Read(buffer)
 	if err != nil {
-		fmt.Println("Error reading from tracker:", err.Error())
+		logger.Error("Error reading from tracker", "tracker", net.JoinHostPort(trackerHost, trackerPort), "err", err)
 		return ""
 	}
 
 	// Parse response from tracker
 	response := string(buffer[:n])
 	if response == "NO_PEER" {
-		fmt.Println("No peer has the requested file")
+		logger.Debug("No peer has the requested file", "tracker", net.JoinHostPort(trackerHost, trackerPort), "file", fileName)
+		return ""
+	}
+	if response == "DENIED" {
+		logger.Error("Tracker refused our swarm token", "tracker", net.JoinHostPort(trackerHost, trackerPort))
 		return ""
 	}
 
@@ -176,104 +918,7125 @@ func (c *P2PPeer) requestFileFromTracker(trackerHost string, trackerPort string,
 	return response
 }
 
-// connectToPeer establishes a connection with another peer
-func (c *P2PPeer) connectToPeer(peerHost string, peerPort string) {
-	conn, err := net.Dial("tcp", peerHost+":"+peerPort)
+// requestPeersFromTracker asks the tracker for every peer that has a specific file
+func (c *P2PPeer) requestPeersFromTracker(trackerHost string, trackerPort string, fileName string) ([]string, error) {
+	// Start TCP connection with tracker
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(trackerHost, trackerPort), dialTimeout)
 	if err != nil {
-		fmt.Println("Error connecting to peer:", err.Error())
-		return
+		return nil, err
 	}
-	c.peers = append(c.peers, conn)
-	fmt.Println("Connected to peer at " + peerHost + ":" + peerPort)
-}
+	defer conn.Close()
 
-// downloadFile handles the downloading of a file from a peer
-func (c *P2PPeer) downloadFile(peerConn net.Conn, fileName string, totalChunks int) {
-	outFile, err := os.Create(fileName)
+	// Send a peer list request message to tracker
+	requestMessage := fmt.Sprintf("REQUEST_PEERS:%s", fileName) + c.swarm.suffix()
+	_, err = conn.Write([]byte(requestMessage))
 	if err != nil {
-		fmt.Println("Error creating file:", err.Error())
-		return
+		return nil, err
 	}
-	defer outFile.Close()
 
-	// For each chunk send a get chunk request message to the uploading peer
-	for i := 0; i < totalChunks; i++ {
-		requestMessage := fmt.Sprintf("GET_CHUNK:%s:%d", fileName, i)
-		// Send request message
-		_, err = peerConn.Write([]byte(requestMessage))
-		if err != nil {
-			fmt.Println("Error sending chunk request:", err.Error())
-			return
-		}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
 
-		// Parse the received chunk
-		// This may present an error if the buffer is not large enough for the entire chunk
-		buffer := make([]byte, ChunkSize)
-		n, err := peerConn.Read(buffer)
+	// The tracker answers with a comma separated list of peers
+	if string(response) == "NO_PEER" || len(response) == 0 {
+		return nil, nil
+	}
+	if string(response) == "DENIED" {
+		return nil, errors.New("tracker refused our swarm token")
+	}
+	return strings.Split(string(response), ","), nil
+}
 
-		if err != nil {
-			fmt.Println("Error receiving chunk:", err.Error())
-			return
+// leaveTracker tells a tracker that the peer is leaving the network, over every IP
+// family it registered on
+func (c *P2PPeer) leaveTracker(trackerHost string, trackerPort string) error {
+	var err error
+	for _, address := range trackerAddresses(trackerHost, trackerPort) {
+		conn, e := net.DialTimeout("tcp", address, dialTimeout)
+		if e != nil {
+			err = e
+			continue
+		}
+
+		requestMessage := "EXIT:" + c.port        // Exit the network; the port tells the tracker which peer we are
+		_, e = conn.Write([]byte(requestMessage)) // Inform the tracker that peer is leaving
+		conn.Close()
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// shutdown stops the peer gracefully. It stops taking connections and new chunk
+// requests, deregisters from the trackers, lets downloads finish the chunks being
+// written and save their state, and waits for uploads in flight, all within timeout.
+// Later calls wait for the first to finish.
+func (c *P2PPeer) shutdown(timeout time.Duration) {
+	c.shutdownOnce.Do(func() {
+		c.stop()
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			c.leaveTrackers()
+		}()
+		go func() {
+			defer wg.Done()
+			c.downloads.Wait()
+		}()
+		go func() {
+			defer wg.Done()
+			c.uploads.waitIdle()
+		}()
+
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(timeout):
+			logger.Warn("Shutdown timed out", "timeout", timeout)
+		}
+		close(c.drained)
+	})
+}
+
+// trackerEndpoint is one configured tracker and its health
+type trackerEndpoint struct {
+	host      string
+	port      string
+	failures  int       // Consecutive failed requests
+	retryAt   time.Time // The tracker is skipped until this time after a failure
+	lastError string    // Most recent failure, for the TRACKERS command
+}
+
+// trackerList holds the configured trackers in tiers. Tiers are used in order, and within
+// a tier the trackers are tried one after another until one answers. The tracker that
+// answered moves to the front of its tier so it is tried first next time.
+type trackerList struct {
+	lock        sync.Mutex
+	tiers       [][]*trackerEndpoint
+	announceAll bool // Register with every tracker instead of one per tier
+}
+
+const (
+	trackerBackoff    = 5 * time.Second  // Time an unhealthy tracker is skipped after its first failure
+	maxTrackerBackoff = 10 * time.Minute // Cap on the doubling backoff for repeated failures
+)
+
+// parseTrackerList reads trackers given as "host:port,host:port;host:port", where
+// commas separate trackers within a tier and semicolons separate tiers
+func parseTrackerList(spec string) (*trackerList, error) {
+	list := &trackerList{}
+	for _, tierSpec := range strings.Split(spec, ";") {
+		var tier []*trackerEndpoint
+		for _, address := range strings.Split(tierSpec, ",") {
+			address = strings.TrimSpace(address)
+			if address == "" {
+				continue
+			}
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			tier = append(tier, &trackerEndpoint{host: host, port: port})
+		}
+		if len(tier) > 0 {
+			// Spread load across a tier, as every peer would otherwise pick the first tracker
+			rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+			list.tiers = append(list.tiers, tier)
+		}
+	}
+	return list, nil
+}
+
+// count returns the number of configured trackers
+func (l *trackerList) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := 0
+	for _, tier := range l.tiers {
+		n += len(tier)
+	}
+	return n
+}
+
+// tierCount returns the number of tiers
+func (l *trackerList) tierCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.tiers)
+}
+
+// candidates returns the trackers of a tier in the order they should be tried,
+// leaving out the ones that are backing off
+func (l *trackerList) candidates(tier int) []*trackerEndpoint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var healthy []*trackerEndpoint
+	for _, t := range l.tiers[tier] {
+		if time.Now().After(t.retryAt) {
+			healthy = append(healthy, t)
+		}
+	}
+	return healthy
+}
+
+// all returns every tracker of every tier, including the ones that are backing off
+func (l *trackerList) all() []*trackerEndpoint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var trackers []*trackerEndpoint
+	for _, tier := range l.tiers {
+		trackers = append(trackers, tier...)
+	}
+	return trackers
+}
+
+// succeeded marks a tracker as healthy and moves it to the front of its tier
+func (l *trackerList) succeeded(tier int, t *trackerEndpoint) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	t.failures = 0
+	t.retryAt = time.Time{}
+	t.lastError = ""
+	trackers := l.tiers[tier]
+	for i, other := range trackers {
+		if other == t {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = t
+			break
+		}
+	}
+}
+
+// failed marks a tracker as unhealthy, skipping it for a doubling backoff period
+func (l *trackerList) failed(t *trackerEndpoint, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	backoff := trackerBackoff << t.failures
+	if backoff > maxTrackerBackoff || backoff <= 0 {
+		backoff = maxTrackerBackoff
+	}
+	t.failures++
+	t.retryAt = time.Now().Add(backoff)
+	t.lastError = err.Error()
+	logger.Warn("Tracker failed", "tracker", net.JoinHostPort(t.host, t.port), "err", err, "retry_in", backoff)
+}
+
+// health returns how every tracker is doing
+func (l *trackerList) health() []trackerStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	trackers := []trackerStatus{}
+	for i, tier := range l.tiers {
+		for _, t := range tier {
+			status := trackerStatus{Address: net.JoinHostPort(t.host, t.port), Tier: i + 1, Reachable: true}
+			if time.Now().Before(t.retryAt) {
+				status.Reachable = false
+				status.Error = t.lastError
+			}
+			trackers = append(trackers, status)
+		}
+	}
+	return trackers
+}
+
+// print shows every tracker and its health
+func (l *trackerList) print() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.tiers) == 0 {
+		fmt.Println("No trackers configured")
+		return
+	}
+	for i, tier := range l.tiers {
+		for _, t := range tier {
+			status := "healthy"
+			if time.Now().Before(t.retryAt) {
+				status = fmt.Sprintf("backing off for %s after %d failures: %s",
+					time.Until(t.retryAt).Round(time.Second), t.failures, t.lastError)
+			}
+			fmt.Printf("Tier %d  %s  %s\n", i+1, net.JoinHostPort(t.host, t.port), status)
+		}
+	}
+}
+
+// announce registers a file with the trackers: with the first tracker that answers in
+// each tier, or with every tracker when announceAll is set
+func (c *P2PPeer) announce(fileName string) {
+	for tier := 0; tier < c.trackers.tierCount(); tier++ {
+		for _, t := range c.trackers.candidates(tier) {
+			err := c.connectToTracker(t.host, t.port, fileName, c.port)
+			if err != nil {
+				c.trackers.failed(t, err)
+				c.metrics.add("peer_errors_total", 1, label("kind", "tracker"))
+				continue
+			}
+			c.trackers.succeeded(tier, t)
+			if !c.trackers.announceAll {
+				break
+			}
+		}
+	}
+}
+
+// reannounce registers every shared file with the trackers again until shutdown, since
+// trackers forget registrations that aren't renewed
+func (c *P2PPeer) reannounce() {
+	ticker := time.NewTicker(reannounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, file := range c.sharedFiles() {
+			c.announce(file.name)
+		}
+	}
+}
+
+// findPeers asks the trackers for the peers that have a file, failing over within each
+// tier and merging the peer lists of all tiers
+func (c *P2PPeer) findPeers(fileName string) []string {
+	seen := make(map[string]bool)
+	var peerList []string
+	for tier := 0; tier < c.trackers.tierCount(); tier++ {
+		for _, t := range c.trackers.candidates(tier) {
+			peers, err := c.requestPeersFromTracker(t.host, t.port, fileName)
+			if err != nil {
+				c.trackers.failed(t, err)
+				c.metrics.add("peer_errors_total", 1, label("kind", "tracker"))
+				continue
+			}
+			c.trackers.succeeded(tier, t)
+			for _, p := range peers {
+				if !seen[p] {
+					seen[p] = true
+					peerList = append(peerList, p)
+				}
+			}
+			break
+		}
+	}
+	return peerList
+}
+
+// trackerFile is a file registered with the trackers and how many peers have it
+type trackerFile struct {
+	Name       string   `json:"name"`
+	Peers      int      `json:"peers"`
+	Publishers []string `json:"publishers,omitempty"` // Publishers named by the file's signed manifests, as the tracker checked them
+}
+
+// listTrackerFiles asks a tracker for every file registered with it
+func (c *P2PPeer) listTrackerFiles(trackerHost string, trackerPort string) ([]trackerFile, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(trackerHost, trackerPort), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	_, err = conn.Write([]byte("LIST_FILES" + c.swarm.suffix()))
+	if err != nil {
+		return nil, err
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	if string(response) == "DENIED" {
+		return nil, errors.New("tracker refused our swarm token")
+	}
+
+	// The tracker answers with one "<file>:<number of peers>[:<publisher>,...]" line per file
+	var files []trackerFile
+	for _, line := range strings.Split(string(response), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		peers, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		file := trackerFile{Name: fields[0], Peers: peers}
+		if len(fields) == 3 {
+			file.Publishers = strings.Split(fields[2], ",")
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// trackerFiles lists the files registered with the trackers, asking the first tracker
+// that answers in each tier and keeping the highest peer count a tier reports
+func (c *P2PPeer) trackerFiles() ([]trackerFile, error) {
+	peers := make(map[string]int)
+	publishers := make(map[string][]string)
+	var err error
+	answered := false
+	for tier := 0; tier < c.trackers.tierCount(); tier++ {
+		for _, t := range c.trackers.candidates(tier) {
+			files, e := c.listTrackerFiles(t.host, t.port)
+			if e != nil {
+				c.trackers.failed(t, e)
+				err = e
+				continue
+			}
+			c.trackers.succeeded(tier, t)
+			answered = true
+			for _, f := range files {
+				peers[f.Name] = max(peers[f.Name], f.Peers)
+				for _, p := range f.Publishers {
+					if !slices.Contains(publishers[f.Name], p) {
+						publishers[f.Name] = append(publishers[f.Name], p)
+					}
+				}
+			}
+			break
+		}
+	}
+	if !answered && err != nil {
+		return nil, err
+	}
+
+	files := make([]trackerFile, 0, len(peers))
+	for name, count := range peers {
+		files = append(files, trackerFile{Name: name, Peers: count, Publishers: publishers[name]})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// unshare stops sharing a file and tells every tracker we no longer have it. Trackers
+// that are backing off are told too, as a failover tracker may have registered the file
+// with them before they failed.
+func (c *P2PPeer) unshare(fileName string) {
+	c.removeFile(fileName)
+	for _, t := range c.trackers.all() {
+		for _, address := range trackerAddresses(t.host, t.port) {
+			err := c.unregisterWithTracker(address, fileName)
+			if err != nil {
+				logger.Warn("Error unregistering file with tracker", "tracker", address, "file", fileName, "err", err)
+			}
+		}
+	}
+}
+
+// unregisterWithTracker tells the tracker at one address that we no longer have a file
+func (c *P2PPeer) unregisterWithTracker(address string, fileName string) error {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	_, err = conn.Write([]byte(fmt.Sprintf("UNREGISTER:%s:%s", fileName, c.port) + c.swarm.suffix()))
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 16)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return err
+	}
+	if string(buffer[:n]) != "OK" {
+		return fmt.Errorf("tracker answered %q", buffer[:n])
+	}
+	return nil
+}
+
+// leaveTrackers tells every tracker that the peer is leaving, including the ones that
+// are backing off, as they may still list us from before they failed
+func (c *P2PPeer) leaveTrackers() {
+	for _, t := range c.trackers.all() {
+		err := c.leaveTracker(t.host, t.port)
+		if err != nil {
+			logger.Error("Error sending exit message to tracker", "tracker", net.JoinHostPort(t.host, t.port), "err", err)
+		}
+	}
+}
+
+// lanDiscovery finds trackers and peers on the local network from the announcements
+// they multicast, and announces this peer the same way. An announcement is a single
+// datagram, "P2P TRACKER <port>" or "P2P PEER <id> <port>"; the host is taken from
+// the sender's address.
+type lanDiscovery struct {
+	lock     sync.Mutex
+	trackers map[string]time.Time // Tracker addresses, with when they last announced themselves
+	peers    map[string]time.Time // Peer server addresses, with when they last announced themselves
+	found    chan struct{}        // Signalled when a new tracker is found
+}
+
+// newLANDiscovery creates an empty discovery table
+func newLANDiscovery() *lanDiscovery {
+	return &lanDiscovery{
+		trackers: make(map[string]time.Time),
+		peers:    make(map[string]time.Time),
+		found:    make(chan struct{}, 1),
+	}
+}
+
+// listenLAN records the trackers and peers announcing themselves on the multicast group
+func (c *P2PPeer) listenLAN() {
+	group, err := net.ResolveUDPAddr("udp4", discoveryGroup)
+	if err != nil {
+		logger.Error("Error resolving discovery group", "err", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		logger.Error("Error joining discovery group", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	// Shutting down closes the socket, which ends the loop
+	go func() {
+		<-c.ctx.Done()
+		conn.Close()
+	}()
+
+	buffer := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				logger.Error("Error reading discovery announcement", "err", err)
+			}
+			return
+		}
+
+		fields := strings.Fields(string(buffer[:n]))
+		if len(fields) < 3 || fields[0] != "P2P" {
+			continue
+		}
+		switch {
+		case fields[1] == "TRACKER" && len(fields) == 3:
+			if c.lan.addTracker(net.JoinHostPort(from.IP.String(), fields[2])) {
+				logger.Info("Found tracker on the local network", "tracker", net.JoinHostPort(from.IP.String(), fields[2]))
+			}
+		case fields[1] == "PEER" && len(fields) == 4 && fields[2] != c.id:
+			address := net.JoinHostPort(from.IP.String(), fields[3])
+			c.lan.addPeer(address)
+			if c.dht != nil {
+				c.dht.seen(fields[2], address)
+			}
+		}
+	}
+}
+
+// advertiseLAN announces this peer's server on the multicast group until shutdown
+func (c *P2PPeer) advertiseLAN() {
+	conn, err := net.Dial("udp4", discoveryGroup)
+	if err != nil {
+		logger.Error("Error announcing on the local network", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	announcement := []byte("P2P PEER " + c.id + " " + c.port)
+	for {
+		conn.Write(announcement) // Lost announcements are simply repeated next time
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(discoveryInterval):
+		}
+	}
+}
+
+// addTracker records an announced tracker and reports whether it is new
+func (l *lanDiscovery) addTracker(address string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, known := l.trackers[address]
+	l.trackers[address] = time.Now()
+	if !known {
+		select {
+		case l.found <- struct{}{}:
+		default:
+		}
+	}
+	return !known
+}
+
+// addPeer records an announced peer
+func (l *lanDiscovery) addPeer(address string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.peers[address] = time.Now()
+}
+
+// fresh returns the addresses of a table announced within the discovery TTL, dropping the rest
+func fresh(table map[string]time.Time) []string {
+	var addrs []string
+	for address, seen := range table {
+		if time.Since(seen) > discoveryTTL {
+			delete(table, address)
+			continue
+		}
+		addrs = append(addrs, address)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// trackerAddresses returns the trackers currently announcing themselves
+func (l *lanDiscovery) trackerAddresses() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return fresh(l.trackers)
+}
+
+// peerAddresses returns the peers currently announcing themselves
+func (l *lanDiscovery) peerAddresses() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return fresh(l.peers)
+}
+
+// waitForTrackers waits up to timeout for a tracker to announce itself and returns
+// the trackers found
+func (l *lanDiscovery) waitForTrackers(timeout time.Duration) []string {
+	deadline := time.After(timeout)
+	for {
+		if addrs := l.trackerAddresses(); len(addrs) > 0 {
+			return addrs
+		}
+		select {
+		case <-l.found:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// rendezvous matches connections made for NAT traversal with whoever waits for
+// them. Both sides know the connection by a random token passed through the tracker.
+type rendezvous struct {
+	lock    sync.Mutex
+	waiting map[string]chan *peerSession // Waiters by token
+	relays  int                          // Connections this peer is relaying
+}
+
+// newRendezvous creates an empty rendezvous table
+func newRendezvous() *rendezvous {
+	return &rendezvous{waiting: make(map[string]chan *peerSession)}
+}
+
+// expect registers a token and returns the channel its connection will arrive on
+func (r *rendezvous) expect(token string) chan *peerSession {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	arrived := make(chan *peerSession, 1)
+	r.waiting[token] = arrived
+	return arrived
+}
+
+// cancel forgets a token, closing its connection if it arrived after all
+func (r *rendezvous) cancel(token string) {
+	r.lock.Lock()
+	arrived := r.waiting[token]
+	delete(r.waiting, token)
+	r.lock.Unlock()
+
+	select {
+	case session := <-arrived:
+		session.conn.Close()
+	default:
+	}
+}
+
+// deliver hands a connection to the waiter for its token, reporting whether there was one
+func (r *rendezvous) deliver(token string, session *peerSession) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	arrived := r.waiting[token]
+	if arrived == nil {
+		return false
+	}
+	delete(r.waiting, token)
+	arrived <- session
+	return true
+}
+
+// connectThroughNAT reaches a peer whose server can't be dialled, which usually means it is
+// behind NAT. The trackers pass on a request for the peer to connect back to our server, or,
+// when we can't accept connections either, to a relay that joins its connection to ours.
+// The trackers only pass on requests for a peer registered for the file we want from it.
+func (c *P2PPeer) connectThroughNAT(address string, fileName string, dialErr error) (*peerSession, error) {
+	if c.trackers.count() == 0 || fileName == "" {
+		return nil, dialErr
+	}
+
+	if c.reachable {
+		session, err := c.reverseConnect(address, fileName)
+		if err == nil {
+			return session, nil
+		}
+	}
+	for _, relay := range c.relays {
+		session, err := c.relayConnect(relay, address, fileName)
+		if err == nil {
+			logger.Info("Reached peer through relay", "peer", address, "relay", relay)
+			return session, nil
+		}
+	}
+	return nil, dialErr
+}
+
+// reverseConnect asks a peer behind NAT to connect to our server and waits for it
+func (c *P2PPeer) reverseConnect(address string, fileName string) (*peerSession, error) {
+	token := newPeerID()
+	arrived := c.pending.expect(token)
+	defer c.pending.cancel(token)
+
+	// The tracker fills in our host, as seen from its side
+	err := c.requestConnectBack(address, fileName, net.JoinHostPort("", c.port), token)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case session := <-arrived:
+		return session, nil
+	case <-time.After(connectBackTimeout):
+		return nil, fmt.Errorf("peer %s did not connect back", address)
+	}
+}
+
+// relayConnect opens a connection to a peer behind NAT through a relay: we connect to
+// the relay, the peer is asked to connect to it too, and the relay joins the two
+func (c *P2PPeer) relayConnect(relay string, address string, fileName string) (*peerSession, error) {
+	conn, err := net.DialTimeout("tcp", relay, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	session := newPeerSession(conn)
+
+	token := newPeerID()
+	err = session.send("RELAY", nil, token)
+	if err == nil {
+		err = c.requestConnectBack(address, fileName, relay, token)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The relay confirms once the peer is on the other end
+	msg, err := session.receiveWithin(connectBackTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msg.kind != "RELAYED" {
+		conn.Close()
+		return nil, fmt.Errorf("relay %s answered %q", relay, msg.kind)
+	}
+	return session, nil
+}
+
+// requestConnectBack asks the trackers to tell a peer behind NAT that shares a file to
+// connect to an address, presenting token. An address without a host means the
+// requester's own host.
+func (c *P2PPeer) requestConnectBack(target string, fileName string, replyAddress string, token string) error {
+	for tier := 0; tier < c.trackers.tierCount(); tier++ {
+		for _, t := range c.trackers.candidates(tier) {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(t.host, t.port), dialTimeout)
+			if err != nil {
+				continue
+			}
+			conn.Write([]byte("CONNECT_BACK:" + target + " " + replyAddress + " " + token + " " + fileName + c.swarm.suffix()))
+			conn.SetReadDeadline(time.Now().Add(dialTimeout))
+			buffer := make([]byte, 64)
+			n, _ := conn.Read(buffer)
+			conn.Close()
+			if string(buffer[:n]) == "OK" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no tracker can reach peer %s", target)
+}
+
+// waitForConnectBack keeps a connection open to every tracker so peers that can't dial
+// us can ask us to connect to them instead. Lost connections are retried with backoff.
+func (c *P2PPeer) waitForConnectBack() {
+	for tier := 0; tier < c.trackers.tierCount(); tier++ {
+		for _, t := range c.trackers.candidates(tier) {
+			for _, address := range trackerAddresses(t.host, t.port) {
+				go c.holdTrackerConnection(address)
+			}
+		}
+	}
+}
+
+// holdTrackerConnection listens for connect-back requests from one tracker until shutdown
+func (c *P2PPeer) holdTrackerConnection(tracker string) {
+	backoff := trackerBackoff
+	for {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(c.ctx, "tcp", tracker)
+		if err == nil {
+			_, err = conn.Write([]byte("LISTEN:" + c.port))
+		}
+		if err == nil {
+			backoff = trackerBackoff
+
+			// Shutting down closes the connection, which ends the scan
+			held := make(chan struct{})
+			go func() {
+				select {
+				case <-c.ctx.Done():
+					conn.Close()
+				case <-held:
+				}
+			}()
+
+			// Each request is a line "CONNECT <address> <token>"
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) == 3 && fields[0] == "CONNECT" {
+					go c.connectBack(fields[1], fields[2])
+				}
+			}
+			close(held)
+			conn.Close()
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxTrackerBackoff {
+			backoff = maxTrackerBackoff
+		}
+	}
+}
+
+// connectBack connects to a peer or relay that asked for us, then serves it as if
+// it had connected to our server
+func (c *P2PPeer) connectBack(address string, token string) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		logger.Warn("Error connecting back", "peer", address, "err", err)
+		return
+	}
+	session := newPeerSession(conn)
+
+	err = session.send("REVERSE", nil, token)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	hello, err := session.receiveWithin(connectBackTimeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c.servePeer(session, hello, false)
+}
+
+// relayFor joins a peer's connection to the one a peer behind NAT makes in answer to
+// the same token, and forwards everything between them
+func (c *P2PPeer) relayFor(session *peerSession, msg message) {
+	defer session.conn.Close()
+
+	if !c.relay || len(msg.args) != 1 {
+		session.send("NO_RELAY", nil)
+		return
+	}
+
+	c.pending.lock.Lock()
+	full := c.pending.relays >= maxRelays
+	if !full {
+		c.pending.relays++
+	}
+	c.pending.lock.Unlock()
+	if full {
+		session.send("NO_RELAY", nil)
+		return
+	}
+	defer func() {
+		c.pending.lock.Lock()
+		c.pending.relays--
+		c.pending.lock.Unlock()
+	}()
+
+	token := msg.args[0]
+	arrived := c.pending.expect(token)
+	var other *peerSession
+	select {
+	case other = <-arrived:
+	case <-time.After(connectBackTimeout):
+		c.pending.cancel(token)
+		return
+	}
+	defer other.conn.Close()
+
+	err := session.send("RELAYED", nil)
+	if err != nil {
+		return
+	}
+	logger.Info("Relaying", "peer", session.conn.RemoteAddr().String(), "to", other.conn.RemoteAddr().String())
+
+	// The two ends keep their own deadlines; the relay only forwards
+	session.conn.SetDeadline(time.Time{})
+	other.conn.SetDeadline(time.Time{})
+
+	// Copy from the readers, as they may already hold buffered bytes; either side
+	// hanging up ends the relay
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(other.conn, session.reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(session.conn, other.reader)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// connectToPeer establishes a connection with another peer
+func (c *P2PPeer) connectToPeer(peerHost string, peerPort string) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(peerHost, peerPort))
+	if err != nil {
+		logger.Error("Error connecting to peer", "peer", net.JoinHostPort(peerHost, peerPort), "err", err)
+		return
+	}
+	c.peers = append(c.peers, conn)
+	logger.Info("Connected to peer", "peer", net.JoinHostPort(peerHost, peerPort))
+}
+
+// activeDownload is the state shared by the workers fetching one file from several peers
+type activeDownload struct {
+	ctx       context.Context // Cancelled to stop the download, keeping what arrived
+	fileName  string
+	path      string // Where the file is written
+	size      int64
+	sched     *chunkScheduler
+	outFile   *os.File
+	local     *sharedFile
+	lock      sync.Mutex
+	sessions  map[string]*peerSession // Sessions of running workers, by peer ID
+	tried     map[string]bool         // Addresses we already connected to or failed to
+	workers   int                     // Number of running workers
+	closed    bool                    // Set once the last worker stopped; no more peers may join
+	stopped   chan struct{}           // Closed when the last worker stops
+	morePeers chan struct{}           // Signals that peer exchange taught us new peers to try
+	written   atomic.Int64            // Bytes of the file written so far
+	hashes    []byte                  // SHA-256 of every chunk the peers agreed on, nil if unknown
+}
+
+// downloadFile downloads a file from every peer that has it, fetching the rarest chunks first.
+// Chunks are served to other peers as soon as they arrive. The file is written to path, and
+// if expectedHash is set it must match. It returns the hash of the finished file.
+// Cancelling ctx stops the download so it can be resumed later; it should derive from the
+// peer's context so shutting down stops it too.
+func (c *P2PPeer) downloadFile(ctx context.Context, fileName string, path string, peerAddrs []string, expectedHash string) (string, error) {
+	c.downloads.Add(1)
+	defer c.downloads.Done()
+	c.metrics.add("peer_active_downloads", 1)
+	defer c.metrics.add("peer_active_downloads", -1)
+	if ctx.Err() != nil {
+		return "", errors.New("download stopped")
+	}
+
+	// Two downloads writing to one file would corrupt each other
+	c.activeLock.Lock()
+	_, busy := c.active[path]
+	if !busy {
+		c.active[path] = nil
+	}
+	c.activeLock.Unlock()
+	if busy {
+		return "", fmt.Errorf("%s is already being downloaded", path)
+	}
+	defer func() {
+		c.activeLock.Lock()
+		delete(c.active, path)
+		c.activeLock.Unlock()
+	}()
+
+	// Remember where the file can be found so peer exchange can pass it on
+	c.pex.add(fileName, peerAddrs)
+
+	// Connect to the peers and learn which chunks each one has
+	size := int64(-1)
+	var sessions []*peerSession
+	var bitfields [][]byte
+	tried := make(map[string]bool)
+	for _, addr := range peerAddrs {
+		if len(sessions) == maxDownloadPeers {
+			break
+		}
+		tried[addr] = true
+		session, peerSize, bitfield, err := c.connectForDownload(addr, fileName)
+		if err != nil {
+			c.metrics.add("peer_errors_total", 1, label("kind", "connect"))
+			logger.Warn("Error getting chunk list", "peer", addr, "file", fileName, "err", err)
+			continue
+		}
+		if size >= 0 && peerSize != size {
+			logger.Warn("Peer has a different version of the file", "peer", addr, "file", fileName)
+			session.conn.Close()
+			continue
+		}
+		size = peerSize
+		sessions = append(sessions, session)
+		bitfields = append(bitfields, bitfield)
+	}
+	if len(sessions) == 0 {
+		logger.Error("No peer could provide the requested file", "file", fileName)
+		return "", errors.New("no peer could provide the file")
+	}
+
+	// With trusted publishers set, only download files one of them signed, and check the
+	// content against the hash they signed
+	var manifest []byte
+	if c.trusted != nil {
+		var m *fileManifest
+		var err error
+		manifest, m, err = c.trustedManifest(fileName, expectedHash, size, sessions, bitfields)
+		if err != nil {
+			logger.Error("Refusing to download a file no trusted publisher signed", "file", fileName, "err", err)
+			for _, session := range sessions {
+				session.conn.Close()
+			}
+			return "", err
+		}
+		expectedHash = m.Hash
+		logger.Info("File is signed by a trusted publisher", "file", fileName, "publisher", publisherIdentity(m.Publisher, m.Key), "trusted_as", c.trusted[m.Key])
+	}
+
+	// Pick up where an interrupted download of the same file left off
+	state := loadDownloadState(path)
+	if state != nil && (state.Size != size || state.Hash != expectedHash) {
+		state = nil
+	}
+
+	outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Error("Error creating file", "file", fileName, "err", err)
+		return "", err
+	}
+	defer outFile.Close()
+
+	// Reserve the whole file so chunks can be written in any order
+	if state == nil {
+		err = outFile.Truncate(0)
+	}
+	if err == nil {
+		err = outFile.Truncate(size)
+	}
+	if err != nil {
+		logger.Error("Error creating file", "file", fileName, "err", err)
+		return "", err
+	}
+
+	// Learn the hash of every chunk so corrupt chunks are caught as they arrive
+	hashes := c.agreeOnChunkHashes(fileName, sessions, bitfields, chunkCount(size))
+	if hashes == nil {
+		logger.Info("No peer has the chunk hashes, chunks can't be checked until the end", "file", fileName)
+	}
+
+	// Share the partial file straight away so other peers can fetch what we already have
+	d := &activeDownload{
+		hashes:    hashes,
+		ctx:       ctx,
+		fileName:  fileName,
+		path:      path,
+		size:      size,
+		sched:     newChunkScheduler(chunkCount(size)),
+		outFile:   outFile,
+		local:     c.addPartialFile(fileName, path, size),
+		sessions:  make(map[string]*peerSession),
+		tried:     tried,
+		stopped:   make(chan struct{}),
+		morePeers: make(chan struct{}, 1),
+	}
+	c.activeLock.Lock()
+	c.active[path] = d
+	c.activeLock.Unlock()
+	if state != nil {
+		bitfield, _ := hex.DecodeString(state.Bitfield)
+		for i, have := range decodeBitfield(bitfield, d.sched.total) {
+			if have {
+				d.sched.finish(i)
+				c.addChunk(d.local, i)
+				d.written.Add(chunkLength(size, i))
+			}
+		}
+		done, total := d.sched.progress()
+		logger.Info("Resuming download", "file", fileName, "chunks_done", done, "chunks", total)
+	}
+	logger.Info("Downloading", "file", fileName, "bytes", size, "chunks", chunkCount(size), "peers", len(sessions))
+
+	// Fetch from every peer in parallel
+	for i, session := range sessions {
+		c.addDownloadPeer(d, session, bitfields[i])
+	}
+
+	// Swap peer lists with our peers and bring in the new ones they tell us about
+	stopPEX := make(chan struct{})
+	go c.exchangePeers(d, stopPEX)
+
+	// Tell whoever is watching how the download is going
+	stopProgress := make(chan struct{})
+	reported := make(chan struct{})
+	go c.reportProgress(d, stopProgress, reported)
+
+	// Hang up on peers still busy with duplicate endgame requests once we have everything,
+	// or on every peer when shutting down; chunks being written are finished first
+	select {
+	case <-d.stopped:
+	case <-d.sched.finished:
+		for _, session := range d.activeSessions() {
+			session.conn.Close()
+		}
+		<-d.stopped
+	case <-ctx.Done():
+		for _, session := range d.activeSessions() {
+			session.conn.Close()
+		}
+		<-d.stopped
+	}
+	close(stopPEX)
+	close(stopProgress)
+	<-reported
+
+	outFile.Sync() // Flush the file buffer to disk
+	done, total := d.sched.progress()
+	if done < total {
+		// Save what we have so a later request for the file resumes from here
+		err := saveDownloadState(d, expectedHash)
+		if err != nil {
+			logger.Error("Error saving download state", "file", fileName, "err", err)
+		}
+		logger.Warn("Download incomplete, request the file again to resume", "file", fileName, "chunks_done", done, "chunks", total)
+		return "", fmt.Errorf("download incomplete: %d of %d chunks", done, total)
+	}
+	os.Remove(downloadStatePath(path))
+
+	// Check the content, then make the finished file announceable by its hash
+	hash, err := hashFile(path)
+	if err != nil {
+		logger.Error("Error hashing file", "file", fileName, "err", err)
+		return "", err
+	}
+	if expectedHash != "" && hash != expectedHash {
+		c.metrics.add("peer_hash_failures_total", 1)
+		logger.Warn("Downloaded file does not match the requested hash, discarding", "file", fileName, "hash", hash, "expected", expectedHash)
+		c.removeFile(fileName)
+		os.Remove(path)
+		return "", fmt.Errorf("downloaded file has hash %s, not %s", hash, expectedHash)
+	}
+	d.local.setHash(hash)
+	logger.Info("Download complete", "file", fileName, "bytes", size, "hash", hash)
+
+	// Keep the manifest with the file and hand it on, so others can check it too
+	if manifest != nil {
+		err = os.WriteFile(path+manifestSuffix, manifest, 0644)
+		if err != nil {
+			logger.Warn("Error saving manifest", "file", fileName, "err", err)
+		}
+		d.local.setManifest(manifest)
+		go c.announce(d.local.name)
+	}
+
+	if c.dht != nil {
+		go c.dht.announce(d.local)
+	}
+	return hash, nil
+}
+
+// downloadState is what is saved of an unfinished download so it can be resumed
+type downloadState struct {
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash,omitempty"` // Hash the file was requested by, if any
+	Bitfield string `json:"bitfield"`       // Chunks already written, hex encoded
+}
+
+// downloadStatePath returns where the state of an unfinished download is saved
+func downloadStatePath(path string) string {
+	return path + ".state"
+}
+
+// saveDownloadState records which chunks of a download have been written
+func saveDownloadState(d *activeDownload, expectedHash string) error {
+	d.local.lock.Lock()
+	bitfield := encodeBitfield(d.local.have)
+	d.local.lock.Unlock()
+
+	data, err := json.Marshal(downloadState{Size: d.size, Hash: expectedHash, Bitfield: hex.EncodeToString(bitfield)})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(downloadStatePath(d.path), data, 0644)
+}
+
+// loadDownloadState returns the saved state of an unfinished download, or nil if there is none
+func loadDownloadState(path string) *downloadState {
+	data, err := os.ReadFile(downloadStatePath(path))
+	if err != nil {
+		return nil
+	}
+	var state downloadState
+	if json.Unmarshal(data, &state) != nil {
+		return nil
+	}
+	return &state
+}
+
+// requestChunkHashes asks a peer for the hash of every chunk of a file. It returns nil
+// if the peer doesn't have them all. Chunks the peer announces meanwhile are added to its
+// bitfield.
+func (c *P2PPeer) requestChunkHashes(session *peerSession, fileName string, chunks int, bitfield []byte) ([]byte, error) {
+	err := session.send("GET_HASHES", nil, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(dialTimeout)
+	for {
+		msg, err := session.next(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.kind {
+		case "CHOKE":
+			session.choked = true
+		case "UNCHOKE":
+			session.choked = false
+		case "HAVE":
+			if len(msg.args) != 2 || msg.args[0] != fileName {
+				continue
+			}
+			chunkIndex, err := strconv.Atoi(msg.args[1])
+			if err == nil && chunkIndex >= 0 && chunkIndex/8 < len(bitfield) {
+				bitfield[chunkIndex/8] |= 0x80 >> (chunkIndex % 8)
+			}
+		case "NO_HASHES":
+			return nil, nil
+		case "HASHES":
+			if len(msg.args) != 1 || msg.args[0] != fileName {
+				continue
+			}
+			if len(msg.payload) != chunks*sha256.Size {
+				return nil, fmt.Errorf("peer sent %d bytes of chunk hashes for %d chunks", len(msg.payload), chunks)
+			}
+			return msg.payload, nil
+		}
+	}
+}
+
+// agreeOnChunkHashes asks the peers for the hash of every chunk of a file and returns the
+// list more than half of those answering agree on, or nil if there is no such list. A
+// peer lying about the hashes is outvoted, and a list every peer lies about alike still
+// fails the check of the whole file when it was requested by hash. Without a majority
+// chunks go unchecked until the end rather than honest peers being banned as corrupt.
+func (c *P2PPeer) agreeOnChunkHashes(fileName string, sessions []*peerSession, bitfields [][]byte, chunks int) []byte {
+	votes := make(map[string]int)
+	total := 0
+	for i, session := range sessions {
+		hashes, err := c.requestChunkHashes(session, fileName, chunks, bitfields[i])
+		if err != nil {
+			logger.Debug("Error getting chunk hashes", "peer", session.conn.RemoteAddr().String(), "file", fileName, "err", err)
+			continue
+		}
+		if hashes != nil {
+			votes[string(hashes)]++
+			total++
+		}
+	}
+
+	best, most := "", 0
+	for hashes, count := range votes {
+		if count > most {
+			best, most = hashes, count
+		}
+	}
+	if most == 0 {
+		return nil
+	}
+	if 2*most <= total {
+		logger.Warn("Peers disagree on the chunk hashes with no majority, not using any", "file", fileName, "lists", len(votes), "votes", most, "peers", total)
+		return nil
+	}
+	if len(votes) > 1 {
+		logger.Warn("Peers disagree on the chunk hashes, going with the majority", "file", fileName, "lists", len(votes), "votes", most, "peers", total)
+	}
+	return []byte(best)
+}
+
+// chunkMatches reports whether a chunk has the hash listed for it
+func chunkMatches(chunk []byte, hashes []byte, chunkIndex int) bool {
+	sum := sha256.Sum256(chunk)
+	return bytes.Equal(sum[:], hashes[chunkIndex*sha256.Size:(chunkIndex+1)*sha256.Size])
+}
+
+// reportCorrupt drops a peer that sent a corrupt chunk, banning its peer ID and IP for a
+// while so it isn't asked again
+func (c *P2PPeer) reportCorrupt(session *peerSession, d *activeDownload, chunkIndex int) {
+	c.metrics.add("peer_errors_total", 1, label("kind", "corrupt"))
+	host, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+	logger.Warn("Peer sent a corrupt chunk", "peer", session.conn.RemoteAddr().String(), "peer_id", session.peerID,
+		"file", d.fileName, "chunk", chunkIndex, "ban", c.corruptBan)
+	if c.corruptBan > 0 {
+		c.access.banFor(session.peerID, c.corruptBan)
+		if ip := net.ParseIP(host); ip != nil {
+			c.access.banFor(ip.String(), c.corruptBan)
+		}
+	}
+}
+
+// connectForDownload opens a session to a peer and asks which chunks of the file it has
+func (c *P2PPeer) connectForDownload(address string, fileName string) (*peerSession, int64, []byte, error) {
+	session, err := c.openSession(address, fileName)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if session.peerID == c.id {
+		session.conn.Close()
+		return nil, 0, nil, fmt.Errorf("that is this peer")
+	}
+
+	size, bitfield, err := c.requestBitfield(session, fileName)
+	if err != nil {
+		session.conn.Close()
+		return nil, 0, nil, err
+	}
+	return session, size, bitfield, nil
+}
+
+// addDownloadPeer starts a worker fetching chunks from a peer. It returns false,
+// closing the session, if the download is over or already uses that peer.
+func (c *P2PPeer) addDownloadPeer(d *activeDownload, session *peerSession, bitfield []byte) bool {
+	d.lock.Lock()
+	if d.closed || d.sessions[session.peerID] != nil {
+		d.lock.Unlock()
+		session.conn.Close()
+		return false
+	}
+	d.sessions[session.peerID] = session
+	d.workers++
+	d.lock.Unlock()
+
+	d.sched.addPeer(session.peerID, decodeBitfield(bitfield, d.sched.total))
+	go func() {
+		c.downloadFromPeer(session, d)
+
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.sessions, session.peerID)
+		d.workers--
+		if d.workers == 0 {
+			d.closed = true
+			close(d.stopped)
+		}
+	}()
+	return true
+}
+
+// downloadProgress returns how many chunks of the download written to path have arrived,
+// out of how many, and whether that download is in progress
+func (c *P2PPeer) downloadProgress(path string) (int, int, bool) {
+	c.activeLock.Lock()
+	d := c.active[path]
+	c.activeLock.Unlock()
+	if d == nil {
+		return 0, 0, false
+	}
+	done, total := d.sched.progress()
+	return done, total, true
+}
+
+// progressInterval is how often a running download reports its progress
+const progressInterval = 500 * time.Millisecond
+
+// progressWindow is how many reports back the transfer rate is averaged over
+const progressWindow = 10
+
+// Progress states: a download reports running until its workers stop, then complete if
+// every chunk arrived or stopped if it will have to be resumed
+const (
+	progressRunning  = "running"
+	progressComplete = "complete"
+	progressStopped  = "stopped"
+)
+
+// progressEvent is a report on how far a download has got
+type progressEvent struct {
+	File  string   `json:"file"`
+	Path  string   `json:"path"`
+	State string   `json:"state"`
+	Bytes int64    `json:"bytes"`       // Bytes written so far, including any resumed from
+	Size  int64    `json:"size"`        // Size of the whole file
+	Rate  float64  `json:"rate"`        // Bytes per second over the last few seconds
+	ETA   float64  `json:"eta_seconds"` // Seconds left at the current rate, -1 if unknown
+	Peers []string `json:"peers"`       // Addresses of the peers we are fetching from
+}
+
+// progressHub hands the progress events of every download to its subscribers and keeps
+// the latest event of each running download
+type progressHub struct {
+	lock        sync.Mutex
+	subscribers map[int]func(progressEvent)
+	nextID      int
+	latest      map[string]progressEvent // By the path the download is written to
+}
+
+// newProgressHub creates a hub with no subscribers
+func newProgressHub() *progressHub {
+	return &progressHub{subscribers: make(map[int]func(progressEvent)), latest: make(map[string]progressEvent)}
+}
+
+// subscribe calls fn with every progress event until the returned function is called.
+// fn is called with the hub locked, so it must return quickly and not use the hub.
+func (h *progressHub) subscribe(fn func(progressEvent)) func() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.subscribers[id] = fn
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.subscribers, id)
+	}
+}
+
+// watch returns a channel receiving progress events until the returned function is
+// called, which also closes the channel. Events are dropped while the channel is full.
+func (h *progressHub) watch(buffer int) (<-chan progressEvent, func()) {
+	events := make(chan progressEvent, buffer)
+	unsubscribe := h.subscribe(func(e progressEvent) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			unsubscribe()
+			close(events)
+		})
+	}
+}
+
+// publish records an event and passes it to the subscribers
+func (h *progressHub) publish(e progressEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if e.State == progressRunning {
+		h.latest[e.Path] = e
+	} else {
+		delete(h.latest, e.Path)
+	}
+	for _, fn := range h.subscribers {
+		fn(e)
+	}
+}
+
+// current returns the latest event of every running download, ordered by path
+func (h *progressHub) current() []progressEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	events := make([]progressEvent, 0, len(h.latest))
+	for _, e := range h.latest {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Path < events[j].Path })
+	return events
+}
+
+// get returns the latest event of the download written to path, if it is running
+func (h *progressHub) get(path string) (progressEvent, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	e, ok := h.latest[path]
+	return e, ok
+}
+
+// reportProgress publishes the progress of a download every progressInterval until
+// stop is closed, then publishes its final state and closes reported
+func (c *P2PPeer) reportProgress(d *activeDownload, stop chan struct{}, reported chan struct{}) {
+	defer close(reported)
+	type sample struct {
+		at    time.Time
+		bytes int64
+	}
+	samples := []sample{{time.Now(), d.written.Load()}}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			done, total := d.sched.progress()
+			state := progressStopped
+			if done == total {
+				state = progressComplete
+			}
+			c.progress.publish(progressEvent{File: d.fileName, Path: d.path, State: state,
+				Bytes: d.written.Load(), Size: d.size, ETA: -1, Peers: []string{}})
+			return
+		}
+
+		now := sample{time.Now(), d.written.Load()}
+		samples = append(samples, now)
+		if len(samples) > progressWindow+1 {
+			samples = samples[1:]
+		}
+		oldest := samples[0]
+		rate := float64(now.bytes-oldest.bytes) / now.at.Sub(oldest.at).Seconds()
+		eta := -1.0
+		if rate > 0 {
+			eta = float64(d.size-now.bytes) / rate
+		}
+
+		peers := []string{}
+		for _, session := range d.activeSessions() {
+			address := session.address
+			if address == "" {
+				address = session.conn.RemoteAddr().String()
+			}
+			peers = append(peers, address)
+		}
+		sort.Strings(peers)
+
+		c.progress.publish(progressEvent{File: d.fileName, Path: d.path, State: progressRunning,
+			Bytes: now.bytes, Size: d.size, Rate: rate, ETA: eta, Peers: peers})
+	}
+}
+
+// formatProgress renders a progress event as a one-line progress bar
+func formatProgress(e progressEvent) string {
+	const width = 20
+	fraction := 1.0
+	if e.Size > 0 {
+		fraction = float64(e.Bytes) / float64(e.Size)
+	}
+	filled := int(fraction * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	if filled < width {
+		bar = strings.Repeat("=", filled) + ">" + strings.Repeat(" ", width-filled-1)
+	}
+
+	eta := "--:--"
+	if e.ETA >= 0 {
+		left := time.Duration(e.ETA) * time.Second
+		eta = fmt.Sprintf("%02d:%02d", int(left.Minutes()), int(left.Seconds())%60)
+	}
+	return fmt.Sprintf("%s [%s] %3d%% %s/%s %s/s ETA %s %d peers",
+		e.File, bar, int(fraction*100), formatSize(e.Bytes), formatSize(e.Size), formatSize(int64(e.Rate)), eta, len(e.Peers))
+}
+
+// formatSize renders a byte count in B, KB, MB or GB
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// progressLine redraws a progress bar in place on a terminal; it draws nothing when
+// stderr isn't one, so logs and piped output stay clean
+type progressLine struct {
+	enabled bool
+	drawn   bool
+}
+
+// newProgressLine creates a progress line on stderr unless turned off
+func newProgressLine(off bool) *progressLine {
+	return &progressLine{enabled: !off && isTerminal(os.Stderr)}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// draw replaces the line with an event
+func (p *progressLine) draw(e progressEvent) {
+	if p.enabled {
+		fmt.Fprint(os.Stderr, "\r\033[K"+formatProgress(e))
+		p.drawn = true
+	}
+}
+
+// clear removes the line
+func (p *progressLine) clear() {
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// activeSessions returns the sessions of the running workers
+func (d *activeDownload) activeSessions() []*peerSession {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sessions := make([]*peerSession, 0, len(d.sessions))
+	for _, session := range d.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// exchangePeers swaps peer lists with the peers of a download right away and then
+// every PEX interval, and connects to the new peers it learns about. This keeps the
+// swarm growing and healing while the tracker is slow or unreachable.
+func (c *P2PPeer) exchangePeers(d *activeDownload, stop chan struct{}) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, session := range d.activeSessions() {
+			peers := c.pex.list(d.fileName, session.address, pexMaxPeers)
+			session.send("PEX", encodePeerList(peers), d.fileName)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-d.morePeers:
+			c.addPeersFromExchange(d)
+		}
+	}
+}
+
+// addPeersFromExchange connects to peers we learned about until the download has enough
+func (c *P2PPeer) addPeersFromExchange(d *activeDownload) {
+	for _, addr := range c.pex.list(d.fileName, "", pexMaxKnown) {
+		if len(d.activeSessions()) >= maxDownloadPeers || d.sched.complete() {
+			return
+		}
+
+		d.lock.Lock()
+		tried := d.tried[addr]
+		d.tried[addr] = true
+		d.lock.Unlock()
+		if tried {
+			continue
+		}
+
+		session, size, bitfield, err := c.connectForDownload(addr, d.fileName)
+		if err != nil {
+			continue
+		}
+		if size != d.size {
+			session.conn.Close()
+			continue
+		}
+		if c.addDownloadPeer(d, session, bitfield) {
+			logger.Info("Fetching from peer found through peer exchange", "peer", addr, "file", d.fileName)
+		}
+	}
+}
+
+// requestBitfield asks a peer which chunks of a file it has, returning the file size and bitfield
+func (c *P2PPeer) requestBitfield(session *peerSession, fileName string) (int64, []byte, error) {
+	err := session.send("GET_BITFIELD", nil, fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for {
+		msg, err := session.next(unchokeTimeout)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch msg.kind {
+		case "CHOKE":
+			session.choked = true
+		case "UNCHOKE":
+			session.choked = false
+		case "NO_FILE":
+			return 0, nil, fmt.Errorf("peer does not have the file")
+		case "BITFIELD":
+			if len(msg.args) != 2 || msg.args[0] != fileName {
+				continue
+			}
+			size, err := strconv.ParseInt(msg.args[1], 10, 64)
+			if err != nil {
+				return 0, nil, err
+			}
+			// The size decides how much disk and memory the download takes, so a peer
+			// mustn't be able to claim just any
+			if size < 0 || size > maxFileSize {
+				return 0, nil, fmt.Errorf("peer claims a file of %d bytes", size)
+			}
+			if len(msg.payload) != (chunkCount(size)+7)/8 {
+				return 0, nil, fmt.Errorf("peer sent a %d byte bitfield for a file of %d bytes", len(msg.payload), size)
+			}
+			return size, msg.payload, nil
+		}
+	}
+}
+
+// downloadFromPeer keeps requesting chunks from one peer until the download is
+// finished or the peer has nothing more to offer
+func (c *P2PPeer) downloadFromPeer(session *peerSession, d *activeDownload) {
+	sched := d.sched
+	defer session.conn.Close()
+	defer sched.removePeer(session.peerID)
+
+	// Let the peer know we want data so it considers us for an unchoke slot
+	err := session.send("INTERESTED", nil)
+	if err != nil {
+		logger.Warn("Error sending interest", "peer", session.conn.RemoteAddr().String(), "file", d.fileName, "err", err)
+		return
+	}
+	defer session.send("NOT_INTERESTED", nil)
+
+	for {
+		wake := sched.changed()
+		if sched.complete() || sched.stalled() || d.ctx.Err() != nil {
+			return
+		}
+
+		chunkIndex, ok := sched.next(session.peerID)
+		if !ok {
+			// Nothing to ask this peer for right now, so wait for it to announce new
+			// chunks or for another peer to give up the ones it was fetching
+			select {
+			case msg, open := <-session.incoming:
+				if !open {
+					return
+				}
+				c.handleDownloadMessage(session, msg, d)
+			case <-wake:
+			case <-d.ctx.Done():
+				return
+			case <-time.After(unchokeTimeout):
+				return
+			}
+			continue
+		}
+
+		chunk, err := c.requestChunk(session, d, chunkIndex)
+		if err != nil {
+			sched.cancel(chunkIndex, session.peerID)
+			if !sched.complete() && d.ctx.Err() == nil {
+				c.metrics.add("peer_errors_total", 1, label("kind", "receive"))
+				logger.Warn("Error receiving chunk", "peer", session.conn.RemoteAddr().String(), "file", d.fileName, "chunk", chunkIndex, "err", err)
+			}
+			return
+		}
+		if chunk == nil {
+			// The peer turned out not to have the chunk after all
+			sched.cancel(chunkIndex, session.peerID)
+			sched.removeChunk(session.peerID, chunkIndex)
+			continue
+		}
+
+		n := len(chunk)
+
+		// Hold the chunk until the download limits allow it through
+		c.limiter.waitDownload(session.remoteHost(), n)
+		c.choker.recordDownload(session, n)
+
+		// A chunk that doesn't match its hash is corrupt, and the peer that sent it is dropped
+		if d.hashes != nil && !chunkMatches(chunk, d.hashes, chunkIndex) {
+			sched.cancel(chunkIndex, session.peerID)
+			c.reportCorrupt(session, d, chunkIndex)
+			return
+		}
+
+		// In endgame another peer may have delivered the same chunk first
+		if sched.isDone(chunkIndex) {
+			continue
+		}
+
+		// Write chunk to the file
+		bytesWritten, err := d.outFile.WriteAt(chunk, int64(chunkIndex)*ChunkSize)
+		if err != nil {
+			c.metrics.add("peer_errors_total", 1, label("kind", "write"))
+			logger.Error("Error writing chunk to file", "file", d.fileName, "chunk", chunkIndex, "err", err)
+			sched.cancel(chunkIndex, session.peerID)
+			return
+		}
+		if sched.finish(chunkIndex) {
+			c.addChunk(d.local, chunkIndex)
+			d.written.Add(int64(bytesWritten))
+			c.metrics.add("peer_downloaded_bytes_total", float64(bytesWritten))
+			c.metrics.add("peer_chunks_downloaded_total", 1)
+			done, total := sched.progress()
+			logger.Debug("Chunk written", "peer", session.conn.RemoteAddr().String(), "file", d.fileName, "chunk", chunkIndex, "bytes", bytesWritten, "chunks_done", done, "chunks", total)
+		}
+	}
+}
+
+// handleDownloadMessage applies a message a peer pushed to us while downloading
+func (c *P2PPeer) handleDownloadMessage(session *peerSession, msg message, d *activeDownload) {
+	switch msg.kind {
+	case "CHOKE":
+		session.choked = true
+	case "UNCHOKE":
+		session.choked = false
+	case "HAVE":
+		if len(msg.args) == 2 {
+			chunkIndex, err := strconv.Atoi(msg.args[1])
+			if err == nil {
+				d.sched.addChunk(session.peerID, chunkIndex)
+			}
+		}
+	case "PEX":
+		// Wake the exchange loop if the peer told us about anyone new
+		if len(msg.args) == 1 && msg.args[0] == d.fileName && c.pex.add(d.fileName, decodePeerList(msg.payload)) > 0 {
+			select {
+			case d.morePeers <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// requestChunk asks a peer for one chunk, waiting out chokes and busy replies.
+// It returns a nil chunk if the peer does not have it.
+func (c *P2PPeer) requestChunk(session *peerSession, d *activeDownload, chunkIndex int) ([]byte, error) {
+	fileName := d.fileName
+	index := strconv.Itoa(chunkIndex)
+	requested := false
+
+	for {
+		// Only ask while unchoked; a choked peer drops our requests
+		if !session.choked && !requested {
+			err := session.send("GET_CHUNK", nil, fileName, index)
+			if err != nil {
+				return nil, err
+			}
+			requested = true
+		}
+
+		msg, err := session.next(unchokeTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.kind {
+		case "CHOKE":
+			session.choked = true
+			requested = false
+		case "BUSY":
+			// The peer's upload queue is full, so back off before asking again
+			requested = false
+			time.Sleep(time.Second)
+		case "NO_CHUNK":
+			if len(msg.args) == 2 && msg.args[0] == fileName && msg.args[1] == index {
+				return nil, nil
+			}
+		case "PIECE":
+			// Pieces for earlier, retried requests are ignored
+			if len(msg.args) == 2 && msg.args[0] == fileName && msg.args[1] == index {
+				if int64(len(msg.payload)) != chunkLength(d.size, chunkIndex) {
+					return nil, fmt.Errorf("peer sent %d bytes of chunk %d", len(msg.payload), chunkIndex)
+				}
+				return msg.payload, nil
+			}
+		default:
+			c.handleDownloadMessage(session, msg, d)
+		}
+	}
+}
+
+// peerExchange remembers which peers hold each file, learned from trackers, the DHT,
+// incoming peers and PEX messages, so the lists can be passed on to other peers
+type peerExchange struct {
+	lock  sync.Mutex
+	known map[string]map[string]time.Time // Peer addresses by file name, with when we last heard of them
+}
+
+// newPeerExchange creates an empty peer book
+func newPeerExchange() *peerExchange {
+	return &peerExchange{known: make(map[string]map[string]time.Time)}
+}
+
+// add records peers holding a file and returns how many of them were new.
+// Once the file's list is full the addresses heard of longest ago make room, and once
+// there are lists for too many files the one heard of longest ago goes.
+func (x *peerExchange) add(fileName string, addrs []string) int {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	peers := x.known[fileName]
+	if peers == nil && len(x.known) >= pexMaxFiles {
+		stalest, stalestSeen := "", time.Time{}
+		for name, known := range x.known {
+			var latest time.Time
+			for _, seen := range known {
+				if seen.After(latest) {
+					latest = seen
+				}
+			}
+			if stalest == "" || latest.Before(stalestSeen) {
+				stalest, stalestSeen = name, latest
+			}
+		}
+		delete(x.known, stalest)
+	}
+	if peers == nil {
+		peers = make(map[string]time.Time)
+		x.known[fileName] = peers
+	}
+
+	added := 0
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			continue
+		}
+		if _, ok := peers[addr]; !ok {
+			added++
+		}
+		peers[addr] = time.Now()
+	}
+
+	for len(peers) > pexMaxKnown {
+		oldest := ""
+		for addr, seen := range peers {
+			if oldest == "" || seen.Before(peers[oldest]) {
+				oldest = addr
+			}
+		}
+		delete(peers, oldest)
+	}
+	return added
+}
+
+// list returns up to limit peers holding a file, most recently heard of first,
+// leaving out one address (usually the peer the list is sent to)
+func (x *peerExchange) list(fileName string, exclude string, limit int) []string {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	peers := x.known[fileName]
+	var addrs []string
+	for addr, seen := range peers {
+		if time.Since(seen) > pexPeerTTL {
+			delete(peers, addr)
+			continue
+		}
+		if addr != exclude {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return peers[addrs[i]].After(peers[addrs[j]]) })
+	if len(addrs) > limit {
+		addrs = addrs[:limit]
+	}
+	return addrs
+}
+
+// encodePeerList writes addresses one per line
+func encodePeerList(addrs []string) []byte {
+	return []byte(strings.Join(addrs, "\n"))
+}
+
+// decodePeerList reads the lines written by encodePeerList, keeping at most pexMaxPeers
+func decodePeerList(payload []byte) []string {
+	var addrs []string
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		addrs = append(addrs, line)
+		if len(addrs) == pexMaxPeers {
+			break
+		}
+	}
+	return addrs
+}
+
+// serveFileChunk sends a requested chunk of a file to another peer
+func (c *P2PPeer) serveFileChunk(session *peerSession, shared *sharedFile, chunkIndex int) {
+	fileName := shared.name
+	file, err := os.Open(shared.path)
+	if err != nil {
+		logger.Error("Error opening file", "file", fileName, "err", err)
+		return
+	}
+	defer file.Close()
+
+	// Seek to the start of the chunk
+	_, err = file.Seek(int64(chunkIndex*ChunkSize), 0)
+	if err != nil {
+		logger.Error("Error seeking file", "file", fileName, "chunk", chunkIndex, "err", err)
+		return
+	}
+
+	// Read the chunk
+	buffer := make([]byte, ChunkSize)
+	n, err := file.Read(buffer)
+	if err != nil && err != io.EOF {
+		logger.Error("Error reading file chunk", "file", fileName, "chunk", chunkIndex, "err", err)
+		return
+	}
+
+	// Hold the chunk until the upload limits allow it through
+	c.limiter.waitUpload(session.remoteHost(), n)
+
+	// Send the chunk
+	err = session.send("PIECE", buffer[:n], fileName, strconv.Itoa(chunkIndex))
+	if err != nil {
+		c.metrics.add("peer_errors_total", 1, label("kind", "serve"))
+		logger.Warn("Error sending file chunk", "peer", session.conn.RemoteAddr().String(), "file", fileName, "chunk", chunkIndex, "err", err)
+		return
+	}
+	c.choker.recordUpload(session, n)
+	c.metrics.add("peer_uploaded_bytes_total", float64(n))
+	c.metrics.add("peer_chunks_served_total", 1)
+
+	logger.Debug("Served chunk", "peer", session.conn.RemoteAddr().String(), "file", fileName, "chunk", chunkIndex, "bytes", n)
+}
+
+// sharedFile is a file we can serve chunks of, either complete or still downloading
+type sharedFile struct {
+	lock     sync.Mutex
+	name     string                // Name the file is shared under
+	path     string                // Location of the file on disk
+	size     int64                 // Full size of the file in bytes
+	hash     string                // SHA-256 of the content, empty until the file is complete
+	have     []bool                // Chunks we hold
+	watchers map[*peerSession]bool // Sessions that get a HAVE message for every new chunk
+
+	chunkHashes []byte // SHA-256 of every chunk, concatenated, once worked out
+	manifest    []byte // Manifest signed by the file's publisher, nil if there is none
+}
+
+// chunkCount returns the number of chunks a file of the given size is split into
+func chunkCount(size int64) int {
+	return int((size + ChunkSize - 1) / ChunkSize)
+}
+
+// maxFileSize is the largest file a peer may offer; its bitfield has to fit in one message
+const maxFileSize = maxMessageSize * 8 * ChunkSize
+
+// chunkLength returns the number of bytes in a chunk of a file of the given size; only
+// the last chunk may be short
+func chunkLength(size int64, chunkIndex int) int64 {
+	return min(ChunkSize, size-int64(chunkIndex)*ChunkSize)
+}
+
+// shareFile makes a complete file on disk available to other peers
+func (c *P2PPeer) shareFile(path string) (*sharedFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := c.addPartialFile(filepath.Base(path), path, info.Size())
+	file.lock.Lock()
+	file.manifest = loadManifest(path, file.name, file.size, hash)
+	file.hash = hash
+	for i := range file.have {
+		file.have[i] = true
+	}
+	file.lock.Unlock()
+	return file, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// isFileHash reports whether s looks like a hex encoded SHA-256 rather than a file name
+func isFileHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// addPartialFile starts sharing a file of which we hold no chunks yet
+func (c *P2PPeer) addPartialFile(name string, path string, size int64) *sharedFile {
+	file := &sharedFile{
+		name:     name,
+		path:     path,
+		size:     size,
+		have:     make([]bool, chunkCount(size)),
+		watchers: make(map[*peerSession]bool),
+	}
+
+	c.filesLock.Lock()
+	defer c.filesLock.Unlock()
+	if _, exists := c.files[name]; !exists {
+		c.availableFiles = append(c.availableFiles, name)
+	}
+	c.files[name] = file
+	return file
+}
+
+// lookupFile returns the shared file with the given name or content hash, or nil
+func (c *P2PPeer) lookupFile(name string) *sharedFile {
+	c.filesLock.Lock()
+	defer c.filesLock.Unlock()
+
+	if file, ok := c.files[name]; ok {
+		return file
+	}
+	if isFileHash(name) {
+		for _, file := range c.files {
+			if file.getHash() == name {
+				return file
+			}
+		}
+	}
+	return nil
+}
+
+// sharedFiles returns every file we share
+func (c *P2PPeer) sharedFiles() []*sharedFile {
+	c.filesLock.Lock()
+	defer c.filesLock.Unlock()
+
+	files := make([]*sharedFile, 0, len(c.files))
+	for _, name := range c.availableFiles {
+		files = append(files, c.files[name])
+	}
+	return files
+}
+
+// removeFile stops sharing a file
+func (c *P2PPeer) removeFile(name string) {
+	c.filesLock.Lock()
+	defer c.filesLock.Unlock()
+
+	delete(c.files, name)
+	for i, available := range c.availableFiles {
+		if available == name {
+			c.availableFiles = append(c.availableFiles[:i], c.availableFiles[i+1:]...)
+			break
+		}
+	}
+}
+
+// getHash returns the content hash, or an empty string if the file is incomplete
+func (f *sharedFile) getHash() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.hash
+}
+
+// setHash records the content hash once the file is complete
+func (f *sharedFile) setHash(hash string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hash = hash
+}
+
+// getManifest returns the file's signed manifest, or nil
+func (f *sharedFile) getManifest() []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.manifest
+}
+
+// setManifest records the file's signed manifest
+func (f *sharedFile) setManifest(manifest []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.manifest = manifest
+}
+
+// getChunkHashes returns the SHA-256 of every chunk, concatenated, or nil while the file
+// is incomplete or when the list wouldn't fit in one message. They are worked out on
+// first use.
+func (f *sharedFile) getChunkHashes() ([]byte, error) {
+	f.lock.Lock()
+	hashes, complete := f.chunkHashes, f.hash != ""
+	f.lock.Unlock()
+	if hashes != nil || !complete || chunkCount(f.size)*sha256.Size > maxMessageSize {
+		return hashes, nil
+	}
+
+	hashes, err := hashChunks(f.path, f.size)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	f.chunkHashes = hashes
+	f.lock.Unlock()
+	return hashes, nil
+}
+
+// hashChunks returns the SHA-256 of every chunk of the file at path, concatenated
+func hashChunks(path string, size int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make([]byte, 0, chunkCount(size)*sha256.Size)
+	buffer := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			sum := sha256.Sum256(buffer[:n])
+			hashes = append(hashes, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(hashes) != chunkCount(size)*sha256.Size {
+		return nil, fmt.Errorf("%s changed size since it was shared", path)
+	}
+	return hashes, nil
+}
+
+// addChunk records a newly downloaded chunk and announces it to watching peers
+func (c *P2PPeer) addChunk(file *sharedFile, chunkIndex int) {
+	file.lock.Lock()
+	file.have[chunkIndex] = true
+	watchers := make([]*peerSession, 0, len(file.watchers))
+	for session := range file.watchers {
+		watchers = append(watchers, session)
+	}
+	file.lock.Unlock()
+
+	for _, session := range watchers {
+		session.send("HAVE", nil, file.name, strconv.Itoa(chunkIndex))
+	}
+}
+
+// hasChunk reports whether we hold a chunk of the file
+func (f *sharedFile) hasChunk(chunkIndex int) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return chunkIndex >= 0 && chunkIndex < len(f.have) && f.have[chunkIndex]
+}
+
+// watch subscribes a session to HAVE updates and returns the file size and current bitfield
+func (f *sharedFile) watch(session *peerSession) (int64, []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.watchers[session] = true
+	return f.size, encodeBitfield(f.have)
+}
+
+// unwatch stops HAVE updates to a session
+func (f *sharedFile) unwatch(session *peerSession) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.watchers, session)
+}
+
+// encodeBitfield packs chunk flags into bytes, with chunk 0 in the high bit of the first byte
+func encodeBitfield(have []bool) []byte {
+	bitfield := make([]byte, (len(have)+7)/8)
+	for i, ok := range have {
+		if ok {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bitfield
+}
+
+// decodeBitfield unpacks a bitfield into flags for the given number of chunks
+func decodeBitfield(bitfield []byte, chunks int) []bool {
+	have := make([]bool, chunks)
+	for i := range have {
+		if i/8 < len(bitfield) && bitfield[i/8]&(0x80>>(i%8)) != 0 {
+			have[i] = true
+		}
+	}
+	return have
+}
+
+// chunkScheduler decides which chunk each peer is asked for next. It picks the
+// rarest chunks first so that scarce chunks spread through the swarm quickly, and
+// switches to endgame mode once every missing chunk has been requested, asking
+// several peers for the same last chunks so a single slow peer can't hold up the end.
+type chunkScheduler struct {
+	lock         sync.Mutex
+	total        int                     // Number of chunks in the file
+	done         []bool                  // Chunks already written
+	remaining    int                     // Chunks still missing
+	availability []int                   // Number of peers holding each chunk
+	peerHas      map[string][]bool       // Chunks each peer has, by peer ID
+	requested    map[int]map[string]bool // Peers each outstanding chunk was requested from
+	endgame      bool                    // Duplicate requests are allowed
+	wake         chan struct{}           // Closed and replaced whenever the state changes
+	finished     chan struct{}           // Closed once every chunk is done
+}
+
+// newChunkScheduler creates a scheduler for a file with the given number of chunks
+func newChunkScheduler(total int) *chunkScheduler {
+	s := &chunkScheduler{
+		total:        total,
+		done:         make([]bool, total),
+		remaining:    total,
+		availability: make([]int, total),
+		peerHas:      make(map[string][]bool),
+		requested:    make(map[int]map[string]bool),
+		wake:         make(chan struct{}),
+		finished:     make(chan struct{}),
+	}
+	if total == 0 {
+		close(s.finished)
+	}
+	return s
+}
+
+// notify wakes everyone waiting for a change. Caller must hold the lock.
+func (s *chunkScheduler) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// changed returns a channel that is closed on the next state change
+func (s *chunkScheduler) changed() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.wake
+}
+
+// addPeer records the chunks a peer has
+func (s *chunkScheduler) addPeer(peerID string, has []bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.peerHas[peerID] = has
+	for i, ok := range has {
+		if ok {
+			s.availability[i]++
+		}
+	}
+	s.notify()
+}
+
+// removePeer forgets a peer and releases the chunks it was fetching
+func (s *chunkScheduler) removePeer(peerID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, ok := range s.peerHas[peerID] {
+		if ok {
+			s.availability[i]--
+		}
+	}
+	delete(s.peerHas, peerID)
+	for _, peers := range s.requested {
+		delete(peers, peerID)
+	}
+	s.notify()
+}
+
+// addChunk records a HAVE announcement from a peer
+func (s *chunkScheduler) addChunk(peerID string, chunkIndex int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	has, ok := s.peerHas[peerID]
+	if !ok || chunkIndex < 0 || chunkIndex >= s.total || has[chunkIndex] {
+		return
+	}
+	has[chunkIndex] = true
+	s.availability[chunkIndex]++
+	s.notify()
+}
+
+// removeChunk records that a peer does not have a chunk after all
+func (s *chunkScheduler) removeChunk(peerID string, chunkIndex int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	has, ok := s.peerHas[peerID]
+	if !ok || chunkIndex < 0 || chunkIndex >= s.total || !has[chunkIndex] {
+		return
+	}
+	has[chunkIndex] = false
+	s.availability[chunkIndex]--
+	s.notify()
+}
+
+// next picks the chunk to request from a peer and marks it as requested.
+// It returns false if the peer has nothing we still need.
+func (s *chunkScheduler) next(peerID string) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	has := s.peerHas[peerID]
+	if has == nil || s.remaining == 0 {
+		return 0, false
+	}
+
+	// Start at a random chunk so peers with equally rare chunks don't all pick the same one
+	offset := rand.Intn(s.total)
+	best := -1
+	unrequested := false
+	for k := 0; k < s.total; k++ {
+		i := (offset + k) % s.total
+		if s.done[i] || len(s.requested[i]) > 0 {
+			continue
+		}
+		unrequested = true
+		if has[i] && (best < 0 || s.availability[i] < s.availability[best]) {
+			best = i
+		}
+	}
+
+	// Endgame starts once every missing chunk is already on its way
+	if !unrequested && !s.endgame {
+		s.endgame = true
+		logger.Info("Entering endgame mode", "chunks_left", s.remaining)
+	}
+
+	// In endgame, duplicate the chunk with the fewest outstanding requests
+	if best < 0 && s.endgame {
+		for k := 0; k < s.total; k++ {
+			i := (offset + k) % s.total
+			if s.done[i] || !has[i] || s.requested[i][peerID] {
+				continue
+			}
+			if best < 0 || len(s.requested[i]) < len(s.requested[best]) {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+
+	if s.requested[best] == nil {
+		s.requested[best] = make(map[string]bool)
+	}
+	s.requested[best][peerID] = true
+	return best, true
+}
+
+// cancel releases a request that will not be answered
+func (s *chunkScheduler) cancel(chunkIndex int, peerID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.requested[chunkIndex], peerID)
+	s.notify()
+}
+
+// finish marks a chunk as done. It returns false if another peer already delivered it.
+func (s *chunkScheduler) finish(chunkIndex int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.done[chunkIndex] {
+		return false
+	}
+	s.done[chunkIndex] = true
+	delete(s.requested, chunkIndex)
+	s.remaining--
+	if s.remaining == 0 {
+		close(s.finished)
+	}
+	s.notify()
+	return true
+}
+
+// isDone reports whether a chunk has already been written
+func (s *chunkScheduler) isDone(chunkIndex int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.done[chunkIndex]
+}
+
+// complete reports whether every chunk has been written
+func (s *chunkScheduler) complete() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remaining == 0
+}
+
+// stalled reports whether no connected peer has any chunk we still need and
+// nothing is in flight, so waiting longer can't help
+func (s *chunkScheduler) stalled() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := 0; i < s.total; i++ {
+		if !s.done[i] && (s.availability[i] > 0 || len(s.requested[i]) > 0) {
+			return false
+		}
+	}
+	return s.remaining > 0
+}
+
+// progress returns the number of chunks done and the total
+func (s *chunkScheduler) progress() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total - s.remaining, s.total
+}
+
+// dhtContact is a node in the DHT routing table
+type dhtContact struct {
+	id      []byte // 160-bit node ID, which is the node's peer ID
+	address string // Address of the node's peer server
+}
+
+// dhtProvider is a peer that announced it shares a file
+type dhtProvider struct {
+	hash    string    // Content hash of the file
+	name    string    // Name the file is shared under
+	address string    // Address of the provider's peer server
+	expires time.Time // When the announcement must be refreshed by
+}
+
+// dhtNode is a Kademlia node running on top of the peer listener. Nodes are kept in
+// k-buckets by XOR distance, and files are announced with STORE under two keys: the
+// first 160 bits of the content hash, and the SHA-256 of the file name so that files
+// can also be found by name without a tracker.
+type dhtNode struct {
+	peer    *P2PPeer
+	self    []byte // Our node ID
+	lock    sync.Mutex
+	buckets [dhtIDBits][]dhtContact           // Bucket i holds nodes sharing an i-bit prefix with us
+	values  map[string]map[string]dhtProvider // Providers stored on this node, by key and address
+}
+
+const (
+	dhtIDBits            = 160              // Length of node IDs and keys
+	dhtBucketSize        = 20               // Kademlia k: contacts per bucket and nodes a value is stored on
+	dhtAlpha             = 3                // Parallel requests during a lookup
+	dhtTimeout           = 5 * time.Second  // How long to wait for a DHT reply
+	dhtValueTTL          = time.Hour        // How long stored providers are kept
+	dhtRepublishInterval = 30 * time.Minute // How often our own files are announced again
+	dhtMaxKeyProviders   = 200              // Most providers stored under one key
+	dhtMaxHostValues     = 100              // Most providers stored for the servers on one host
+	dhtMaxValues         = 10000            // Most providers stored in all
+)
+
+// newDHTNode creates a DHT node for the peer, using its peer ID as node ID
+func newDHTNode(peer *P2PPeer) *dhtNode {
+	self, _ := hex.DecodeString(peer.id)
+	return &dhtNode{
+		peer:   peer,
+		self:   self,
+		values: make(map[string]map[string]dhtProvider),
+	}
+}
+
+// dhtDistance returns the XOR distance between two IDs
+func dhtDistance(a []byte, b []byte) []byte {
+	distance := make([]byte, len(a))
+	for i := range a {
+		distance[i] = a[i] ^ b[i]
+	}
+	return distance
+}
+
+// contentKey returns the DHT key a file is stored under by content hash
+func contentKey(hash string) []byte {
+	key, _ := hex.DecodeString(hash)
+	return key[:dhtIDBits/8]
+}
+
+// nameKey returns the DHT key a file is stored under by name
+func nameKey(name string) []byte {
+	sum := sha256.Sum256([]byte(name))
+	return sum[:dhtIDBits/8]
+}
+
+// bucketIndex returns the bucket an ID belongs in, or -1 for our own ID
+func (d *dhtNode) bucketIndex(id []byte) int {
+	for i, b := range dhtDistance(d.self, id) {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// seen records that a node is alive. Recently seen nodes move to the tail of their bucket;
+// when a bucket is full the least recently seen node is kept if it still answers a ping.
+func (d *dhtNode) seen(peerID string, address string) {
+	id, err := hex.DecodeString(peerID)
+	if err != nil || len(id) != dhtIDBits/8 {
+		return
+	}
+	index := d.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+	contact := dhtContact{id: id, address: address}
+
+	d.lock.Lock()
+	bucket := d.buckets[index]
+	for i, existing := range bucket {
+		if bytes.Equal(existing.id, id) {
+			bucket = append(bucket[:i:i], bucket[i+1:]...)
+			d.buckets[index] = append(bucket, contact)
+			d.lock.Unlock()
+			return
+		}
+	}
+	if len(bucket) < dhtBucketSize {
+		d.buckets[index] = append(bucket, contact)
+		d.lock.Unlock()
+		return
+	}
+	oldest := bucket[0]
+	d.lock.Unlock()
+
+	// Long-lived nodes tend to stay up, so only replace the oldest contact if it is gone
+	go func() {
+		if d.ping(oldest.address) == nil {
+			return
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		bucket := d.buckets[index]
+		for i, existing := range bucket {
+			if bytes.Equal(existing.id, oldest.id) {
+				bucket = append(bucket[:i:i], bucket[i+1:]...)
+				d.buckets[index] = append(bucket, contact)
+				return
+			}
+		}
+	}()
+}
+
+// closest returns up to n known contacts ordered by distance to the target
+func (d *dhtNode) closest(target []byte, n int) []dhtContact {
+	d.lock.Lock()
+	var contacts []dhtContact
+	for _, bucket := range d.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	d.lock.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// sortByDistance orders contacts by XOR distance to the target, closest first
+func sortByDistance(contacts []dhtContact, target []byte) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return bytes.Compare(dhtDistance(contacts[i].id, target), dhtDistance(contacts[j].id, target)) < 0
+	})
+}
+
+// size returns the number of contacts in the routing table
+func (d *dhtNode) size() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := 0
+	for _, bucket := range d.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// handleRequest answers a DHT request that arrived on the peer listener
+func (d *dhtNode) handleRequest(session *peerSession, msg message) {
+	switch msg.kind {
+	case "PING":
+		session.send("PONG", nil)
+
+	case "FIND_NODE":
+		target, err := hex.DecodeString(firstArg(msg))
+		if err != nil || len(target) != dhtIDBits/8 {
+			return
+		}
+		session.send("NODES", encodeContacts(d.closest(target, dhtBucketSize)))
+
+	case "FIND_VALUE":
+		key := firstArg(msg)
+		target, err := hex.DecodeString(key)
+		if err != nil || len(target) != dhtIDBits/8 {
+			return
+		}
+		providers := d.providers(key)
+		if len(providers) > 0 {
+			session.send("VALUES", encodeProviders(providers))
+			return
+		}
+		session.send("NODES", encodeContacts(d.closest(target, dhtBucketSize)))
+
+	case "STORE":
+		// STORE:<key>:<content hash>:<file name>, provided by the sender's own server and
+		// kept only under a key the file is looked up by
+		if len(msg.args) != 3 || session.listenPort == "" {
+			return
+		}
+		key, hash, name := msg.args[0], msg.args[1], msg.args[2]
+		if !isFileHash(hash) || !isFileName(name) || (key != hex.EncodeToString(contentKey(hash)) && key != hex.EncodeToString(nameKey(name))) {
+			session.send("NOT_STORED", nil)
+			return
+		}
+		host, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+		stored := d.store(key, dhtProvider{
+			hash:    hash,
+			name:    name,
+			address: net.JoinHostPort(host, session.listenPort),
+			expires: time.Now().Add(dhtValueTTL),
+		})
+		if !stored {
+			session.send("NOT_STORED", nil)
+			return
+		}
+		session.send("STORED", nil)
+	}
+}
+
+// firstArg returns the first header argument of a message, or an empty string
+func firstArg(msg message) string {
+	if len(msg.args) == 0 {
+		return ""
+	}
+	return msg.args[0]
+}
+
+// store keeps a provider announcement under a key. It returns false, keeping nothing,
+// once the key, the provider's host or the node as a whole holds all it may; refreshing
+// an announcement already held always works.
+func (d *dhtNode) store(key string, provider dhtProvider) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Count what is held, dropping what expired
+	host, _, _ := net.SplitHostPort(provider.address)
+	total, fromHost := 0, 0
+	for k, providers := range d.values {
+		for address, p := range providers {
+			if time.Now().After(p.expires) {
+				delete(providers, address)
+				continue
+			}
+			total++
+			if h, _, _ := net.SplitHostPort(address); h == host {
+				fromHost++
+			}
+		}
+		if len(providers) == 0 {
+			delete(d.values, k)
+		}
+	}
+
+	if _, held := d.values[key][provider.address]; !held {
+		if len(d.values[key]) >= dhtMaxKeyProviders || fromHost >= dhtMaxHostValues || total >= dhtMaxValues {
+			return false
+		}
+	}
+	if d.values[key] == nil {
+		d.values[key] = make(map[string]dhtProvider)
+	}
+	d.values[key][provider.address] = provider
+	return true
+}
+
+// providers returns the unexpired providers stored under a key
+func (d *dhtNode) providers(key string) []dhtProvider {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var providers []dhtProvider
+	for address, provider := range d.values[key] {
+		if time.Now().After(provider.expires) {
+			delete(d.values[key], address)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+// encodeContacts writes contacts as "<id> <address>" lines
+func encodeContacts(contacts []dhtContact) []byte {
+	var buffer bytes.Buffer
+	for _, contact := range contacts {
+		fmt.Fprintf(&buffer, "%s %s\n", hex.EncodeToString(contact.id), contact.address)
+	}
+	return buffer.Bytes()
+}
+
+// decodeContacts reads the lines written by encodeContacts, skipping malformed ones
+func decodeContacts(payload []byte) []dhtContact {
+	var contacts []dhtContact
+	for _, line := range strings.Split(string(payload), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		id, err := hex.DecodeString(fields[0])
+		if err != nil || len(id) != dhtIDBits/8 {
+			continue
+		}
+		contacts = append(contacts, dhtContact{id: id, address: fields[1]})
+	}
+	return contacts
+}
+
+// encodeProviders writes providers as "<hash> <address> <name>" lines
+func encodeProviders(providers []dhtProvider) []byte {
+	var buffer bytes.Buffer
+	for _, provider := range providers {
+		fmt.Fprintf(&buffer, "%s %s %s\n", provider.hash, provider.address, provider.name)
+	}
+	return buffer.Bytes()
+}
+
+// decodeProviders reads the lines written by encodeProviders, skipping malformed ones
+func decodeProviders(payload []byte) []dhtProvider {
+	var providers []dhtProvider
+	for _, line := range strings.Split(string(payload), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || !isFileHash(fields[0]) || !isFileName(fields[2]) {
+			continue
+		}
+		providers = append(providers, dhtProvider{hash: fields[0], address: fields[1], name: fields[2]})
+	}
+	return providers
+}
+
+// call sends one DHT request to a node and waits for its reply
+func (d *dhtNode) call(address string, kind string, args ...string) (message, error) {
+	session, err := d.peer.openSession(address, "")
+	if err != nil {
+		return message{}, err
+	}
+	defer session.conn.Close()
+
+	err = session.send(kind, nil, args...)
+	if err != nil {
+		return message{}, err
+	}
+	for {
+		msg, err := session.next(dhtTimeout)
+		if err != nil {
+			return message{}, err
+		}
+		if msg.kind == "NO_DHT" {
+			return message{}, fmt.Errorf("peer %s is not part of the DHT", address)
+		}
+		if msg.kind != "CHOKE" && msg.kind != "UNCHOKE" {
+			return msg, nil
+		}
+	}
+}
+
+// ping checks whether a node is alive. The handshake adds it to the routing table.
+func (d *dhtNode) ping(address string) error {
+	_, err := d.call(address, "PING")
+	return err
+}
+
+// lookup runs an iterative Kademlia lookup for the nodes closest to the target.
+// With findValue set it stops as soon as some node returns providers for the key.
+func (d *dhtNode) lookup(target []byte, findValue bool) ([]dhtContact, []dhtProvider) {
+	kind := "FIND_NODE"
+	if findValue {
+		kind = "FIND_VALUE"
+	}
+	key := hex.EncodeToString(target)
+
+	shortlist := d.closest(target, dhtBucketSize)
+	known := make(map[string]bool)
+	for _, contact := range shortlist {
+		known[contact.address] = true
+	}
+	queried := make(map[string]bool)
+	var providers []dhtProvider
+
+	type reply struct {
+		contact dhtContact
+		msg     message
+		err     error
+	}
+
+	for {
+		// Ask the closest nodes we have not asked yet, a few at a time
+		var batch []dhtContact
+		for _, contact := range shortlist {
+			if !queried[contact.address] {
+				batch = append(batch, contact)
+				queried[contact.address] = true
+			}
+			if len(batch) == dhtAlpha {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make(chan reply, len(batch))
+		for _, contact := range batch {
+			go func(contact dhtContact) {
+				msg, err := d.call(contact.address, kind, key)
+				replies <- reply{contact, msg, err}
+			}(contact)
+		}
+
+		failed := make(map[string]bool)
+		for range batch {
+			r := <-replies
+			if r.err != nil {
+				failed[r.contact.address] = true
+				continue
+			}
+			switch r.msg.kind {
+			case "NODES":
+				for _, contact := range decodeContacts(r.msg.payload) {
+					if !known[contact.address] && !bytes.Equal(contact.id, d.self) {
+						known[contact.address] = true
+						shortlist = append(shortlist, contact)
+					}
+				}
+			case "VALUES":
+				// The nodes asked together often hold the same providers
+				for _, provider := range decodeProviders(r.msg.payload) {
+					if !slices.ContainsFunc(providers, func(p dhtProvider) bool { return p.address == provider.address && p.hash == provider.hash }) {
+						providers = append(providers, provider)
+					}
+				}
+			}
+		}
+
+		// Drop nodes that didn't answer and keep only the k closest
+		alive := shortlist[:0]
+		for _, contact := range shortlist {
+			if !failed[contact.address] {
+				alive = append(alive, contact)
+			}
+		}
+		shortlist = alive
+		sortByDistance(shortlist, target)
+		if len(shortlist) > dhtBucketSize {
+			shortlist = shortlist[:dhtBucketSize]
+		}
+
+		if findValue && len(providers) > 0 {
+			break
+		}
+	}
+	return shortlist, providers
+}
+
+// bootstrap joins the DHT through the given nodes and fills the routing table
+// by looking up our own ID
+func (d *dhtNode) bootstrap(addresses []string) {
+	for _, address := range addresses {
+		err := d.ping(address)
+		if err != nil {
+			logger.Warn("Error reaching DHT bootstrap node", "node", address, "err", err)
+		}
+	}
+	d.lookup(d.self, false)
+	logger.Info("Joined the DHT", "nodes", d.size())
+}
+
+// announce stores us as a provider of a complete file on the nodes closest to its keys
+func (d *dhtNode) announce(file *sharedFile) {
+	hash := file.getHash()
+	if hash == "" {
+		return
+	}
+
+	for _, key := range [][]byte{contentKey(hash), nameKey(file.name)} {
+		contacts, _ := d.lookup(key, false)
+		for _, contact := range contacts {
+			_, err := d.call(contact.address, "STORE", hex.EncodeToString(key), hash, file.name)
+			if err != nil {
+				logger.Warn("Error announcing to DHT node", "node", contact.address, "file", file.name, "err", err)
+			}
+		}
+	}
+}
+
+// findProviders looks up the peers sharing a file, by content hash or by name
+func (d *dhtNode) findProviders(nameOrHash string) []dhtProvider {
+	key := nameKey(nameOrHash)
+	if isFileHash(nameOrHash) {
+		key = contentKey(nameOrHash)
+	}
+
+	providers := d.providers(hex.EncodeToString(key))
+	if len(providers) == 0 {
+		_, providers = d.lookup(key, true)
+	}
+	return providers
+}
+
+// findInDHT looks up the peers sharing a file in the DHT. It returns the file name
+// and content hash they announced along with their addresses.
+func (c *P2PPeer) findInDHT(nameOrHash string) (string, string, []string) {
+	providers := c.dht.findProviders(nameOrHash)
+	if len(providers) == 0 {
+		return nameOrHash, "", nil
+	}
+
+	// Different files may have been shared under the same name, so stick to one version
+	chosen := providers[0]
+	var peerList []string
+	for _, provider := range providers {
+		if provider.hash == chosen.hash {
+			peerList = append(peerList, provider.address)
+		}
+	}
+	return chosen.name, chosen.hash, peerList
+}
+
+// republish announces our files again before their announcements expire, until shutdown
+func (d *dhtNode) republish() {
+	ticker := time.NewTicker(dhtRepublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.peer.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, file := range d.peer.sharedFiles() {
+			d.announce(file)
+		}
+	}
+}
+
+// message is one frame of the peer wire protocol: a colon separated header
+// such as "GET_CHUNK:poem1.txt:0" and an optional binary payload
+type message struct {
+	kind    string   // Message type, the first field of the header
+	args    []string // Remaining header fields
+	payload []byte   // Binary data such as a file chunk
+}
+
+// peerSession is a persistent connection to another peer.
+// Each frame is sent as a length-prefixed header followed by a length-prefixed payload.
+type peerSession struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeLock  sync.Mutex    // Keeps frames from interleaving when several goroutines send
+	peerID     string        // ID the remote peer announced in its handshake
+	listenPort string        // Port of the remote peer's server from its handshake
+	address    string        // Address of the remote peer's server, known on outgoing sessions
+	choked     bool          // The remote peer is refusing to upload to us
+	incoming   chan message  // Messages read in the background on outgoing sessions
+	readErr    error         // Why incoming was closed
+	closed     chan struct{} // Closed with the connection of an outgoing session
+}
+
+// closingConn is a connection that closes a channel when it is closed, so goroutines
+// serving it don't outlive it
+type closingConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Close closes the connection and the channel
+func (c *closingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// newPeerSession wraps a connection in the framed wire protocol
+func newPeerSession(conn net.Conn) *peerSession {
+	return &peerSession{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		choked: true, // Every peer starts out choked until told otherwise
+	}
+}
+
+// openSession connects to another peer's server and performs the handshake. A peer
+// behind NAT is only reached through the trackers when we name a file it shares.
+func (c *P2PPeer) openSession(address string, fileName string) (*peerSession, error) {
+	if !c.access.allowsAddress(address) {
+		return nil, fmt.Errorf("%s is denied or banned", address)
+	}
+	var session *peerSession
+	conn, err := c.dial(address)
+	if err == nil {
+		session = newPeerSession(conn)
+	} else {
+		// The peer may be behind NAT, in which case it has to connect to us instead
+		session, err = c.connectThroughNAT(address, fileName, err)
+		if err != nil {
+			return nil, err
+		}
+		conn = session.conn
+	}
+	session.address = address
+
+	err = session.send("HELLO", nil, append([]string{c.id, c.port}, c.swarm.hello()...)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msg, err := session.receiveWithin(dialTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !isHello(msg) {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected handshake %q from %s", msg.kind, address)
+	}
+	if !c.swarm.admits(msg.args[2:]) {
+		conn.Close()
+		return nil, fmt.Errorf("peer at %s is not in our swarm", address)
+	}
+	session.peerID = msg.args[0]
+	session.listenPort = msg.args[1]
+	if !c.access.allowsPeer(session.peerID) || !c.access.allowsAddress(conn.RemoteAddr().String()) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s at %s is denied or banned", session.peerID, address)
+	}
+	if c.dht != nil {
+		c.dht.seen(session.peerID, address)
+	}
+
+	// Read in the background so pushed messages such as HAVE are seen while idle
+	session.startReading()
+	return session, nil
+}
+
+// startReading makes an outgoing session read in the background into incoming, until
+// the session is closed even if nobody reads any more
+func (s *peerSession) startReading() {
+	s.incoming = make(chan message, 16)
+	s.closed = make(chan struct{})
+	s.conn = &closingConn{Conn: s.conn, closed: s.closed}
+	go s.readLoop()
+}
+
+// readLoop feeds incoming until the connection fails or is closed
+func (s *peerSession) readLoop() {
+	for {
+		msg, err := s.receive()
+		if err != nil {
+			s.readErr = err
+			close(s.incoming)
+			return
+		}
+		select {
+		case s.incoming <- msg:
+		case <-s.closed:
+			s.readErr = net.ErrClosed
+			close(s.incoming)
+			return
+		}
+	}
+}
+
+// next waits for the next message on an outgoing session
+func (s *peerSession) next(timeout time.Duration) (message, error) {
+	select {
+	case msg, open := <-s.incoming:
+		if !open {
+			return message{}, s.readErr
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return message{}, fmt.Errorf("timed out waiting for peer %s", s.address)
+	}
+}
+
+// remoteHost returns the IP the peer connected from or was reached at
+func (s *peerSession) remoteHost() string {
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return host
+}
+
+// send writes one frame to the peer
+func (s *peerSession) send(kind string, payload []byte, args ...string) error {
+	header := strings.Join(append([]string{kind}, args...), ":")
+	frame := make([]byte, 0, 8+len(header)+len(payload))
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(header)))
+	frame = append(frame, header...)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// A peer that stops reading must not block us forever
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// receive reads the next frame from the peer
+func (s *peerSession) receive() (message, error) {
+	header, err := s.readField(maxHeaderSize)
+	if err != nil {
+		return message{}, err
+	}
+	payload, err := s.readField(maxMessageSize)
+	if err != nil {
+		return message{}, err
+	}
+
+	parts := strings.Split(string(header), ":")
+	return message{kind: parts[0], args: parts[1:], payload: payload}, nil
+}
+
+// receiveWithin reads the next frame, giving up if none arrives before the timeout
+func (s *peerSession) receiveWithin(timeout time.Duration) (message, error) {
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	return s.receive()
+}
+
+// readField reads one length-prefixed field of a frame of at most limit bytes
+func (s *peerSession) readField(limit uint32) ([]byte, error) {
+	sizeBuffer := make([]byte, 4)
+	_, err := io.ReadFull(s.reader, sizeBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(sizeBuffer)
+	if size > limit {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	field := make([]byte, size)
+	_, err = io.ReadFull(s.reader, field)
+	if err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// uTP packet types. A packet is a 21 byte header (type, connection ID, sequence number,
+// cumulative ack, send timestamp in microseconds and the echoed one-way delay) followed
+// by up to utpMaxPayload bytes of stream data.
+const (
+	utpData byte = iota
+	utpAck
+	utpSyn
+	utpSynAck
+	utpFin
+)
+
+const (
+	utpHeaderSize  = 21
+	utpMaxPayload  = 1200                   // Stream bytes per packet, small enough to avoid fragmentation
+	utpTargetDelay = 100 * time.Millisecond // Queuing delay LEDBAT aims for before backing off
+	utpMinWindow   = 2 * utpMaxPayload      // Smallest congestion window in bytes
+	utpMaxWindow   = 1 << 20                // Largest congestion window in bytes
+	utpMaxBuffered = 4 << 20                // Unread bytes a receiver holds before dropping data
+	utpMinRTO      = 500 * time.Millisecond // Shortest retransmission timeout
+	utpMaxRTO      = 10 * time.Second       // Longest retransmission timeout
+	utpBaseHistory = 2 * time.Minute        // How long the lowest delay seen counts as the base delay
+	utpIdleTimeout = 30 * time.Second       // How long unacknowledged data may go without progress
+	utpTick        = 50 * time.Millisecond  // How often timeouts are checked
+)
+
+// utpPacket is a data packet waiting to be acknowledged
+type utpPacket struct {
+	seq           uint32
+	data          []byte
+	sent          time.Time
+	retransmitted bool // Retransmitted packets don't give RTT samples
+}
+
+// utpConn is a reliable, ordered byte stream over UDP with LEDBAT congestion control:
+// the sender grows its window while the one-way delay stays near the lowest delay seen
+// and shrinks it as queues build up, so transfers yield to other traffic on the link.
+// It implements net.Conn, so peer sessions run on it exactly as on TCP.
+type utpConn struct {
+	socket  *net.UDPConn
+	remote  *net.UDPAddr
+	id      uint32 // Connection ID, chosen by the dialling side
+	dialled bool   // The socket belongs to this connection alone
+	onClose func() // Lets a listener forget the connection
+	lock    sync.Mutex
+	changed *sync.Cond // Broadcast on every state change and every tick
+
+	// Sending
+	nextSeq      uint32
+	unacked      []*utpPacket // Sent but not yet acknowledged, in order
+	inFlight     int          // Bytes in unacked
+	window       float64      // Congestion window in bytes
+	baseDelay    uint32       // Lowest one-way delay seen, in microseconds
+	baseSince    time.Time
+	srtt, rttVar time.Duration
+	rto          time.Duration
+	lastProgress time.Time // When unacknowledged data last got acknowledged
+
+	// Receiving
+	nextExpected uint32
+	readBuffer   bytes.Buffer
+
+	established   chan struct{} // Closed once the handshake is done
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+	remoteClosed  bool   // The remote side sent FIN
+	finSeq        uint32 // Sequence number after the remote side's last data packet
+	err           error  // Why the connection broke, if it did
+}
+
+// newUTPConn creates the state for one connection and starts its timer
+func newUTPConn(socket *net.UDPConn, remote *net.UDPAddr, id uint32) *utpConn {
+	u := &utpConn{
+		socket:      socket,
+		remote:      remote,
+		id:          id,
+		window:      utpMinWindow,
+		rto:         time.Second,
+		established: make(chan struct{}),
+	}
+	u.changed = sync.NewCond(&u.lock)
+	go u.tick()
+	return u
+}
+
+// dialUTP connects to a peer's uTP listener
+func dialUTP(address string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	u := newUTPConn(socket, remote, rand.Uint32())
+	u.dialled = true
+	go u.readLoop()
+
+	// Repeat the SYN until the listener answers, as either may be lost
+	deadline := time.After(timeout)
+	for {
+		u.sendPacket(utpSyn, 0, nil)
+		select {
+		case <-u.established:
+			return u, nil
+		case <-time.After(utpMinRTO):
+		case <-deadline:
+			u.abort(fmt.Errorf("uTP handshake with %s timed out", address))
+			socket.Close()
+			return nil, u.err
+		}
+	}
+}
+
+// readLoop delivers the packets arriving on a dialled connection's own socket
+func (u *utpConn) readLoop() {
+	buffer := make([]byte, utpHeaderSize+utpMaxPayload)
+	for {
+		n, from, err := u.socket.ReadFromUDP(buffer)
+		if err != nil {
+			u.abort(err)
+			return
+		}
+		if !from.IP.Equal(u.remote.IP) || from.Port != u.remote.Port || n < utpHeaderSize {
+			continue
+		}
+		if binary.LittleEndian.Uint32(buffer[1:5]) != u.id {
+			continue
+		}
+		u.handlePacket(buffer[:n])
+	}
+}
+
+// sendPacket writes one packet to the remote side
+func (u *utpConn) sendPacket(kind byte, seq uint32, data []byte) error {
+	return u.sendWithDelay(kind, seq, 0, data)
+}
+
+// sendWithDelay writes one packet carrying an echoed one-way delay
+func (u *utpConn) sendWithDelay(kind byte, seq uint32, delay uint32, data []byte) error {
+	packet := make([]byte, utpHeaderSize+len(data))
+	packet[0] = kind
+	binary.LittleEndian.PutUint32(packet[1:5], u.id)
+	binary.LittleEndian.PutUint32(packet[5:9], seq)
+	binary.LittleEndian.PutUint32(packet[9:13], u.nextExpected)
+	binary.LittleEndian.PutUint32(packet[13:17], uint32(time.Now().UnixMicro()))
+	binary.LittleEndian.PutUint32(packet[17:21], delay)
+	copy(packet[utpHeaderSize:], data)
+	_, err := u.socket.WriteToUDP(packet, u.remote)
+	return err
+}
+
+// handlePacket applies an incoming packet to the connection
+func (u *utpConn) handlePacket(packet []byte) {
+	kind := packet[0]
+	seq := binary.LittleEndian.Uint32(packet[5:9])
+	ack := binary.LittleEndian.Uint32(packet[9:13])
+	timestamp := binary.LittleEndian.Uint32(packet[13:17])
+	delay := binary.LittleEndian.Uint32(packet[17:21])
+	data := packet[utpHeaderSize:]
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	defer u.changed.Broadcast()
+
+	switch kind {
+	case utpSynAck:
+		select {
+		case <-u.established:
+		default:
+			close(u.established)
+		}
+
+	case utpData:
+		// Only the next packet in order is kept; the sender resends the rest. Data is
+		// also dropped while the reader is far behind, which throttles the sender.
+		if seq == u.nextExpected && u.readBuffer.Len() < utpMaxBuffered {
+			u.readBuffer.Write(data)
+			u.nextExpected++
+		}
+		// Echo how long the packet took, so the sender can see queues building up
+		u.sendWithDelay(utpAck, 0, uint32(time.Now().UnixMicro())-timestamp, nil)
+
+	case utpAck:
+		u.acknowledge(ack, delay)
+
+	case utpFin:
+		// FIN carries the sequence number after the last data packet, so data still
+		// on its way is read before the stream ends
+		if !u.remoteClosed {
+			u.remoteClosed = true
+			u.finSeq = seq
+		}
+	}
+}
+
+// acknowledge drops the packets below ack and adjusts the congestion window.
+// Caller must hold the lock.
+func (u *utpConn) acknowledge(ack uint32, delay uint32) {
+	acked := 0
+	for len(u.unacked) > 0 && int32(ack-u.unacked[0].seq) > 0 {
+		p := u.unacked[0]
+		u.unacked = u.unacked[1:]
+		acked += len(p.data)
+
+		if !p.retransmitted {
+			u.updateRTT(time.Since(p.sent))
+		}
+	}
+	if acked == 0 {
+		return
+	}
+	u.inFlight -= acked
+	u.lastProgress = time.Now()
+
+	// Track the lowest delay seen lately; anything above it is time spent in queues
+	if u.baseSince.IsZero() || time.Since(u.baseSince) > utpBaseHistory || delay < u.baseDelay {
+		u.baseDelay = delay
+		u.baseSince = time.Now()
+	}
+	queuing := time.Duration(delay-u.baseDelay) * time.Microsecond
+
+	// LEDBAT: grow while below the target delay, shrink in proportion once above it
+	offTarget := float64(utpTargetDelay-queuing) / float64(utpTargetDelay)
+	u.window += offTarget * float64(acked) * utpMaxPayload / u.window
+	u.window = math.Max(utpMinWindow, math.Min(utpMaxWindow, u.window))
+}
+
+// updateRTT folds a round trip sample into the retransmission timeout.
+// Caller must hold the lock.
+func (u *utpConn) updateRTT(sample time.Duration) {
+	if u.srtt == 0 {
+		u.srtt = sample
+		u.rttVar = sample / 2
+	} else {
+		diff := u.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		u.rttVar = (3*u.rttVar + diff) / 4
+		u.srtt = (7*u.srtt + sample) / 8
+	}
+	u.rto = u.srtt + 4*u.rttVar
+	if u.rto < utpMinRTO {
+		u.rto = utpMinRTO
+	}
+}
+
+// tick resends data that went unacknowledged for too long, halving the window as
+// for any loss, and wakes waiters so they notice expired deadlines
+func (u *utpConn) tick() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		u.lock.Lock()
+		if u.closed {
+			u.lock.Unlock()
+			return
+		}
+
+		if len(u.unacked) > 0 && time.Since(u.lastProgress) > utpIdleTimeout {
+			u.err = fmt.Errorf("uTP peer %s stopped responding", u.remote)
+			u.closed = true
+		} else if len(u.unacked) > 0 && time.Since(u.unacked[0].sent) > u.rto {
+			// Go back N: resend everything from the oldest lost packet on
+			for _, p := range u.unacked {
+				p.sent = time.Now()
+				p.retransmitted = true
+				u.sendPacket(utpData, p.seq, p.data)
+			}
+			u.window = math.Max(utpMinWindow, u.window/2)
+			u.rto = min(2*u.rto, utpMaxRTO)
+		}
+
+		u.changed.Broadcast()
+		u.lock.Unlock()
+	}
+}
+
+// abort breaks the connection with an error
+func (u *utpConn) abort(err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.closed {
+		u.err = err
+		u.closed = true
+	}
+	u.changed.Broadcast()
+}
+
+// Read returns buffered stream data, waiting for some to arrive
+func (u *utpConn) Read(b []byte) (int, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for u.readBuffer.Len() == 0 {
+		switch {
+		case u.remoteClosed && u.nextExpected == u.finSeq:
+			return 0, io.EOF
+		case u.err != nil:
+			return 0, u.err
+		case u.closed:
+			return 0, net.ErrClosed
+		case !u.readDeadline.IsZero() && time.Now().After(u.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		u.changed.Wait()
+	}
+	return u.readBuffer.Read(b)
+}
+
+// Write sends data as packets, waiting for room in the congestion window
+func (u *utpConn) Write(b []byte) (int, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		size := min(len(b)-written, utpMaxPayload)
+		for u.inFlight > 0 && float64(u.inFlight+size) > u.window {
+			switch {
+			case u.err != nil:
+				return written, u.err
+			case u.closed || u.remoteClosed:
+				return written, net.ErrClosed
+			case !u.writeDeadline.IsZero() && time.Now().After(u.writeDeadline):
+				return written, os.ErrDeadlineExceeded
+			}
+			u.changed.Wait()
+		}
+		if u.closed || u.remoteClosed {
+			return written, net.ErrClosed
+		}
+
+		p := &utpPacket{seq: u.nextSeq, data: append([]byte(nil), b[written:written+size]...), sent: time.Now()}
+		u.nextSeq++
+		if len(u.unacked) == 0 {
+			u.lastProgress = time.Now()
+		}
+		u.unacked = append(u.unacked, p)
+		u.inFlight += size
+		u.sendPacket(utpData, p.seq, p.data)
+		written += size
+	}
+	return written, nil
+}
+
+// Close waits briefly for sent data to be acknowledged, then tells the remote side
+func (u *utpConn) Close() error {
+	u.lock.Lock()
+	if u.closed {
+		u.lock.Unlock()
+		return nil
+	}
+	deadline := time.Now().Add(dialTimeout)
+	for len(u.unacked) > 0 && !u.remoteClosed && !u.closed && time.Now().Before(deadline) {
+		u.changed.Wait()
+	}
+
+	// FIN isn't acknowledged, so send a few in case some are lost
+	for i := 0; i < 3; i++ {
+		u.sendPacket(utpFin, u.nextSeq, nil)
+	}
+	u.closed = true
+	u.changed.Broadcast()
+	u.lock.Unlock()
+
+	if u.onClose != nil {
+		u.onClose()
+	}
+	if u.dialled {
+		return u.socket.Close()
+	}
+	return nil
+}
+
+func (u *utpConn) LocalAddr() net.Addr  { return u.socket.LocalAddr() }
+func (u *utpConn) RemoteAddr() net.Addr { return u.remote }
+
+func (u *utpConn) SetDeadline(t time.Time) error {
+	u.SetReadDeadline(t)
+	return u.SetWriteDeadline(t)
+}
+
+func (u *utpConn) SetReadDeadline(t time.Time) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.readDeadline = t
+	return nil
+}
+
+func (u *utpConn) SetWriteDeadline(t time.Time) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.writeDeadline = t
+	return nil
+}
+
+// utpListener accepts uTP connections on a single UDP socket, telling them apart
+// by remote address and connection ID. It implements net.Listener.
+type utpListener struct {
+	socket *net.UDPConn
+	lock   sync.Mutex
+	conns  map[string]*utpConn
+	accept chan *utpConn
+	done   chan struct{}
+}
+
+// listenUTP opens a uTP listener on a UDP port
+func listenUTP(port string) (*utpListener, error) {
+	address, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &utpListener{
+		socket: socket,
+		conns:  make(map[string]*utpConn),
+		accept: make(chan *utpConn, 16),
+		done:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// readLoop hands each packet to its connection, creating connections for new SYNs
+func (l *utpListener) readLoop() {
+	buffer := make([]byte, utpHeaderSize+utpMaxPayload)
+	for {
+		n, from, err := l.socket.ReadFromUDP(buffer)
+		if err != nil {
+			close(l.done)
+			return
+		}
+		if n < utpHeaderSize {
+			continue
+		}
+		id := binary.LittleEndian.Uint32(buffer[1:5])
+		key := from.String() + "/" + strconv.FormatUint(uint64(id), 10)
+
+		l.lock.Lock()
+		u := l.conns[key]
+		if u == nil && buffer[0] == utpSyn {
+			u = newUTPConn(l.socket, from, id)
+			close(u.established)
+			u.onClose = func() {
+				l.lock.Lock()
+				delete(l.conns, key)
+				l.lock.Unlock()
+			}
+
+			select {
+			case l.accept <- u:
+				l.conns[key] = u
+			default:
+				// Too many connections waiting to be accepted; the dialler will retry
+				u.abort(net.ErrClosed)
+				u = nil
+			}
+		}
+		l.lock.Unlock()
+
+		switch {
+		case u == nil:
+		case buffer[0] == utpSyn:
+			// Also answers repeated SYNs whose answer was lost
+			u.sendPacket(utpSynAck, 0, nil)
+		default:
+			u.handlePacket(buffer[:n])
+		}
+	}
+}
+
+// Accept waits for the next incoming connection
+func (l *utpListener) Accept() (net.Conn, error) {
+	select {
+	case u := <-l.accept:
+		return u, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *utpListener) Close() error   { return l.socket.Close() }
+func (l *utpListener) Addr() net.Addr { return l.socket.LocalAddr() }
+
+// tokenBucket is a token-bucket rate limiter measured in bytes per second.
+// A rate of 0 means the bucket never limits anything.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64   // Tokens (bytes) added per second
+	burst  float64   // Maximum number of tokens the bucket can hold
+	tokens float64   // Tokens currently available, negative while callers are waiting
+	last   time.Time // Last time tokens were added
+}
+
+// newTokenBucket creates a bucket that starts full
+func newTokenBucket(rate int) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+// setRate changes the rate of the bucket, which takes effect for the next wait
+func (b *tokenBucket) setRate(rate int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.rate = float64(rate)
+
+	// Allow up to one second worth of traffic in a burst, but never less than a chunk
+	b.burst = b.rate
+	if b.burst < ChunkSize {
+		b.burst = ChunkSize
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// refill adds the tokens earned since the last refill. Caller must hold the lock.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// full reports whether the bucket holds as many tokens as it can
+func (b *tokenBucket) full() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// wait blocks until n bytes may pass through the bucket
+func (b *tokenBucket) wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+
+	// Reserve the tokens now and sleep off any deficit outside the lock
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// bandwidthLimiter applies global and per-peer upload and download limits.
+// All rates are in bytes per second, and 0 means unlimited. Peers are told apart by
+// IP, as a peer could dodge its limit by reconnecting under a new peer ID.
+type bandwidthLimiter struct {
+	lock         sync.Mutex
+	upload       *tokenBucket            // Global upload limit
+	download     *tokenBucket            // Global download limit
+	peerUpload   int                     // Upload limit applied to each peer
+	peerDownload int                     // Download limit applied to each peer
+	uploads      map[string]*tokenBucket // Per-peer upload buckets, by IP
+	downloads    map[string]*tokenBucket // Per-peer download buckets, by IP
+	swept        time.Time               // When full per-peer buckets were last dropped
+}
+
+// bucketSweepInterval is how often per-peer buckets that refilled are dropped, so peers
+// that left don't keep theirs
+const bucketSweepInterval = time.Minute
+
+// newBandwidthLimiter creates a limiter with no limits set
+func newBandwidthLimiter() *bandwidthLimiter {
+	return &bandwidthLimiter{
+		upload:    newTokenBucket(0),
+		download:  newTokenBucket(0),
+		uploads:   make(map[string]*tokenBucket),
+		downloads: make(map[string]*tokenBucket),
+	}
+}
+
+// peerBucket returns the bucket for a peer's host, creating it on first use
+func (l *bandwidthLimiter) peerBucket(buckets map[string]*tokenBucket, host string, rate int) *tokenBucket {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// A full bucket is no different from a new one, so it can go until the peer is back
+	if time.Since(l.swept) > bucketSweepInterval {
+		for _, m := range []map[string]*tokenBucket{l.uploads, l.downloads} {
+			for p, b := range m {
+				if b.full() {
+					delete(m, p)
+				}
+			}
+		}
+		l.swept = time.Now()
+	}
+
+	bucket, ok := buckets[host]
+	if !ok {
+		bucket = newTokenBucket(rate)
+		buckets[host] = bucket
+	}
+	return bucket
+}
+
+// waitUpload blocks until n bytes may be sent to the peer at host
+func (l *bandwidthLimiter) waitUpload(host string, n int) {
+	l.peerBucket(l.uploads, host, l.getPeerUploadLimit()).wait(n)
+	l.upload.wait(n)
+}
+
+// waitDownload blocks until n bytes may be received from the peer at host
+func (l *bandwidthLimiter) waitDownload(host string, n int) {
+	l.peerBucket(l.downloads, host, l.getPeerDownloadLimit()).wait(n)
+	l.download.wait(n)
+}
+
+// getPeerUploadLimit returns the current per-peer upload limit
+func (l *bandwidthLimiter) getPeerUploadLimit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.peerUpload
+}
+
+// getPeerDownloadLimit returns the current per-peer download limit
+func (l *bandwidthLimiter) getPeerDownloadLimit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.peerDownload
+}
+
+// setUploadLimit changes the global upload limit
+func (l *bandwidthLimiter) setUploadLimit(rate int) {
+	l.upload.setRate(rate)
+}
+
+// setDownloadLimit changes the global download limit
+func (l *bandwidthLimiter) setDownloadLimit(rate int) {
+	l.download.setRate(rate)
+}
+
+// setPeerUploadLimit changes the upload limit of every peer, including ones already seen
+func (l *bandwidthLimiter) setPeerUploadLimit(rate int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.peerUpload = rate
+	for _, bucket := range l.uploads {
+		bucket.setRate(rate)
+	}
+}
+
+// setPeerDownloadLimit changes the download limit of every peer, including ones already seen
+func (l *bandwidthLimiter) setPeerDownloadLimit(rate int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.peerDownload = rate
+	for _, bucket := range l.downloads {
+		bucket.setRate(rate)
+	}
+}
+
+// uploadSlots caps the number of uploads served at once.
+// Requests beyond the cap wait in a FIFO queue until a slot frees up.
+type uploadSlots struct {
+	lock     sync.Mutex
+	max      int             // Maximum concurrent uploads (0 = unlimited)
+	maxQueue int             // Maximum number of waiting requests (0 = unlimited)
+	active   int             // Uploads currently holding a slot
+	queue    []chan struct{} // Waiting requests, oldest first
+}
+
+// newUploadSlots creates a slot pool with the given limits
+func newUploadSlots(max int, maxQueue int) *uploadSlots {
+	return &uploadSlots{max: max, maxQueue: maxQueue}
+}
+
+// waitIdle waits until no upload holds a slot and none is queued
+func (s *uploadSlots) waitIdle() {
+	for {
+		s.lock.Lock()
+		idle := s.active == 0 && len(s.queue) == 0
+		s.lock.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// acquire takes an upload slot, waiting in the queue if none is free.
+// It returns false if the queue is full and the request should be rejected.
+func (s *uploadSlots) acquire() bool {
+	s.lock.Lock()
+	if s.max <= 0 || s.active < s.max {
+		s.active++
+		s.lock.Unlock()
+		return true
+	}
+	if s.maxQueue > 0 && len(s.queue) >= s.maxQueue {
+		s.lock.Unlock()
+		return false
+	}
+
+	// Wait for release to hand over its slot
+	ready := make(chan struct{})
+	s.queue = append(s.queue, ready)
+	s.lock.Unlock()
+	<-ready
+	return true
+}
+
+// release gives back an upload slot, handing it to the next queued request if any
+func (s *uploadSlots) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queue) > 0 && (s.max <= 0 || s.active <= s.max) {
+		// The slot passes directly to the waiter, so active stays the same
+		close(s.queue[0])
+		s.queue = s.queue[1:]
+		return
+	}
+	s.active--
+}
+
+// setLimits changes the slot and queue limits, letting waiters in if slots opened up
+func (s *uploadSlots) setLimits(max int, maxQueue int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.max = max
+	s.maxQueue = maxQueue
+	for len(s.queue) > 0 && (s.max <= 0 || s.active < s.max) {
+		s.active++
+		close(s.queue[0])
+		s.queue = s.queue[1:]
+	}
+}
+
+// status returns the number of active and queued uploads
+func (s *uploadSlots) status() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active, len(s.queue)
+}
+
+// peerState is what we know about another peer we exchange data with
+type peerState struct {
+	id           string                // Peer ID from the handshake
+	address      string                // Remote address of the peer's latest connection to our server
+	sessions     map[*peerSession]bool // Connections to our server, with whether the peer wants data on each
+	choked       bool                  // We refuse to upload to the peer
+	interested   bool                  // The peer wants data from us on some session
+	optimistic   bool                  // The peer holds the optimistic unchoke slot
+	uploaded     int64                 // Total bytes we sent to the peer
+	downloaded   int64                 // Total bytes the peer sent to us
+	upWindow     int64                 // Bytes sent since the last rechoke
+	downWindow   int64                 // Bytes received since the last rechoke
+	uploadRate   float64               // Bytes per second sent to the peer over the last rechoke interval
+	downloadRate float64               // Bytes per second received from the peer over the last rechoke interval
+}
+
+// tell returns the change that tells every session of the peer its choke state
+func (p *peerState) tell(kind string) []chokeChange {
+	changes := make([]chokeChange, 0, len(p.sessions))
+	for session := range p.sessions {
+		changes = append(changes, chokeChange{session, kind})
+	}
+	return changes
+}
+
+// choker implements BitTorrent-style tit-for-tat. A few regular unchoke slots go to the
+// interested peers that upload to us fastest, and one optimistic slot rotates among the
+// rest so newcomers get a chance to prove themselves.
+type choker struct {
+	lock           sync.Mutex
+	slots          int                   // Regular unchoke slots, not counting the optimistic one
+	peers          map[string]*peerState // Known peers by chokeKey
+	optimistic     *peerState            // Peer holding the optimistic unchoke
+	lastRechoke    time.Time             // When rates were last computed
+	lastOptimistic time.Time             // When the optimistic unchoke last rotated
+}
+
+// chokeChange is a choke state update that still has to be sent to a peer
+type chokeChange struct {
+	session *peerSession
+	kind    string // CHOKE or UNCHOKE
+}
+
+// newChoker creates a choker with the given number of regular unchoke slots
+func newChoker(slots int) *choker {
+	return &choker{
+		slots:       slots,
+		peers:       make(map[string]*peerState),
+		lastRechoke: time.Now(),
+	}
+}
+
+// chokeKey returns what the choker keeps a peer under: the peer ID from its handshake and
+// its IP, so a host claiming another peer's ID gets a state of its own
+func chokeKey(session *peerSession) string {
+	return session.peerID + "@" + session.remoteHost()
+}
+
+// run reassigns unchoke slots every rechoke interval
+func (k *choker) run() {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		k.rechoke()
+	}
+}
+
+// state returns the state for a peer, creating it on first contact. Caller must hold the lock.
+func (k *choker) state(session *peerSession) *peerState {
+	key := chokeKey(session)
+	p, ok := k.peers[key]
+	if !ok {
+		p = &peerState{id: session.peerID, sessions: make(map[*peerSession]bool), choked: true}
+		k.peers[key] = p
+	}
+	return p
+}
+
+// connect registers an inbound session and tells the peer its initial choke state. A peer
+// downloading several files at once has a session for each, and all of them share its slot.
+func (k *choker) connect(session *peerSession) {
+	k.lock.Lock()
+	p := k.state(session)
+	if len(p.sessions) == 0 {
+		p.choked = true
+	}
+	p.sessions[session] = false
+	p.address = session.conn.RemoteAddr().String()
+	kind := "CHOKE"
+	if !p.choked {
+		kind = "UNCHOKE"
+	}
+	k.lock.Unlock()
+
+	session.send(kind, nil)
+}
+
+// disconnect forgets an inbound session and hands its slot to someone else if the peer
+// no longer wants data. The peer is forgotten with its last session, so peers that come
+// and go don't pile up.
+func (k *choker) disconnect(session *peerSession) {
+	k.lock.Lock()
+	key := chokeKey(session)
+	p := k.peers[key]
+	if p == nil {
+		k.lock.Unlock()
+		return
+	}
+	delete(p.sessions, session)
+	changes := k.updateInterest(p)
+	if len(p.sessions) == 0 {
+		p.choked = true
+		p.optimistic = false
+		delete(k.peers, key)
+	}
+	changes = append(changes, k.fillFreeSlots()...)
+	k.lock.Unlock()
+
+	sendChokeChanges(changes)
+}
+
+// setInterested records whether a peer wants data on a session, unchoking it straight away
+// if a slot is free. A download finishing on one session doesn't choke the peer while it
+// still wants data on another.
+func (k *choker) setInterested(session *peerSession, interested bool) {
+	k.lock.Lock()
+	p, ok := k.peers[chokeKey(session)]
+	if ok {
+		_, ok = p.sessions[session]
+	}
+	if !ok {
+		k.lock.Unlock()
+		return
+	}
+	p.sessions[session] = interested
+	changes := k.updateInterest(p)
+	changes = append(changes, k.fillFreeSlots()...)
+	k.lock.Unlock()
+
+	sendChokeChanges(changes)
+}
+
+// updateInterest works out whether the peer wants data on any session, choking it if
+// it no longer does since uninterested peers don't need a slot. Caller must hold the lock.
+func (k *choker) updateInterest(p *peerState) []chokeChange {
+	p.interested = false
+	for _, interested := range p.sessions {
+		p.interested = p.interested || interested
+	}
+	if p.interested || p.choked {
+		return nil
+	}
+	p.choked = true
+	p.optimistic = false
+	return p.tell("CHOKE")
+}
+
+// fillFreeSlots unchokes waiting peers while slots are unused. Caller must hold the lock.
+func (k *choker) fillFreeSlots() []chokeChange {
+	unchoked := 0
+	var waiting []*peerState
+	for _, p := range k.peers {
+		if len(p.sessions) == 0 {
+			continue
+		}
+		if !p.choked {
+			unchoked++
+		} else if p.interested {
+			waiting = append(waiting, p)
+		}
+	}
+
+	var changes []chokeChange
+	for _, p := range waiting {
+		if unchoked >= k.slots+1 {
+			break
+		}
+		p.choked = false
+		unchoked++
+		changes = append(changes, p.tell("UNCHOKE")...)
+	}
+	return changes
+}
+
+// isChoking reports whether we currently refuse to upload to the peer on a session
+func (k *choker) isChoking(session *peerSession) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	p, ok := k.peers[chokeKey(session)]
+	return !ok || p.choked
+}
+
+// recordUpload counts bytes we sent to a peer
+func (k *choker) recordUpload(session *peerSession, n int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	p := k.state(session)
+	p.uploaded += int64(n)
+	p.upWindow += int64(n)
+}
+
+// recordDownload counts bytes a peer sent to us
+func (k *choker) recordDownload(session *peerSession, n int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	p := k.state(session)
+	p.downloaded += int64(n)
+	p.downWindow += int64(n)
+}
+
+// setSlots changes the number of regular unchoke slots
+func (k *choker) setSlots(slots int) {
+	k.lock.Lock()
+	k.slots = slots
+	k.lock.Unlock()
+
+	k.rechoke()
+}
+
+// rechoke recomputes transfer rates and reassigns the unchoke slots
+func (k *choker) rechoke() {
+	k.lock.Lock()
+
+	now := time.Now()
+	elapsed := now.Sub(k.lastRechoke).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	k.lastRechoke = now
+
+	// Update rates and collect the connected peers that want data. Peers we only
+	// download from are forgotten once nothing came from them for an interval.
+	var candidates []*peerState
+	for key, p := range k.peers {
+		if len(p.sessions) == 0 && p.upWindow == 0 && p.downWindow == 0 {
+			delete(k.peers, key)
+			continue
+		}
+		p.uploadRate = float64(p.upWindow) / elapsed
+		p.downloadRate = float64(p.downWindow) / elapsed
+		p.upWindow = 0
+		p.downWindow = 0
+		if len(p.sessions) > 0 && p.interested {
+			candidates = append(candidates, p)
+		}
+	}
+
+	// Reward the peers that upload to us the most. When we are only seeding nobody
+	// uploads to us, so fall back to the peers that download from us the fastest.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].downloadRate != candidates[j].downloadRate {
+			return candidates[i].downloadRate > candidates[j].downloadRate
+		}
+		return candidates[i].uploadRate > candidates[j].uploadRate
+	})
+	unchoke := make(map[*peerState]bool)
+	for i := 0; i < len(candidates) && i < k.slots; i++ {
+		unchoke[candidates[i]] = true
+	}
+
+	// Rotate the optimistic unchoke when it is due, or when its holder earned a regular slot or left
+	current := k.optimistic
+	if current == nil || len(current.sessions) == 0 || !current.interested || unchoke[current] ||
+		now.Sub(k.lastOptimistic) >= optimisticInterval {
+		var choked []*peerState
+		for _, p := range candidates {
+			if !unchoke[p] {
+				choked = append(choked, p)
+			}
+		}
+		k.optimistic = nil
+		if len(choked) > 0 {
+			k.optimistic = choked[rand.Intn(len(choked))]
+		}
+		k.lastOptimistic = now
+	}
+	if k.optimistic != nil {
+		unchoke[k.optimistic] = true
+	}
+
+	// Apply the new assignment to every connected peer
+	var changes []chokeChange
+	for _, p := range k.peers {
+		p.optimistic = p == k.optimistic
+		if len(p.sessions) == 0 {
+			continue
+		}
+		if unchoke[p] && p.choked {
+			p.choked = false
+			changes = append(changes, p.tell("UNCHOKE")...)
+		} else if !unchoke[p] && !p.choked {
+			p.choked = true
+			changes = append(changes, p.tell("CHOKE")...)
+		}
+	}
+	k.lock.Unlock()
+
+	sendChokeChanges(changes)
+}
+
+// snapshot returns a copy of every known peer's state, ordered by peer ID
+func (k *choker) snapshot() []peerState {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	states := make([]peerState, 0, len(k.peers))
+	for _, p := range k.peers {
+		states = append(states, *p)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].id < states[j].id })
+	return states
+}
+
+// sendChokeChanges notifies peers of their new choke state, outside of any lock
+func sendChokeChanges(changes []chokeChange) {
+	for _, change := range changes {
+		err := change.session.send(change.kind, nil)
+		if err != nil {
+			logger.Warn("Error sending choke change", "peer", change.session.conn.RemoteAddr().String(), "message", change.kind, "err", err)
+		}
+	}
+}
+
+// printPeers shows the choke state and transfer rates of every known peer
+func (c *P2PPeer) printPeers() {
+	states := c.choker.snapshot()
+	if len(states) == 0 {
+		fmt.Println("No peers yet")
+		return
+	}
+
+	fmt.Printf("%-10s %-22s %-8s %-10s %10s %10s %10s %10s\n",
+		"PEER", "ADDRESS", "CHOKED", "INTERESTED", "UP KB/s", "DOWN KB/s", "UP KB", "DOWN KB")
+	for _, p := range states {
+		choked := fmt.Sprint(p.choked)
+		if p.optimistic {
+			choked += "*" // Optimistic unchoke
+		}
+		fmt.Printf("%-10s %-22s %-8s %-10t %10.1f %10.1f %10d %10d\n",
+			shortID(p.id), p.address, choked, p.interested,
+			p.uploadRate/1024, p.downloadRate/1024, p.uploaded/1024, p.downloaded/1024)
+	}
+}
+
+// handleLimitCommand applies a runtime limit change typed at the prompt.
+// Supported forms are "LIMIT <UP|DOWN|PEER-UP|PEER-DOWN> <KB/s>" and "SLOTS <max> [queue]".
+func (c *P2PPeer) handleLimitCommand(command string) {
+	fields := strings.Fields(strings.ToUpper(command))
+
+	if fields[0] == "SLOTS" {
+		if len(fields) < 2 || len(fields) > 3 {
+			fmt.Println("Usage: SLOTS <max uploads> [max queued]")
+			return
+		}
+		max, err := strconv.Atoi(fields[1])
+		if err != nil || max < 0 {
+			fmt.Println("Invalid slot count:", fields[1])
+			return
+		}
+		maxQueue := 0
+		if len(fields) == 3 {
+			maxQueue, err = strconv.Atoi(fields[2])
+			if err != nil || maxQueue < 0 {
+				fmt.Println("Invalid queue length:", fields[2])
+				return
+			}
+		}
+		c.uploads.setLimits(max, maxQueue)
+		active, queued := c.uploads.status()
+		fmt.Printf("Upload slots set to %d (queue %d), %d active, %d queued\n", max, maxQueue, active, queued)
+		return
+	}
+
+	if len(fields) != 3 {
+		fmt.Println("Usage: LIMIT <UP|DOWN|PEER-UP|PEER-DOWN> <KB/s, 0 for unlimited>")
+		return
+	}
+	kbps, err := strconv.Atoi(fields[2])
+	if err != nil || kbps < 0 {
+		fmt.Println("Invalid rate:", fields[2])
+		return
+	}
+	rate := kbps * 1024
+
+	switch fields[1] {
+	case "UP":
+		c.limiter.setUploadLimit(rate)
+	case "DOWN":
+		c.limiter.setDownloadLimit(rate)
+	case "PEER-UP":
+		c.limiter.setPeerUploadLimit(rate)
+	case "PEER-DOWN":
+		c.limiter.setPeerDownloadLimit(rate)
+	default:
+		fmt.Println("Unknown limit:", fields[1])
+		return
+	}
+	fmt.Printf("%s limit set to %d KB/s\n", fields[1], kbps)
+}
+
+// handleDownloadCommand applies a download queue command typed at the prompt.
+// Supported forms are "DOWNLOADS", "PAUSE <id>", "RESUME <id>", "CANCEL <id>" and
+// "PRIORITY <id> <priority>".
+func (q *downloadQueue) handleDownloadCommand(command string) {
+	fields := strings.Fields(strings.ToUpper(command))
+	if fields[0] == "DOWNLOADS" {
+		printDownloads(false, q.list())
+		return
+	}
+
+	want := 2
+	if fields[0] == "PRIORITY" {
+		want = 3
+	}
+	if len(fields) != want {
+		if fields[0] == "PRIORITY" {
+			fmt.Println("Usage: PRIORITY <id> <priority>")
+		} else {
+			fmt.Printf("Usage: %s <id>\n", fields[0])
+		}
+		return
+	}
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		fmt.Println("Invalid download id:", fields[1])
+		return
+	}
+
+	var item queuedDownload
+	switch fields[0] {
+	case "PAUSE":
+		item, err = q.pause(id)
+	case "RESUME":
+		item, err = q.resume(id)
+	case "CANCEL":
+		item, err = q.cancel(id)
+	case "PRIORITY":
+		priority, perr := strconv.Atoi(fields[2])
+		if perr != nil {
+			fmt.Println("Invalid priority:", fields[2])
+			return
+		}
+		item, err = q.setPriority(id, priority)
+	}
+	if err != nil {
+		fmt.Printf("Download %d: %v\n", id, err)
+		return
+	}
+	printDownload(false, item)
+}
+
+// tuiRefresh is how often the terminal UI redraws
+const tuiRefresh = 500 * time.Millisecond
+
+// tuiFilesRefresh is how often the terminal UI asks the trackers which files they know of
+const tuiFilesRefresh = 10 * time.Second
+
+// Panes of the terminal UI, in the order Tab moves through them
+const (
+	paneFiles = iota
+	paneTransfers
+	panePeers
+	paneCount
+)
+
+// tuiKeys is the key help shown at the bottom of the terminal UI
+const tuiKeys = "Tab pane  ↑↓ select  Enter download  / type a name or hash  p pause  r resume  c cancel  +/- priority  f refresh  q quit"
+
+// terminalUI is a full-screen interface to the peer, drawn with ANSI escape codes. It
+// shows the files the trackers know of, our downloads and uploads, and the peers we
+// trade with, and takes single-key commands.
+type terminalUI struct {
+	peer      *P2PPeer
+	saved     string // Terminal settings to restore, from stty -g
+	closeOnce sync.Once
+
+	lock     sync.Mutex // Guards everything below
+	rows     int
+	cols     int
+	files    []trackerFile
+	filesErr error
+	pane     int
+	selected [paneCount]int
+	typing   bool   // Reading a file name or hash after "/"
+	input    string // What was typed so far
+	status   string // Outcome of the last command
+
+	// Logs have their own lock as they are written with other locks held
+	logLock sync.Mutex
+	logs    []string
+}
+
+// newTerminalUI switches the terminal to raw mode and the alternate screen. close puts
+// it back.
+func newTerminalUI(peer *P2PPeer) (*terminalUI, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	_, err = stty("raw", "-echo")
+	if err != nil {
+		return nil, err
+	}
+	ui := &terminalUI{peer: peer, saved: strings.TrimSpace(saved)}
+	ui.resize()
+	fmt.Print("\033[?1049h\033[?25l") // Alternate screen, hidden cursor
+	return ui, nil
+}
+
+// stty runs stty on the terminal and returns what it printed
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// close restores the terminal; it may be called more than once
+func (ui *terminalUI) close() {
+	ui.closeOnce.Do(func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		stty(ui.saved)
+	})
+}
+
+// resize reads the size of the terminal
+func (ui *terminalUI) resize() {
+	rows, cols := 24, 80
+	if size, err := stty("size"); err == nil {
+		fmt.Sscan(size, &rows, &cols)
+	}
+	ui.lock.Lock()
+	ui.rows, ui.cols = rows, cols
+	ui.lock.Unlock()
+}
+
+// Write takes log lines so they show in the UI instead of scribbling over it
+func (ui *terminalUI) Write(p []byte) (int, error) {
+	ui.logLock.Lock()
+	defer ui.logLock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		ui.logs = append(ui.logs, line)
+	}
+	if len(ui.logs) > 100 {
+		ui.logs = ui.logs[len(ui.logs)-100:]
+	}
+	return len(p), nil
+}
+
+// run draws the UI and handles keys until the user quits or the peer shuts down
+func (ui *terminalUI) run() {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		buffer := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buffer)
+			if err != nil {
+				return
+			}
+			for _, key := range splitKeys(buffer[:n]) {
+				keys <- key
+			}
+		}
+	}()
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+
+	go ui.refreshFiles()
+	redraw := time.NewTicker(tuiRefresh)
+	defer redraw.Stop()
+	refresh := time.NewTicker(tuiFilesRefresh)
+	defer refresh.Stop()
+
+	for {
+		ui.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok || !ui.handleKey(key) {
+				return
+			}
+		case <-resized:
+			ui.resize()
+		case <-redraw.C:
+		case <-refresh.C:
+			go ui.refreshFiles()
+		case <-ui.peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// splitKeys splits what was read from the terminal into key presses: arrow keys and
+// other escape sequences, or single characters
+func splitKeys(input []byte) []string {
+	var keys []string
+	for len(input) > 0 {
+		n := 1
+		if input[0] == 27 && len(input) >= 3 && input[1] == '[' {
+			n = 3
+		} else if _, size := utf8.DecodeRune(input); size > 1 {
+			n = size
+		}
+		keys = append(keys, string(input[:n]))
+		input = input[n:]
+	}
+	return keys
+}
+
+// refreshFiles asks the trackers which files they know of
+func (ui *terminalUI) refreshFiles() {
+	files, err := ui.peer.trackerFiles()
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	ui.files, ui.filesErr = files, err
+}
+
+// handleKey applies a key press and returns false when the user quits
+func (ui *terminalUI) handleKey(key string) bool {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.typing {
+		switch {
+		case key[0] == '\r' || key[0] == '\n':
+			ui.typing = false
+			if requested := strings.TrimSpace(ui.input); requested != "" {
+				ui.queue(requested)
+			}
+		case key[0] == 27 || key[0] == 3: // Escape or Ctrl-C
+			ui.typing = false
+		case key[0] == 127 || key[0] == 8: // Backspace
+			if ui.input != "" {
+				runes := []rune(ui.input)
+				ui.input = string(runes[:len(runes)-1])
+			}
+		case key[0] >= ' ':
+			ui.input += key
+		}
+		return true
+	}
+
+	switch key {
+	case "q", "Q", "\x03":
+		return false
+	case "\t":
+		ui.pane = (ui.pane + 1) % paneCount
+	case "\x1b[A", "k":
+		ui.selected[ui.pane] = max(ui.selected[ui.pane]-1, 0)
+	case "\x1b[B", "j":
+		ui.selected[ui.pane]++ // Clamped when drawn
+	case "\r", "\n", "d":
+		if ui.pane == paneFiles && ui.selected[paneFiles] < len(ui.files) {
+			ui.queue(ui.files[ui.selected[paneFiles]].Name)
+		}
+	case "/":
+		ui.typing = true
+		ui.input = ""
+	case "f":
+		go ui.refreshFiles()
+		ui.status = "Asking the trackers for their files"
+	case "p":
+		ui.change("Paused", ui.peer.queue.pause)
+	case "r":
+		ui.change("Resumed", ui.peer.queue.resume)
+	case "c":
+		ui.change("Cancelled", ui.peer.queue.cancel)
+	case "+", "-":
+		step := 1
+		if key[0] == '-' {
+			step = -1
+		}
+		ui.change("Changed the priority of", func(id int) (queuedDownload, error) {
+			item, err := ui.peer.queue.get(id)
+			if err != nil {
+				return item, err
+			}
+			return ui.peer.queue.setPriority(id, item.Priority+step)
+		})
+	}
+	return true
+}
+
+// queue adds a download. Caller must hold the lock.
+func (ui *terminalUI) queue(requested string) {
+	item := ui.peer.queue.add(requested, "", 0)
+	ui.status = fmt.Sprintf("Queued download %d of %s", item.ID, requested)
+}
+
+// change applies a queue command to the selected download. Caller must hold the lock.
+func (ui *terminalUI) change(done string, apply func(id int) (queuedDownload, error)) {
+	items := ui.peer.queue.list()
+	if ui.selected[paneTransfers] >= len(items) {
+		ui.status = "Select a download in the transfers pane first"
+		return
+	}
+	item, err := apply(items[ui.selected[paneTransfers]].ID)
+	if err != nil {
+		ui.status = fmt.Sprintf("Download %d: %v", item.ID, err)
+		return
+	}
+	ui.status = fmt.Sprintf("%s download %d of %s", done, item.ID, item.Request)
+}
+
+// draw redraws the whole screen
+func (ui *terminalUI) draw() {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	downloads := ui.peer.queue.list()
+	states := ui.peer.choker.snapshot()
+	var downRate, upRate float64
+	for _, e := range ui.peer.progress.current() {
+		downRate += e.Rate
+	}
+	var uploads []peerState
+	for _, p := range states {
+		upRate += p.uploadRate
+		if p.uploadRate > 0 {
+			uploads = append(uploads, p)
+		}
+	}
+
+	// Files the trackers know of, marking the ones we share
+	var files []string
+	for _, f := range ui.files {
+		mark := ""
+		if ui.peer.lookupFile(f.Name) != nil {
+			mark = "shared"
+		}
+		files = append(files, fmt.Sprintf("%-40s %5d  %-6s  %s", f.Name, f.Peers, mark, ui.peer.publisherLabels(f.Name, f.Publishers)))
+	}
+	if ui.filesErr != nil && len(files) == 0 {
+		files = append(files, "No tracker answered: "+ui.filesErr.Error())
+	}
+
+	// Downloads with their progress, then the peers we upload to
+	var transfers []string
+	for _, item := range downloads {
+		line := fmt.Sprintf("%-4d %-9s %3d  ", item.ID, item.State, item.Priority)
+		if item.Progress != nil {
+			line += formatProgress(*item.Progress)
+		} else {
+			name := item.Name
+			if name == "" {
+				name = item.Request
+			}
+			line += name
+			if item.Chunks > 0 {
+				line += fmt.Sprintf(" %d%%", item.ChunksDone*100/item.Chunks)
+			}
+			if item.Error != "" {
+				line += " (" + item.Error + ")"
+			}
+		}
+		transfers = append(transfers, line)
+	}
+	for _, p := range uploads {
+		transfers = append(transfers, fmt.Sprintf("up   %-22s %s/s", p.address, formatSize(int64(p.uploadRate))))
+	}
+
+	var peers []string
+	for _, p := range states {
+		choked := fmt.Sprint(p.choked)
+		if p.optimistic {
+			choked += "*"
+		}
+		peers = append(peers, fmt.Sprintf("%-10s %-22s %-7s %10s/s %10s/s", shortID(p.id), p.address, choked,
+			formatSize(int64(p.uploadRate)), formatSize(int64(p.downloadRate))))
+	}
+
+	// Split what's left after the header and footer between the panes
+	var screen bytes.Buffer
+	screen.WriteString("\033[H")
+	row := 1
+	line := func(text string, style string) {
+		if row > ui.rows {
+			return
+		}
+		fmt.Fprintf(&screen, "\033[%d;1H\033[2K%s%s\033[0m", row, style, fitWidth(text, ui.cols))
+		row++
+	}
+	header := fmt.Sprintf(" Peer %s on port %s  %d shared  down %s/s  up %s/s", shortID(ui.peer.id), ui.peer.port,
+		len(ui.peer.sharedFiles()), formatSize(int64(downRate)), formatSize(int64(upRate)))
+	line(header, "\033[7m")
+
+	space := max(ui.rows-4, paneCount*2)
+	heights := [paneCount]int{space / 3, space / 3, space - 2*(space/3)}
+	panes := [paneCount]struct {
+		title string
+		rows  []string
+	}{
+		{fmt.Sprintf("Files on the trackers (%d)   %-34s %5s", len(files), "", "PEERS"), files},
+		{fmt.Sprintf("Transfers: %d downloads, %d uploads   ID   STATE   PRI", len(downloads), len(uploads)), transfers},
+		{fmt.Sprintf("Peers (%d)   %-10s %-22s %-7s %12s %12s", len(peers), "ID", "ADDRESS", "CHOKED", "UP", "DOWN"), peers},
+	}
+	for i, pane := range panes {
+		selectable := len(pane.rows)
+		if i == paneTransfers {
+			selectable = len(downloads)
+		}
+		ui.selected[i] = max(min(ui.selected[i], selectable-1), 0)
+
+		style := "\033[1m"
+		if i == ui.pane {
+			style = "\033[1;4m"
+		}
+		line(pane.title, style)
+
+		// Scroll so the selection stays in view
+		visible := heights[i] - 1
+		first := max(ui.selected[i]-visible+1, 0)
+		for j := first; j < first+visible; j++ {
+			switch {
+			case j >= len(pane.rows):
+				line("", "")
+			case j == ui.selected[i] && j < selectable && i == ui.pane:
+				line("> "+pane.rows[j], "\033[7m")
+			case j == ui.selected[i] && j < selectable:
+				line("> "+pane.rows[j], "")
+			default:
+				line("  "+pane.rows[j], "")
+			}
+		}
+	}
+
+	row = ui.rows - 2
+	lastLog := ""
+	ui.logLock.Lock()
+	if len(ui.logs) > 0 {
+		lastLog = ui.logs[len(ui.logs)-1]
+	}
+	ui.logLock.Unlock()
+	line(lastLog, "\033[2m")
+	if ui.typing {
+		line("File name or hash to download: "+ui.input+"_", "\033[1m")
+	} else {
+		line(ui.status, "")
+	}
+	line(tuiKeys, "\033[7m")
+	os.Stdout.Write(screen.Bytes())
+}
+
+// fitWidth cuts text to a width of the terminal, counting runes. Control characters
+// become "?", as file names, errors and log lines come from other peers and trackers,
+// and an escape sequence among them would take over the terminal.
+func fitWidth(text string, width int) string {
+	runes := []rune(text)
+	for i, r := range runes {
+		if unicode.IsControl(r) {
+			runes[i] = '?'
+		}
+	}
+	if len(runes) > width {
+		runes = runes[:width]
+	}
+	return string(runes)
+}
+
+// Download states reported by the control API
+const (
+	downloadQueued    = "queued"
+	downloadRunning   = "running"
+	downloadPaused    = "paused"
+	downloadDone      = "done"
+	downloadFailed    = "failed"
+	downloadNotFound  = "not_found" // No peer had the file
+	downloadCancelled = "cancelled" // Stopped for good; what arrived was deleted
+)
+
+// errNoSuchDownload is returned for a download ID the queue doesn't know
+var errNoSuchDownload = errors.New("no such download")
+
+// queuedDownload is a download in the queue
+type queuedDownload struct {
+	ID         int                `json:"id"`
+	Request    string             `json:"request"`        // File name or content hash asked for
+	Name       string             `json:"name,omitempty"` // File name, once found
+	Path       string             `json:"path"`           // Where the file is written; a directory means under its own name
+	Priority   int                `json:"priority"`       // Higher runs first
+	State      string             `json:"state"`
+	ChunksDone int                `json:"chunks_done"`
+	Chunks     int                `json:"chunks"`
+	Size       int64              `json:"size,omitempty"`
+	Hash       string             `json:"hash,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Progress   *progressEvent     `json:"progress,omitempty"` // Bytes, rate and ETA while running
+	cancel     context.CancelFunc // Stops the download; set until its fetch returns, even once paused
+}
+
+// downloadQueue runs queued downloads, up to limit at once, highest priority first and in
+// the order they were queued otherwise. The queue is saved to a file on every change so
+// it survives restarts.
+type downloadQueue struct {
+	peer    *P2PPeer
+	lock    sync.Mutex
+	items   []*queuedDownload
+	nextID  int
+	limit   int           // Most downloads running at once (0 = unlimited)
+	running int           // Downloads running now
+	path    string        // File the queue is saved to, empty to keep it in memory only
+	wake    chan struct{} // Signals that a download may be ready to run
+}
+
+// newDownloadQueue creates a queue, loading the one saved at path if there is one; run
+// starts it. Downloads that were running when the queue was saved are queued again and
+// resume from what had arrived.
+func newDownloadQueue(peer *P2PPeer, limit int, path string) (*downloadQueue, error) {
+	q := &downloadQueue{peer: peer, nextID: 1, limit: limit, path: path, wake: make(chan struct{}, 1)}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &q.items)
+	if err != nil {
+		return nil, fmt.Errorf("reading download queue %s: %w", path, err)
+	}
+	for _, item := range q.items {
+		if item.State == downloadRunning {
+			item.State = downloadQueued
+		}
+		q.nextID = max(q.nextID, item.ID+1)
+	}
+	return q, nil
+}
+
+// save writes the queue to its file. Caller must hold the lock.
+func (q *downloadQueue) save() {
+	if q.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(q.items, "", "  ")
+	if err == nil {
+		// Write a new file and swap it in so a crash never leaves half a queue
+		err = os.WriteFile(q.path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(q.path+".tmp", q.path)
+	}
+	if err != nil {
+		logger.Error("Error saving download queue", "path", q.path, "err", err)
+	}
+}
+
+// notify wakes the run loop
+func (q *downloadQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add queues a download and returns it
+func (q *downloadQueue) add(request string, path string, priority int) queuedDownload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := &queuedDownload{ID: q.nextID, Request: request, Path: path, Priority: priority, State: downloadQueued}
+	q.nextID++
+	q.items = append(q.items, item)
+	q.save()
+	q.notify()
+	return *item
+}
+
+// snapshot returns a copy of a download with its current progress. Caller must hold the lock.
+func (q *downloadQueue) snapshot(item *queuedDownload) queuedDownload {
+	if item.State != downloadRunning {
+		return *item
+	}
+	if done, total, ok := q.peer.downloadProgress(item.Path); ok {
+		item.ChunksDone, item.Chunks = done, total
+	}
+	snapshot := *item
+	if e, ok := q.peer.progress.get(item.Path); ok {
+		snapshot.Progress = &e
+	}
+	return snapshot
+}
+
+// list returns every download, in the order they were queued
+func (q *downloadQueue) list() []queuedDownload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := make([]queuedDownload, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, q.snapshot(item))
+	}
+	return items
+}
+
+// find returns the download with the given ID. Caller must hold the lock.
+func (q *downloadQueue) find(id int) *queuedDownload {
+	for _, item := range q.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// get returns one download
+func (q *downloadQueue) get(id int) (queuedDownload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := q.find(id)
+	if item == nil {
+		return queuedDownload{}, errNoSuchDownload
+	}
+	return q.snapshot(item), nil
+}
+
+// pause stops a download from running until it is resumed; what arrived is kept
+func (q *downloadQueue) pause(id int) (queuedDownload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := q.find(id)
+	if item == nil {
+		return queuedDownload{}, errNoSuchDownload
+	}
+	switch item.State {
+	case downloadRunning:
+		q.snapshot(item)
+		item.cancel()
+	case downloadQueued:
+		// Possibly resumed while it was still stopping; fetch leaves it paused
+	default:
+		return *item, fmt.Errorf("download is %s", item.State)
+	}
+	item.State = downloadPaused
+	q.save()
+	return *item, nil
+}
+
+// resume queues a paused or failed download again. A download paused while running
+// only starts again once it has stopped.
+func (q *downloadQueue) resume(id int) (queuedDownload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := q.find(id)
+	if item == nil {
+		return queuedDownload{}, errNoSuchDownload
+	}
+	switch item.State {
+	case downloadPaused, downloadFailed, downloadNotFound:
+		item.State = downloadQueued
+		item.Error = ""
+		q.save()
+		q.notify()
+	default:
+		return *item, fmt.Errorf("download is %s", item.State)
+	}
+	return *item, nil
+}
+
+// cancel stops a download for good and deletes what arrived of it
+func (q *downloadQueue) cancel(id int) (queuedDownload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := q.find(id)
+	if item == nil {
+		return queuedDownload{}, errNoSuchDownload
+	}
+	switch {
+	case item.State == downloadDone || item.State == downloadCancelled:
+		return *item, fmt.Errorf("download is %s", item.State)
+	case item.cancel != nil:
+		// Running or still stopping; fetch deletes the partial file once it has stopped
+		item.cancel()
+	default:
+		q.discard(item)
+	}
+	item.State = downloadCancelled
+	item.ChunksDone = 0
+	q.save()
+	return *item, nil
+}
+
+// discard deletes the partial file of a download that won't be finished, along with its
+// saved state, and stops sharing it. Caller must hold the lock.
+func (q *downloadQueue) discard(item *queuedDownload) {
+	// Without saved state the file at the path isn't one of our partial downloads
+	statePath := downloadStatePath(item.Path)
+	if _, err := os.Stat(statePath); err != nil {
+		return
+	}
+	if file := q.peer.lookupFile(item.Name); file != nil && file.path == item.Path {
+		q.peer.removeFile(item.Name)
+	}
+	os.Remove(item.Path)
+	os.Remove(statePath)
+}
+
+// setPriority changes the priority of a download, which matters while it waits to run
+func (q *downloadQueue) setPriority(id int, priority int) (queuedDownload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := q.find(id)
+	if item == nil {
+		return queuedDownload{}, errNoSuchDownload
+	}
+	item.Priority = priority
+	q.save()
+	return q.snapshot(item), nil
+}
+
+// next returns the queued download to run next, or nil. Downloads still stopping and
+// downloads to a path another one is writing to wait. Caller must hold the lock.
+func (q *downloadQueue) next() *queuedDownload {
+	busy := make(map[string]bool)
+	for _, item := range q.items {
+		if item.cancel != nil {
+			busy[item.Path] = true
+		}
+	}
+	var best *queuedDownload
+	for _, item := range q.items {
+		if item.State != downloadQueued || item.cancel != nil || (item.Path != "" && busy[item.Path]) {
+			continue
+		}
+		if best == nil || item.Priority > best.Priority {
+			best = item
+		}
+	}
+	return best
+}
+
+// run starts queued downloads as they come and as running ones finish, until the peer
+// shuts down
+func (q *downloadQueue) run() {
+	for {
+		q.lock.Lock()
+		for q.peer.ctx.Err() == nil && (q.limit <= 0 || q.running < q.limit) {
+			item := q.next()
+			if item == nil {
+				break
+			}
+			ctx, cancel := context.WithCancel(q.peer.ctx)
+			item.cancel = cancel
+			item.State = downloadRunning
+			q.running++
+
+			// Shutdown waits for the download and for its outcome to be saved
+			q.peer.downloads.Add(1)
+			go q.fetch(ctx, cancel, item)
+		}
+		q.save()
+		q.lock.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-q.peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch finds the peers that have a queued file and downloads it. The item can't run
+// again until fetch returns, as its cancel stays set.
+func (q *downloadQueue) fetch(ctx context.Context, cancel context.CancelFunc, item *queuedDownload) {
+	defer q.peer.downloads.Done()
+	name, expectedHash, peerList := q.peer.locate(item.Request)
+
+	// Names come from other peers, so only their last element is used
+	path := item.Path
+	if path == "" {
+		path = filepath.Base(name)
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, filepath.Base(name))
+	}
+	q.lock.Lock()
+	item.Name = name
+	item.Path = path
+	q.lock.Unlock()
+
+	var hash string
+	var err error
+	if len(peerList) > 0 {
+		// Announce ourselves first so other peers can fetch chunks from us while we download
+		q.peer.announce(name)
+		hash, err = q.peer.downloadFile(ctx, name, path, peerList, expectedHash)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	cancel()
+	item.cancel = nil
+	q.running--
+	defer q.notify()
+	defer q.save()
+	switch {
+	case item.State == downloadPaused:
+		// Paused while running; it stays paused
+	case item.State == downloadQueued:
+		// Paused and resumed while running; it runs again
+	case item.State == downloadCancelled:
+		q.discard(item)
+	case q.peer.ctx.Err() != nil:
+		// Interrupted by shutdown; it runs again when the queue is loaded
+		item.State = downloadQueued
+	case len(peerList) == 0:
+		logger.Warn("No peer has the requested file", "file", item.Request)
+		item.State = downloadNotFound
+		item.Error = "no peer has " + item.Request
+	case err != nil:
+		item.State = downloadFailed
+		item.Error = err.Error()
+	default:
+		item.State = downloadDone
+		item.Hash = hash
+		if info, err := os.Stat(path); err == nil {
+			item.Size = info.Size()
+			item.Chunks = chunkCount(item.Size)
+			item.ChunksDone = item.Chunks
+		}
+	}
+}
+
+// daemonStatus is what the control API reports about a running peer
+type daemonStatus struct {
+	PeerID      string          `json:"peer_id"`
+	Port        string          `json:"port"`
+	Shares      int             `json:"shares"`
+	Downloads   map[string]int  `json:"downloads"` // Number of downloads in each state
+	Uploads     int             `json:"uploads"`
+	Connections int             `json:"connections"`
+	Trackers    []trackerStatus `json:"trackers"`
+	DHTNodes    *int            `json:"dht_nodes,omitempty"`
+}
+
+// controlServer serves the control API of a daemon: JSON over HTTP, on a Unix socket or
+// a loopback address so only local users can reach it
+type controlServer struct {
+	peer  *P2PPeer
+	queue *downloadQueue
+	token string // Token clients must send over TCP, empty on a Unix socket
+}
+
+// controlTokenPath returns where the token of the control API at address is kept: the
+// given file, or else a file in the user's config directory named after the address
+func controlTokenPath(address string, tokenFile string) (string, error) {
+	if tokenFile != "" {
+		return tokenFile, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no config directory for the control token, give -control-token-file: %w", err)
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(address)
+	return filepath.Join(dir, "p2p-peer", "control-"+name+".token"), nil
+}
+
+// writeControlToken makes a new control token and writes it where only the user can read it
+func writeControlToken(path string) (string, error) {
+	token := make([]byte, 32)
+	_, err := crand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(path) // So a file someone else made can't keep its permissions
+	err = os.WriteFile(path, []byte(hex.EncodeToString(token)+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// guard turns away requests that may not come from the user's own programs. Over TCP any
+// local user, and any web page the user opens, can reach the API, so requests must carry
+// the token from the token file and name a loopback host, which DNS rebinding can't fake.
+// Requests other than GET must send JSON, which browsers won't send to another site
+// without asking it first.
+func (s *controlServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				replyError(w, http.StatusForbidden, errors.New("requests must name a loopback host"))
+				return
+			}
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				replyError(w, http.StatusUnauthorized, errors.New("missing or wrong control token; is the daemon run by another user?"))
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				replyError(w, http.StatusUnsupportedMediaType, errors.New("requests must be sent as application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenControl listens on "unix:<path>" or on a loopback host:port
+func listenControl(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		os.Remove(path) // Left behind by a daemon that didn't stop cleanly
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return listener, os.Chmod(path, 0600)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control API must listen on a loopback address or a Unix socket, not %s", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serve answers control requests until the peer shuts down
+func (s *controlServer) serve(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.status)
+	mux.HandleFunc("GET /shares", s.listShares)
+	mux.HandleFunc("POST /shares", s.addShare)
+	mux.HandleFunc("DELETE /shares/{name}", s.removeShare)
+	mux.HandleFunc("GET /downloads", s.listDownloads)
+	mux.HandleFunc("POST /downloads", s.addDownload)
+	mux.HandleFunc("GET /downloads/{id}", s.getDownload)
+	mux.HandleFunc("POST /downloads/{id}/pause", s.pauseDownload)
+	mux.HandleFunc("POST /downloads/{id}/resume", s.resumeDownload)
+	mux.HandleFunc("POST /downloads/{id}/cancel", s.cancelDownload)
+	mux.HandleFunc("POST /downloads/{id}/priority", s.setPriority)
+	mux.HandleFunc("GET /progress", s.listProgress)
+	mux.HandleFunc("GET /progress/stream", s.streamProgress)
+
+	server := &http.Server{Handler: s.guard(mux), ReadHeaderTimeout: dialTimeout}
+	go func() {
+		<-s.peer.ctx.Done()
+		server.Close()
+	}()
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Error serving control API", "err", err)
+	}
+}
+
+// reply writes a JSON answer
+func reply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// replyError writes an error as {"error": "..."}, with 404 for unknown downloads and
+// shares and 409 for requests the download's state doesn't allow
+func replyError(w http.ResponseWriter, code int, err error) {
+	if errors.Is(err, errNoSuchDownload) {
+		code = http.StatusNotFound
+	}
+	reply(w, code, map[string]string{"error": err.Error()})
+}
+
+// status reports on the peer
+func (s *controlServer) status(w http.ResponseWriter, r *http.Request) {
+	uploads, _ := s.peer.uploads.status()
+	connections, _, _, _ := s.peer.connLimits.stats()
+	status := daemonStatus{
+		PeerID:      s.peer.id,
+		Port:        s.peer.port,
+		Shares:      len(s.peer.sharedFiles()),
+		Downloads:   make(map[string]int),
+		Uploads:     uploads,
+		Connections: connections,
+		Trackers:    s.peer.trackers.health(),
+	}
+	for _, item := range s.queue.list() {
+		status.Downloads[item.State]++
+	}
+	if s.peer.dht != nil {
+		nodes := s.peer.dht.size()
+		status.DHTNodes = &nodes
+	}
+	reply(w, http.StatusOK, status)
+}
+
+// listShares lists the files we share, including unfinished downloads
+func (s *controlServer) listShares(w http.ResponseWriter, r *http.Request) {
+	shares := []fileInfo{}
+	for _, file := range s.peer.sharedFiles() {
+		shares = append(shares, fileInfo{Name: file.name, Path: file.path, Size: file.size, Hash: file.getHash()})
+	}
+	reply(w, http.StatusOK, shares)
+}
+
+// addShare shares a file, or every file in a directory: {"path": "..."}
+func (s *controlServer) addShare(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Path string `json:"path"`
+	}
+	if json.NewDecoder(r.Body).Decode(&request) != nil || request.Path == "" {
+		replyError(w, http.StatusBadRequest, errors.New(`expected {"path": "..."}`))
+		return
+	}
+	files, err := shareablePaths([]string{request.Path})
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	shared := []fileInfo{}
+	for _, path := range files {
+		file, err := s.peer.shareFile(path)
+		if err != nil {
+			replyError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.peer.announce(file.name)
+		if s.peer.dht != nil {
+			go s.peer.dht.announce(file)
+		}
+		shared = append(shared, fileInfo{Name: file.name, Path: path, Size: file.size, Hash: file.getHash()})
+	}
+	reply(w, http.StatusOK, shared)
+}
+
+// removeShare stops sharing a file
+func (s *controlServer) removeShare(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if s.peer.lookupFile(name) == nil {
+		replyError(w, http.StatusNotFound, fmt.Errorf("%s is not shared", name))
+		return
+	}
+	s.peer.unshare(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDownloads lists every download requested, with progress
+func (s *controlServer) listDownloads(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, s.queue.list())
+}
+
+// addDownload queues a download: {"file": "<name|hash>", "path": "...", "priority": 0}
+func (s *controlServer) addDownload(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		File     string `json:"file"`
+		Path     string `json:"path"`
+		Priority int    `json:"priority"`
+	}
+	if json.NewDecoder(r.Body).Decode(&request) != nil || request.File == "" {
+		replyError(w, http.StatusBadRequest, errors.New(`expected {"file": "<name|hash>"}`))
+		return
+	}
+	reply(w, http.StatusCreated, s.queue.add(request.File, request.Path, request.Priority))
+}
+
+// downloadID parses the {id} in a request path
+func downloadID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, errNoSuchDownload
+	}
+	return id, nil
+}
+
+// getDownload reports on one download
+func (s *controlServer) getDownload(w http.ResponseWriter, r *http.Request) {
+	s.changeDownload(w, r, s.queue.get)
+}
+
+// pauseDownload pauses a download
+func (s *controlServer) pauseDownload(w http.ResponseWriter, r *http.Request) {
+	s.changeDownload(w, r, s.queue.pause)
+}
+
+// resumeDownload resumes a paused or failed download
+func (s *controlServer) resumeDownload(w http.ResponseWriter, r *http.Request) {
+	s.changeDownload(w, r, s.queue.resume)
+}
+
+// cancelDownload cancels a download and deletes what arrived of it
+func (s *controlServer) cancelDownload(w http.ResponseWriter, r *http.Request) {
+	s.changeDownload(w, r, s.queue.cancel)
+}
+
+// listProgress reports the latest progress of every running download
+func (s *controlServer) listProgress(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, s.peer.progress.current())
+}
+
+// streamProgress sends progress events as they happen, one JSON object per line, until
+// the client hangs up or the peer shuts down
+func (s *controlServer) streamProgress(w http.ResponseWriter, r *http.Request) {
+	events, stop := s.peer.progress.watch(64)
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case e := <-events:
+			if encoder.Encode(e) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// setPriority changes a download's priority: {"priority": n}
+func (s *controlServer) setPriority(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Priority *int `json:"priority"`
+	}
+	if json.NewDecoder(r.Body).Decode(&request) != nil || request.Priority == nil {
+		replyError(w, http.StatusBadRequest, errors.New(`expected {"priority": n}`))
+		return
+	}
+	s.changeDownload(w, r, func(id int) (queuedDownload, error) {
+		return s.queue.setPriority(id, *request.Priority)
+	})
+}
+
+// changeDownload applies an operation to the download named in the request path
+// and replies with the download
+func (s *controlServer) changeDownload(w http.ResponseWriter, r *http.Request, operation func(id int) (queuedDownload, error)) {
+	id, err := downloadID(r)
+	if err == nil {
+		var item queuedDownload
+		item, err = operation(id)
+		if err == nil {
+			reply(w, http.StatusOK, item)
+			return
+		}
+	}
+	replyError(w, http.StatusConflict, err)
+}
+
+// errNoDaemon is returned by the control client when no daemon answers
+var errNoDaemon = errors.New("no peer daemon is running")
+
+// controlClient talks to a daemon's control API
+type controlClient struct {
+	address   string
+	http      *http.Client
+	base      string
+	tokenPath string // File the daemon's token is read from over TCP, empty on a Unix socket
+}
+
+// newControlClient returns a client for the control API at "unix:<path>" or host:port.
+// Over TCP it authenticates with the token in tokenFile, or the daemon's default token file.
+func newControlClient(address string, tokenFile string) *controlClient {
+	transport := &http.Transport{}
+	base := "http://" + address
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		base = "http://daemon"
+	}
+	client := &controlClient{address: address, http: &http.Client{Transport: transport, Timeout: time.Minute}, base: base}
+	if !strings.HasPrefix(address, "unix:") {
+		client.tokenPath, _ = controlTokenPath(address, tokenFile)
+	}
+	return client
+}
+
+// call sends a request with an optional JSON body and decodes the JSON answer into result
+func (c *controlClient) call(method string, path string, body any, result any) error {
+	var content io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, c.base+path, content)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.tokenPath != "" {
+		// A missing file leaves the token out, and a running daemon then says so
+		token, err := os.ReadFile(c.tokenPath)
+		if err == nil {
+			request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w at %s", errNoDaemon, c.address)
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		if failure.Error == "" {
+			failure.Error = response.Status
+		}
+		return errors.New(failure.Error)
+	}
+	if result == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// peerOptions holds the settings given on the command line, shared by the interactive
+// prompt and every subcommand
+type peerOptions struct {
+	uploadLimit       int
+	downloadLimit     int
+	peerUploadLimit   int
+	peerDownloadLimit int
+	uploadSlots       int
+	uploadQueue       int
+	unchokeSlots      int
+	useDHT            bool
+	bootstrap         string
+	trackers          string
+	announceAll       bool
+	lan               bool
+	unreachable       bool
+	relay             bool
+	relays            string
+	transport         string
+	maxConns          int
+	maxConnsPerIP     int
+	metricsAddress    string
+	shutdownLimit     time.Duration
+	logLevel          string
+	logFormat         string
+	logFile           string
+	control           string
+	controlToken      string
+	maxDownloads      int
+	queueFile         string
+	accessFile        string
+	corruptBan        time.Duration
+	swarm             string
+	swarmKeyFile      string
+	swarmToken        string
+	trustedKeys       string
+}
+
+// register defines the options as flags of a flag set
+func (o *peerOptions) register(fs *flag.FlagSet) {
+	// Optional bandwidth limits, all of which can also be changed at the prompt
+	fs.IntVar(&o.uploadLimit, "upload-limit", 0, "Global upload limit in KB/s (0 = unlimited)")
+	fs.IntVar(&o.downloadLimit, "download-limit", 0, "Global download limit in KB/s (0 = unlimited)")
+	fs.IntVar(&o.peerUploadLimit, "peer-upload-limit", 0, "Upload limit per peer in KB/s (0 = unlimited)")
+	fs.IntVar(&o.peerDownloadLimit, "peer-download-limit", 0, "Download limit per peer in KB/s (0 = unlimited)")
+	fs.IntVar(&o.uploadSlots, "upload-slots", 4, "Maximum concurrent uploads (0 = unlimited)")
+	fs.IntVar(&o.uploadQueue, "upload-queue", 16, "Maximum uploads waiting for a slot (0 = unlimited)")
+	fs.IntVar(&o.unchokeSlots, "unchoke-slots", 4, "Peers unchoked for reciprocating uploads, plus one optimistic slot")
+	fs.BoolVar(&o.useDHT, "dht", false, "Join the Kademlia DHT so files can be found without a tracker")
+	fs.StringVar(&o.bootstrap, "bootstrap", "", "Comma separated host:port list of DHT nodes to join through")
+	fs.StringVar(&o.trackers, "trackers", "", "Trackers as host:port, comma separated within a tier and semicolon separated between tiers")
+	fs.BoolVar(&o.announceAll, "announce-all", false, "Register with every tracker instead of the first working one in each tier")
+	fs.BoolVar(&o.lan, "lan", true, "Discover trackers and peers on the local network over UDP multicast, and announce this peer there")
+	fs.BoolVar(&o.unreachable, "unreachable", false, "Don't accept connections, as behind NAT; other peers reach this one through the trackers or relays")
+	fs.BoolVar(&o.relay, "relay", false, "Relay connections for peers that can't reach each other")
+	fs.StringVar(&o.relays, "relays", "", "Comma separated host:port list of relays to use for peers behind NAT")
+	fs.StringVar(&o.transport, "transport", "tcp", "Transport for connections to other peers: tcp, or utp to yield to other traffic")
+	fs.IntVar(&o.maxConns, "max-conns", 256, "Most connections the peer server handles at once (0 = unlimited)")
+	fs.IntVar(&o.maxConnsPerIP, "max-conns-per-ip", 16, "Most connections the peer server handles at once from one IP (0 = unlimited)")
+	fs.StringVar(&o.metricsAddress, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9101 (empty = off)")
+	fs.DurationVar(&o.shutdownLimit, "shutdown-timeout", shutdownTimeout, "How long a graceful shutdown may take before the peer exits anyway")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Least severe log messages written: debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "log-format", "text", "Log output format: text or json")
+	fs.StringVar(&o.logFile, "log-file", "", "File to append logs to (empty = stderr)")
+	fs.IntVar(&o.maxDownloads, "max-downloads", 3, "Most downloads running at once; more wait in the queue (0 = unlimited)")
+	fs.StringVar(&o.queueFile, "queue-file", "downloads.json", "File the download queue is saved to so it survives restarts (empty = don't save)")
+	fs.StringVar(&o.accessFile, "access-file", "", "File of allow and deny rules for IPs, CIDRs and peer IDs, reloaded when it changes or on SIGHUP")
+	fs.DurationVar(&o.corruptBan, "corrupt-ban", corruptBanTime, "How long to ban a peer that sends a corrupt chunk (0 = don't ban)")
+	fs.StringVar(&o.swarm, "swarm", "", "Private swarm to share and look up files in (empty = the public one)")
+	fs.StringVar(&o.swarmKeyFile, "swarm-key-file", "", "File holding the private swarm's key")
+	fs.StringVar(&o.swarmToken, "swarm-token", "", "Token for the private swarm, for peers not given its key; with the key, shown to peers that hold only this token")
+	fs.StringVar(&o.trustedKeys, "trusted-keys", "", "File of publisher keys, one \"<hex key> <name>\" per line; only files they signed are downloaded (empty = any file)")
+}
+
+// registerControl defines the flag giving the address of the daemon's control API
+func (o *peerOptions) registerControl(fs *flag.FlagSet) {
+	fs.StringVar(&o.control, "control", defaultControlAddress, "Control API of the peer daemon: a loopback host:port, or unix:<path> for a Unix socket (empty = none)")
+	fs.StringVar(&o.controlToken, "control-token-file", "", "File holding the token the control API requires over TCP (default: one in the user's config directory)")
+}
+
+// swarmCredentials returns the private swarm given by the options, or nil for the public one
+func (o *peerOptions) swarmCredentials() (*swarmCredentials, error) {
+	if o.swarm == "" {
+		if o.swarmKeyFile != "" || o.swarmToken != "" {
+			return nil, errors.New("-swarm-key-file and -swarm-token need -swarm")
+		}
+		return nil, nil
+	}
+	if strings.ContainsAny(o.swarm, ":/") {
+		return nil, fmt.Errorf("swarm ID %q has a : or /", o.swarm)
+	}
+	// The DHT has no notion of swarms and would give our files away to anyone
+	if o.useDHT {
+		return nil, errors.New("-dht can't be used in a private swarm")
+	}
+
+	s := &swarmCredentials{id: o.swarm, token: o.swarmToken}
+	switch {
+	case o.swarmKeyFile != "":
+		key, err := os.ReadFile(o.swarmKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.key = strings.TrimSpace(string(key))
+	case o.swarmToken == "":
+		return nil, errors.New("-swarm needs -swarm-key-file or -swarm-token")
+	}
+	return s, nil
+}
+
+// newPeer sets up logging and creates a peer configured by the options
+func (o *peerOptions) newPeer() (*P2PPeer, error) {
+	l, err := newLogger(o.logLevel, o.logFormat, o.logFile)
+	if err != nil {
+		return nil, err
+	}
+	SetLogger(l)
+	if o.transport != "tcp" && o.transport != "utp" {
+		return nil, fmt.Errorf("unknown transport %q", o.transport)
+	}
+
+	access, err := newAccessList(o.accessFile)
+	if err != nil {
+		return nil, err
+	}
+	swarm, err := o.swarmCredentials()
+	if err != nil {
+		return nil, err
+	}
+	var trusted map[string]string
+	if o.trustedKeys != "" {
+		trusted, err = readTrustedKeys(o.trustedKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	peer := NewP2PPeer()
+	peer.access = access
+	go access.watch(peer.ctx)
+	peer.corruptBan = o.corruptBan
+	peer.swarm = swarm
+	peer.trusted = trusted
+	peer.limiter.setUploadLimit(o.uploadLimit * 1024)
+	peer.limiter.setDownloadLimit(o.downloadLimit * 1024)
+	peer.limiter.setPeerUploadLimit(o.peerUploadLimit * 1024)
+	peer.limiter.setPeerDownloadLimit(o.peerDownloadLimit * 1024)
+	peer.uploads.setLimits(o.uploadSlots, o.uploadQueue)
+	peer.choker.setSlots(o.unchokeSlots)
+	if o.useDHT {
+		peer.dht = newDHTNode(peer)
+	}
+	if o.lan {
+		peer.lan = newLANDiscovery()
+		go peer.listenLAN()
+	}
+	peer.reachable = !o.unreachable
+	peer.relay = o.relay
+	if o.relays != "" {
+		peer.relays = strings.Split(o.relays, ",")
+	}
+	peer.transport = o.transport
+	peer.connLimits = newConnLimiter(o.maxConns, o.maxConnsPerIP)
+	if o.metricsAddress != "" {
+		go serveMetrics(peer.ctx, o.metricsAddress, peer.metrics)
+	}
+	return peer, nil
+}
+
+// useTrackers configures the trackers given with -trackers, or else the trackers announcing
+// themselves on the local network. Without either the peer relies on the DHT.
+func (o *peerOptions) useTrackers(peer *P2PPeer) error {
+	if o.trackers != "" {
+		list, err := parseTrackerList(o.trackers)
+		if err != nil {
+			return err
+		}
+		peer.trackers = list
+	} else if peer.lan != nil {
+		peer.useLANTrackers()
+	}
+	peer.trackers.announceAll = o.announceAll
+	if peer.trackers.tierCount() == 0 && peer.dht == nil {
+		return errors.New("no tracker to use: pass -trackers, or use -lan or -dht")
+	}
+	return nil
+}
+
+// joinDHT bootstraps the DHT if it is enabled
+func (o *peerOptions) joinDHT(peer *P2PPeer) {
+	if peer.dht == nil {
+		return
+	}
+	var nodes []string
+	if o.bootstrap != "" {
+		nodes = strings.Split(o.bootstrap, ",")
+	}
+	peer.dht.bootstrap(nodes)
+}
+
+// startPeer creates a peer and connects it to the network without prompting: its server
+// listens on port, or on a free port when port is "0"
+func (o *peerOptions) startPeer(port string) (*P2PPeer, error) {
+	peer, err := o.newPeer()
+	if err != nil {
+		return nil, err
+	}
+
+	if peer.reachable {
+		port, err = peer.startPeerServer(port)
+		if err != nil {
+			return nil, err
+		}
+		if peer.lan != nil && peer.swarm == nil {
+			go peer.advertiseLAN()
+		}
+	} else {
+		// The port is how trackers tell us apart from other peers at the same address
+		if port == "0" {
+			return nil, errors.New("-unreachable needs a -port")
+		}
+		go peer.choker.run()
+	}
+	peer.port = port
+
+	err = o.useTrackers(peer)
+	if err != nil {
+		return nil, err
+	}
+	if !peer.reachable {
+		peer.waitForConnectBack()
+	}
+	o.joinDHT(peer)
+	return peer, nil
+}
+
+// useLANTrackers uses every tracker announcing itself on the local network, as one tier,
+// and returns their addresses
+func (c *P2PPeer) useLANTrackers() []string {
+	found := c.lan.waitForTrackers(2 * discoveryInterval)
+	for _, address := range found {
+		host, port, _ := net.SplitHostPort(address)
+		if len(c.trackers.tiers) == 0 {
+			c.trackers.tiers = append(c.trackers.tiers, nil)
+		}
+		c.trackers.tiers[0] = append(c.trackers.tiers[0], &trackerEndpoint{host: host, port: port})
+	}
+	return found
+}
+
+// locate finds the peers that have a file, given its name or content hash. It returns
+// the file's name, the hash the finished file must have if known, and the peers.
+func (c *P2PPeer) locate(requested string) (string, string, []string) {
+	fileName := requested
+	expectedHash := ""
+	var peerList []string
+
+	// Message tracker for information about the peers who possess the file
+	if !isFileHash(requested) {
+		peerList = c.findPeers(fileName)
+	}
+
+	// Fall back to the DHT, which can also find files by content hash
+	if len(peerList) == 0 && c.dht != nil {
+		fileName, expectedHash, peerList = c.findInDHT(requested)
+	}
+
+	// Fall back to peers we heard of through peer exchange
+	if len(peerList) == 0 {
+		peerList = c.pex.list(fileName, "", maxDownloadPeers)
+	}
+
+	// As a last resort ask the peers on the local network; those without the file say so.
+	// They aren't known to be in our swarm, so a private swarm doesn't.
+	if len(peerList) == 0 && c.lan != nil && c.swarm == nil {
+		peerList = c.lan.peerAddresses()
+	}
+	return fileName, expectedHash, peerList
+}
+
+// Encrypted files start with a header naming how their key is derived, then hold the
+// content as records of up to encryptedRecord bytes, each sealed with AES-256-GCM. Seeders
+// share them like any other file, so only peers with the key can read what they relay.
+const (
+	encryptedMagic     = "P2PENC1\n"
+	encryptedRecord    = 64 * 1024 // Bytes of content in each sealed record but the last
+	encryptedSuffix    = ".enc"    // Added to the names of encrypted files
+	passphraseRounds   = 600000    // PBKDF2-SHA256 rounds turning a passphrase into a key
+	maxPassphraseRound = 1 << 24   // Most rounds accepted from a file's header
+	keyFromKey         = 0         // Header kind: the key is derived from a shared key
+	keyFromPassphrase  = 1         // Header kind: the key is derived from a passphrase
+)
+
+// fileSecret is what the key of an encrypted file is derived from: a 32-byte key shared
+// out of band, or a passphrase
+type fileSecret struct {
+	key        []byte
+	passphrase string
+}
+
+// readFileSecret reads a hex key or a passphrase from the given file, or asks for a
+// passphrase on the terminal when neither file is given. New passphrases are asked twice.
+func readFileSecret(keyFile string, passphraseFile string, confirm bool) (fileSecret, error) {
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return fileSecret{}, errors.New("give either -key-file or -passphrase-file")
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fileSecret{}, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return fileSecret{}, fmt.Errorf("%s doesn't hold a key of 64 hex digits", keyFile)
+		}
+		return fileSecret{key: key}, nil
+	case passphraseFile != "":
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return fileSecret{}, err
+		}
+		passphrase := strings.TrimRight(string(data), "\r\n")
+		if passphrase == "" {
+			return fileSecret{}, fmt.Errorf("%s is empty", passphraseFile)
+		}
+		return fileSecret{passphrase: passphrase}, nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return fileSecret{}, errors.New("give -key-file or -passphrase-file, or run in a terminal to type a passphrase")
+	}
+	// One reader for both prompts, so a line typed ahead isn't lost in its buffer
+	stdin := bufio.NewReader(os.Stdin)
+	passphrase, err := readPassphrase(stdin, "Passphrase: ")
+	if err != nil {
+		return fileSecret{}, err
+	}
+	if passphrase == "" {
+		return fileSecret{}, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := readPassphrase(stdin, "Passphrase again: ")
+		if err != nil {
+			return fileSecret{}, err
+		}
+		if again != passphrase {
+			return fileSecret{}, errors.New("the passphrases don't match")
+		}
+	}
+	return fileSecret{passphrase: passphrase}, nil
+}
+
+// readPassphrase reads a line from the terminal without echoing it
+func readPassphrase(stdin *bufio.Reader, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if _, err := stty("-echo"); err == nil {
+		defer stty("echo")
+	}
+	line, err := stdin.ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// newEncryptionHeader starts the header of a file encrypted with secret, with a fresh salt
+func newEncryptionHeader(secret fileSecret) ([]byte, error) {
+	header := make([]byte, 0, len(encryptedMagic)+1+4+16)
+	header = append(header, encryptedMagic...)
+	if secret.key != nil {
+		header = append(header, keyFromKey)
+		header = binary.BigEndian.AppendUint32(header, 0)
+	} else {
+		header = append(header, keyFromPassphrase)
+		header = binary.BigEndian.AppendUint32(header, passphraseRounds)
+	}
+	salt := make([]byte, 16)
+	_, err := crand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, salt...), nil
+}
+
+// fileCipher derives the key of an encrypted file from its header and the secret.
+// Every file has its own salt, so no two files share a key.
+func fileCipher(header []byte, secret fileSecret) (cipher.AEAD, error) {
+	kind := header[len(encryptedMagic)]
+	rounds := int(binary.BigEndian.Uint32(header[len(encryptedMagic)+1:]))
+	salt := header[len(encryptedMagic)+5:]
+
+	var key []byte
+	var err error
+	switch {
+	case kind == keyFromKey && secret.key != nil:
+		key, err = hkdf.Key(sha256.New, secret.key, salt, "p2p file content", 32)
+	case kind == keyFromPassphrase && secret.key == nil:
+		if rounds < 1 || rounds > maxPassphraseRound {
+			return nil, fmt.Errorf("unlikely passphrase rounds %d", rounds)
+		}
+		key, err = pbkdf2.Key(sha256.New, secret.passphrase, salt, rounds, 32)
+	case kind == keyFromKey:
+		return nil, errors.New("the file was encrypted with a key, not a passphrase")
+	case kind == keyFromPassphrase:
+		return nil, errors.New("the file was encrypted with a passphrase, not a key")
+	default:
+		return nil, fmt.Errorf("unknown key kind %d", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordNonce returns the nonce of a record: its index, which never repeats within a file
+func recordNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// recordData returns what a record is authenticated along with: the header, and whether
+// it is the last record, so the file can't be cut short or have its header swapped
+func recordData(header []byte, last bool) []byte {
+	data := append([]byte{}, header...)
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// encryptFile encrypts the file at src into dst
+func encryptFile(src string, dst string, secret fileSecret) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header, err := newEncryptionHeader(secret)
+	if err != nil {
+		return err
+	}
+	aead, err := fileCipher(header, secret)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomically(dst, func(out io.Writer) error {
+		_, err := out.Write(header)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReaderSize(in, encryptedRecord)
+		record := make([]byte, encryptedRecord)
+		for index := uint64(0); ; index++ {
+			n, err := io.ReadFull(reader, record)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			// A full record is the last one if nothing follows it
+			last := err != nil
+			if !last {
+				_, err = reader.Peek(1)
+				last = err == io.EOF
+			}
+
+			_, err = out.Write(aead.Seal(nil, recordNonce(index), record[:n], recordData(header, last)))
+			if err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+		}
+	})
+}
+
+// decryptFile decrypts the file at src into dst. Nothing is left at dst unless the whole
+// file decrypts, so a wrong key or a tampered file yields no partial plaintext.
+func decryptFile(src string, dst string, secret fileSecret) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader := bufio.NewReaderSize(in, encryptedRecord+16)
+	header := make([]byte, len(encryptedMagic)+1+4+16)
+	_, err = io.ReadFull(reader, header)
+	if err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return fmt.Errorf("%s is not an encrypted file", src)
+	}
+	aead, err := fileCipher(header, secret)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomically(dst, func(out io.Writer) error {
+		record := make([]byte, encryptedRecord+aead.Overhead())
+		for index := uint64(0); ; index++ {
+			n, err := io.ReadFull(reader, record)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				if err == io.EOF {
+					return errors.New("the file is cut short")
+				}
+				return err
+			}
+			last := err != nil
+			if !last {
+				_, err = reader.Peek(1)
+				last = err == io.EOF
+			}
+
+			content, err := aead.Open(record[:0], recordNonce(index), record[:n], recordData(header, last))
+			if err != nil {
+				return errors.New("wrong key or passphrase, or the file was tampered with")
+			}
+			_, err = out.Write(content)
+			if err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+		}
+	})
+}
+
+// writeAtomically writes a file through a temporary file that replaces it only once write
+// succeeded
+func writeAtomically(path string, write func(out io.Writer) error) error {
+	temp := path + ".tmp"
+	out, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(out)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Exit codes of the subcommands
+const (
+	exitOK       = 0
+	exitFailure  = 1 // The command failed
+	exitUsage    = 2 // The command line is wrong
+	exitNotFound = 3 // No peer has the requested file
+)
+
+// peerCommands are the subcommands that run without prompting, for scripts
+var peerCommands = map[string]func(args []string) int{
+	"serve":     runServe,
+	"share":     runShare,
+	"unshare":   runUnshare,
+	"get":       runGet,
+	"list":      runList,
+	"status":    runStatus,
+	"downloads": runDownloads,
+	"pause":     runPause,
+	"resume":    runResume,
+	"cancel":    runCancel,
+	"priority":  runPriority,
+	"keygen":    runKeygen,
+	"encrypt":   runEncrypt,
+	"decrypt":   runDecrypt,
+	"sign":      runSign,
+}
+
+// commandFlags returns the flag set of a subcommand, with its usage line
+func commandFlags(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: peer %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandLine parses a subcommand's flags, which may come before, between or after
+// its positional arguments, and returns the positional arguments
+func parseCommandLine(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// usageError returns the exit code for a command line that failed to parse
+func usageError(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return exitUsage
+}
+
+// writeJSON writes one JSON document on a line of its own to stdout
+func writeJSON(v any) {
+	json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// commandFailed reports why a command failed, on stdout as JSON when asked to and on
+// stderr otherwise, and returns the exit code
+func commandFailed(asJSON bool, code int, err error) int {
+	if asJSON {
+		writeJSON(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+	}
+	return code
+}
+
+// fileInfo describes a file in command output
+type fileInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// shareablePaths expands files and directories into the files in them that can be shared:
+// hidden files and unfinished downloads are left out
+func shareablePaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".state") || strings.HasSuffix(name, manifestSuffix) {
+				continue
+			}
+			if _, err := os.Stat(downloadStatePath(filepath.Join(path, name))); err == nil {
+				continue
+			}
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// runServe runs the peer as a daemon: it shares every file in the given files and
+// directories, or in ./files by default, and takes commands over the control API until
+// interrupted
+func runServe(args []string) int {
+	var options peerOptions
+	fs := commandFlags("serve", "[flags] [path ...]")
+	options.register(fs)
+	options.registerControl(fs)
+	port := fs.String("port", "0", "Port my server listens on (0 = any free port)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	paths, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+
+	// Without paths the daemon shares ./files if there is one, and otherwise starts empty
+	if len(paths) == 0 {
+		if _, err := os.Stat("files"); err == nil {
+			paths = []string{"files"}
+		}
+	}
+	files, err := shareablePaths(paths)
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+
+	// Take commands from the CLI and other local programs. Over TCP they need a token that
+	// only this user can read.
+	var listener net.Listener
+	var token string
+	if options.control != "" {
+		listener, err = listenControl(options.control)
+		if err != nil {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+	}
+	if listener != nil && !strings.HasPrefix(options.control, "unix:") {
+		path, err := controlTokenPath(options.control, options.controlToken)
+		if err == nil {
+			token, err = writeControlToken(path)
+		}
+		if err != nil {
+			listener.Close()
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+	}
+
+	peer, err := options.startPeer(*port)
+	if err == nil {
+		peer.queue, err = newDownloadQueue(peer, options.maxDownloads, options.queueFile)
+	}
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		if peer != nil {
+			peer.shutdown(options.shutdownLimit)
+		}
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	go peer.queue.run()
+	if listener != nil {
+		control := &controlServer{peer: peer, queue: peer.queue, token: token}
+		go control.serve(listener)
+	}
+
+	var shared []fileInfo
+	for _, path := range files {
+		file, err := peer.shareFile(path)
+		if err != nil {
+			peer.shutdown(options.shutdownLimit)
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+		peer.announce(file.name)
+		if peer.dht != nil {
+			go peer.dht.announce(file)
+		}
+		shared = append(shared, fileInfo{Name: file.name, Path: path, Size: file.size, Hash: file.getHash()})
+	}
+	go peer.reannounce()
+	if peer.dht != nil {
+		go peer.dht.republish()
+	}
+
+	if *asJSON {
+		writeJSON(map[string]any{"port": peer.port, "control": options.control, "files": shared})
+	} else {
+		fmt.Println("Serving on port", peer.port)
+		if options.control != "" {
+			fmt.Println("Control API on", options.control)
+		}
+		for _, file := range shared {
+			fmt.Printf("%s  %d bytes  %s\n", file.Name, file.Size, file.Hash)
+		}
+	}
+
+	// Serve until Ctrl-C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	peer.shutdown(options.shutdownLimit)
+	return exitOK
+}
+
+// daemonCommand parses the command line of a subcommand that needs a running daemon.
+// It returns a client for the daemon, the positional arguments and whether to print JSON;
+// the client is nil, and the exit code set, when the command line is wrong.
+func daemonCommand(name string, usage string, args []string, want int) (*controlClient, []string, bool, int) {
+	var options peerOptions
+	fs := commandFlags(name, usage)
+	options.registerControl(fs)
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return nil, nil, false, usageError(err)
+	}
+	if len(positional) != want {
+		fs.Usage()
+		return nil, nil, false, exitUsage
+	}
+	return newControlClient(options.control, options.controlToken), positional, *asJSON, exitOK
+}
+
+// printShares prints shared files as JSON or one per line
+func printShares(asJSON bool, files []fileInfo) {
+	if asJSON {
+		writeJSON(files)
+		return
+	}
+	for _, file := range files {
+		hash := file.Hash
+		if hash == "" {
+			hash = "(incomplete)"
+		}
+		fmt.Printf("%-30s %12d  %s\n", file.Name, file.Size, hash)
+	}
+}
+
+// runShare has the daemon share a file, or every file in a directory
+func runShare(args []string) int {
+	client, positional, asJSON, code := daemonCommand("share", "[flags] <path>", args, 1)
+	if client == nil {
+		return code
+	}
+
+	// The daemon may run in another directory
+	path, err := filepath.Abs(positional[0])
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	var shared []fileInfo
+	err = client.call("POST", "/shares", map[string]string{"path": path}, &shared)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	printShares(asJSON, shared)
+	return exitOK
+}
+
+// runUnshare has the daemon stop sharing a file
+func runUnshare(args []string) int {
+	client, positional, asJSON, code := daemonCommand("unshare", "[flags] <name>", args, 1)
+	if client == nil {
+		return code
+	}
+	err := client.call("DELETE", "/shares/"+url.PathEscape(positional[0]), nil, nil)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	if asJSON {
+		writeJSON(map[string]string{"unshared": positional[0]})
+	}
+	return exitOK
+}
+
+// runGet downloads a file by name or content hash. With a daemon running the download is
+// queued there; otherwise the command joins the swarm itself until the file has arrived.
+func runGet(args []string) int {
+	var options peerOptions
+	fs := commandFlags("get", "[flags] <name|hash>")
+	options.register(fs)
+	options.registerControl(fs)
+	port := fs.String("port", "0", "Port my server listens on while downloading without a daemon (0 = any free port)")
+	output := fs.String("o", "", "Where to save the file: a path, or a directory to save it in under its own name (default: its name, in the current directory)")
+	priority := fs.Int("priority", 0, "Priority in the daemon's download queue; higher runs first")
+	detach := fs.Bool("detach", false, "Return once the daemon has queued the download instead of waiting for it to finish")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	// Hand the download to the daemon if one is running; it may run in another directory
+	if options.control != "" {
+		path := *output
+		if path == "" {
+			path = "."
+		}
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+		client := newControlClient(options.control, options.controlToken)
+		var item queuedDownload
+		err = client.call("POST", "/downloads", map[string]any{"file": positional[0], "path": path, "priority": *priority}, &item)
+		if err == nil {
+			return waitForDownload(client, item, *detach, *asJSON)
 		}
+		if !errors.Is(err, errNoDaemon) {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+	}
+	return getFile(&options, positional[0], *port, *output, *asJSON)
+}
 
-		if n == 0 {
-			fmt.Println("Received empty chunk")
-			continue
+// waitForDownload follows a download queued on the daemon until it finishes, and reports
+// the result. With detach it reports the queued download right away.
+func waitForDownload(client *controlClient, item queuedDownload, detach bool, asJSON bool) int {
+	if detach {
+		if asJSON {
+			writeJSON(item)
+		} else {
+			fmt.Printf("Queued download %d of %s\n", item.ID, item.Request)
 		}
+		return exitOK
+	}
 
-		// Write chunk to the file
-		bytesWritten, err := outFile.Write(buffer[:n])
+	line := newProgressLine(asJSON)
+	defer line.clear()
+	for {
+		if item.Progress != nil {
+			line.draw(*item.Progress)
+		}
+		switch item.State {
+		case downloadDone:
+			line.clear()
+			result := fileInfo{Name: item.Name, Path: item.Path, Size: item.Size, Hash: item.Hash}
+			if asJSON {
+				writeJSON(result)
+			} else {
+				fmt.Printf("Downloaded %s to %s (%d bytes, %s)\n", result.Name, result.Path, result.Size, result.Hash)
+			}
+			return exitOK
+		case downloadNotFound:
+			return commandFailed(asJSON, exitNotFound, errors.New(item.Error))
+		case downloadFailed:
+			return commandFailed(asJSON, exitFailure, errors.New(item.Error))
+		case downloadPaused, downloadCancelled:
+			return commandFailed(asJSON, exitFailure, fmt.Errorf("download %d was %s", item.ID, item.State))
+		}
 
+		time.Sleep(500 * time.Millisecond)
+		err := client.call("GET", "/downloads/"+strconv.Itoa(item.ID), nil, &item)
 		if err != nil {
-			fmt.Println("Error writing chunk to file:", err.Error())
-			return
+			return commandFailed(asJSON, exitFailure, err)
 		}
-		fmt.Printf("Chunk %d written, %d bytes\n", i, bytesWritten)
 	}
+}
+
+// getFile downloads a file without a daemon, then exits
+func getFile(options *peerOptions, requested string, port string, output string, asJSON bool) int {
+	peer, err := options.startPeer(port)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	defer peer.shutdown(options.shutdownLimit)
 
-	outFile.Sync() // Flush the file buffer to disk
-	fmt.Println("Download complete for file:", fileName)
+	// Stop downloading on Ctrl-C or SIGTERM; what arrived is kept to resume from
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		peer.shutdown(options.shutdownLimit)
+	}()
+
+	fileName, expectedHash, peerList := peer.locate(requested)
+	if len(peerList) == 0 {
+		return commandFailed(asJSON, exitNotFound, fmt.Errorf("no peer has %s", requested))
+	}
+
+	// Names come from other peers, so only their last element is used
+	path := filepath.Base(fileName)
+	if output != "" {
+		path = output
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			path = filepath.Join(path, filepath.Base(fileName))
+		}
+	}
+
+	// Draw the progress of the download as it goes
+	line := newProgressLine(asJSON)
+	events, unwatch := peer.progress.watch(16)
+	drawn := make(chan struct{})
+	go func() {
+		defer close(drawn)
+		for e := range events {
+			if e.Path == path && e.State == progressRunning {
+				line.draw(e)
+			}
+		}
+	}()
+
+	// Announce ourselves first so other peers can fetch chunks from us while we download
+	peer.announce(fileName)
+	hash, err := peer.downloadFile(peer.ctx, fileName, path, peerList, expectedHash)
+	unwatch()
+	<-drawn
+	line.clear()
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	result := fileInfo{Name: fileName, Path: path, Size: info.Size(), Hash: hash}
+	if asJSON {
+		writeJSON(result)
+	} else {
+		fmt.Printf("Downloaded %s to %s (%d bytes, %s)\n", result.Name, result.Path, result.Size, result.Hash)
+	}
+	return exitOK
 }
 
-// serveFileChunk sends a requested chunk of a file to another peer
-func (c *P2PPeer) serveFileChunk(conn net.Conn, fileName string, chunkIndex int) {
-	file, err := os.Open(fileName)
+// runList lists the files the daemon shares. Without a daemon it lists the files serve
+// would share from the given files and directories, or from ./files by default.
+func runList(args []string) int {
+	var options peerOptions
+	fs := commandFlags("list", "[flags] [path ...]")
+	options.registerControl(fs)
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	paths, err := parseCommandLine(fs, args)
 	if err != nil {
-		fmt.Println("Error opening file:", err.Error())
-		return
+		return usageError(err)
 	}
-	defer file.Close()
 
-	// Seek to the start of the chunk
-	_, err = file.Seek(int64(chunkIndex*ChunkSize), 0)
+	if options.control != "" && len(paths) == 0 {
+		var shared []fileInfo
+		err := newControlClient(options.control, options.controlToken).call("GET", "/shares", nil, &shared)
+		if err == nil {
+			printShares(*asJSON, shared)
+			return exitOK
+		}
+		if !errors.Is(err, errNoDaemon) {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+	}
+
+	if len(paths) == 0 {
+		paths = []string{"files"}
+	}
+	files, err := shareablePaths(paths)
 	if err != nil {
-		fmt.Println("Error seeking file:", err.Error())
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	listed := []fileInfo{}
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+		listed = append(listed, fileInfo{Name: filepath.Base(path), Path: path, Size: info.Size(), Hash: hash})
+	}
+	printShares(*asJSON, listed)
+	return exitOK
+}
+
+// printDownloads prints downloads as JSON or as a table
+func printDownloads(asJSON bool, items []queuedDownload) {
+	if asJSON {
+		writeJSON(items)
 		return
 	}
+	fmt.Printf("%-4s %-10s %8s %8s  %-30s %s\n", "ID", "STATE", "PRIORITY", "PROGRESS", "FILE", "PATH")
+	for _, item := range items {
+		progress := "-"
+		if item.Chunks > 0 {
+			progress = fmt.Sprintf("%d%%", item.ChunksDone*100/item.Chunks)
+		}
+		name := item.Name
+		if name == "" {
+			name = item.Request
+		}
+		fmt.Printf("%-4d %-10s %8d %8s  %-30s %s\n", item.ID, item.State, item.Priority, progress, name, item.Path)
+	}
+}
 
-	// Read the chunk
-	buffer := make([]byte, ChunkSize)
-	n, err := file.Read(buffer)
-	if err != nil && err != io.EOF {
-		fmt.Println("Error reading file chunk:", err.Error())
+// printDownload prints one download as JSON or as a table row
+func printDownload(asJSON bool, item queuedDownload) {
+	if asJSON {
+		writeJSON(item)
 		return
 	}
+	printDownloads(false, []queuedDownload{item})
+}
 
-	// Send the chunk
-	_, err = conn.Write(buffer[:n])
+// runDownloads lists the daemon's downloads with their progress
+func runDownloads(args []string) int {
+	client, _, asJSON, code := daemonCommand("downloads", "[flags]", args, 0)
+	if client == nil {
+		return code
+	}
+	var items []queuedDownload
+	err := client.call("GET", "/downloads", nil, &items)
 	if err != nil {
-		fmt.Println("Error sending file chunk:", err.Error())
-		return
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	printDownloads(asJSON, items)
+	return exitOK
+}
+
+// runPause pauses one of the daemon's downloads
+func runPause(args []string) int {
+	return changeDownload("pause", args)
+}
+
+// runResume resumes a paused or failed download of the daemon
+func runResume(args []string) int {
+	return changeDownload("resume", args)
+}
+
+// runCancel cancels one of the daemon's downloads and deletes what arrived of it
+func runCancel(args []string) int {
+	return changeDownload("cancel", args)
+}
+
+// changeDownload implements pause, resume and cancel
+func changeDownload(action string, args []string) int {
+	client, positional, asJSON, code := daemonCommand(action, "[flags] <id>", args, 1)
+	if client == nil {
+		return code
+	}
+	var item queuedDownload
+	err := client.call("POST", "/downloads/"+url.PathEscape(positional[0])+"/"+action, nil, &item)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	printDownload(asJSON, item)
+	return exitOK
+}
+
+// runPriority changes the priority of one of the daemon's downloads
+func runPriority(args []string) int {
+	client, positional, asJSON, code := daemonCommand("priority", "[flags] <id> <priority>", args, 2)
+	if client == nil {
+		return code
+	}
+	priority, err := strconv.Atoi(positional[1])
+	if err != nil {
+		return commandFailed(asJSON, exitUsage, fmt.Errorf("invalid priority %q", positional[1]))
+	}
+	var item queuedDownload
+	err = client.call("POST", "/downloads/"+url.PathEscape(positional[0])+"/priority", map[string]int{"priority": priority}, &item)
+	if err != nil {
+		return commandFailed(asJSON, exitFailure, err)
+	}
+	printDownload(asJSON, item)
+	return exitOK
+}
+
+// trackerStatus is how one tracker is doing
+type trackerStatus struct {
+	Address   string  `json:"address"`
+	Tier      int     `json:"tier"`
+	Reachable bool    `json:"reachable"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// printTrackers prints tracker statuses one per line
+func printTrackers(trackers []trackerStatus) {
+	for _, t := range trackers {
+		switch {
+		case !t.Reachable:
+			fmt.Printf("Tier %d  %s  unreachable: %s\n", t.Tier, t.Address, t.Error)
+		case t.LatencyMS > 0:
+			fmt.Printf("Tier %d  %s  ok (%.1f ms)\n", t.Tier, t.Address, t.LatencyMS)
+		default:
+			fmt.Printf("Tier %d  %s  ok\n", t.Tier, t.Address)
+		}
+	}
+}
+
+// runKeygen makes a random key to encrypt files with, to be shared out of band, or with
+// -sign a publisher's key to sign manifests with
+func runKeygen(args []string) int {
+	fs := commandFlags("keygen", "[flags]")
+	output := fs.String("o", "", "File to write the key to (default: print it)")
+	signing := fs.Bool("sign", false, "Make an Ed25519 key to sign manifests with, and print its public key for peers to trust; needs -o")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if len(positional) != 0 || (*signing && *output == "") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	// A signing key is kept as its 32-byte seed, so both kinds are 32 random bytes
+	key := make([]byte, 32)
+	_, err = crand.Read(key)
+	if err != nil {
+		return commandFailed(false, exitFailure, err)
+	}
+	if *output == "" {
+		fmt.Println(hex.EncodeToString(key))
+		return exitOK
+	}
+	err = os.WriteFile(*output, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return commandFailed(false, exitFailure, err)
+	}
+	if *signing {
+		fmt.Println(hex.EncodeToString(ed25519.NewKeyFromSeed(key).Public().(ed25519.PublicKey)))
+	}
+	return exitOK
+}
+
+// runSign signs a file's manifest as its publisher. The manifest is written next to the
+// file, and peers sharing the file hand it out with it.
+func runSign(args []string) int {
+	fs := commandFlags("sign", "[flags] <path>")
+	keyFile := fs.String("key-file", "", "File holding the publisher's key, made with keygen -sign")
+	publisher := fs.String("publisher", "", "Name to publish under")
+	asJSON := fs.Bool("json", false, "Print the manifest as JSON")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if len(positional) != 1 || *keyFile == "" || *publisher == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	path := positional[0]
+
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return commandFailed(*asJSON, exitUsage, err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return commandFailed(*asJSON, exitUsage, fmt.Errorf("%s doesn't hold a key of 64 hex digits", *keyFile))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	m := fileManifest{Name: filepath.Base(path), Size: info.Size(), Hash: hash, Publisher: *publisher}
+	m.sign(ed25519.NewKeyFromSeed(seed))
+	err = m.verify()
+	if err != nil {
+		return commandFailed(*asJSON, exitUsage, err)
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	err = os.WriteFile(path+manifestSuffix, append(manifest, '\n'), 0644)
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+
+	if *asJSON {
+		writeJSON(m)
+	} else {
+		fmt.Printf("%s signed by %s\n", path+manifestSuffix, publisherIdentity(m.Publisher, m.Key))
+	}
+	return exitOK
+}
+
+// runEncrypt encrypts a file so it can be shared with only the peers that have the key
+func runEncrypt(args []string) int {
+	return cryptCommand("encrypt", args)
+}
+
+// runDecrypt decrypts a downloaded file that was encrypted with runEncrypt
+func runDecrypt(args []string) int {
+	return cryptCommand("decrypt", args)
+}
+
+// cryptCommand runs the encrypt or decrypt command on one file
+func cryptCommand(name string, args []string) int {
+	fs := commandFlags(name, "[flags] <path>")
+	keyFile := fs.String("key-file", "", "File holding a key made with keygen")
+	passphraseFile := fs.String("passphrase-file", "", "File holding a passphrase (default: ask for one)")
+	output := fs.String("o", "", "Where to write the result (default: the path with "+encryptedSuffix+" added, or taken off)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	src, dst := positional[0], *output
+
+	if dst == "" && name == "encrypt" {
+		dst = src + encryptedSuffix
+	}
+	if dst == "" {
+		if !strings.HasSuffix(src, encryptedSuffix) || len(src) == len(encryptedSuffix) {
+			return commandFailed(*asJSON, exitUsage, fmt.Errorf("give -o, as %s doesn't end in %s", src, encryptedSuffix))
+		}
+		dst = strings.TrimSuffix(src, encryptedSuffix)
+	}
+
+	secret, err := readFileSecret(*keyFile, *passphraseFile, name == "encrypt")
+	if err != nil {
+		return commandFailed(*asJSON, exitUsage, err)
+	}
+	if name == "encrypt" {
+		err = encryptFile(src, dst, secret)
+	} else {
+		err = decryptFile(src, dst, secret)
+	}
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+
+	if *asJSON {
+		writeJSON(map[string]string{"input": src, "output": dst})
+	} else {
+		fmt.Println(dst)
+	}
+	return exitOK
+}
+
+// runStatus reports on the daemon. Without a daemon it checks that the trackers answer and
+// the DHT can be joined, and exits with exitFailure when there is no other node to work with.
+func runStatus(args []string) int {
+	var options peerOptions
+	fs := commandFlags("status", "[flags]")
+	options.register(fs)
+	options.registerControl(fs)
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	positional, err := parseCommandLine(fs, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if len(positional) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if options.control != "" {
+		var status daemonStatus
+		err := newControlClient(options.control, options.controlToken).call("GET", "/status", nil, &status)
+		if err == nil {
+			printDaemonStatus(*asJSON, status)
+			return exitOK
+		}
+		if !errors.Is(err, errNoDaemon) {
+			return commandFailed(*asJSON, exitFailure, err)
+		}
+	}
+
+	peer, err := options.newPeer()
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	err = options.useTrackers(peer)
+	if err != nil {
+		return commandFailed(*asJSON, exitFailure, err)
+	}
+	options.joinDHT(peer)
+
+	// Ask every tracker for the peers of no file at all, which any tracker answers
+	reachable := false
+	trackers := []trackerStatus{}
+	for i, tier := range peer.trackers.tiers {
+		for _, t := range tier {
+			status := trackerStatus{Address: net.JoinHostPort(t.host, t.port), Tier: i + 1}
+			start := time.Now()
+			_, err := peer.requestPeersFromTracker(t.host, t.port, "")
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Reachable = true
+				status.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+				reachable = true
+			}
+			trackers = append(trackers, status)
+		}
+	}
+	dhtNodes := -1
+	if peer.dht != nil {
+		dhtNodes = peer.dht.size()
+		reachable = reachable || dhtNodes > 0
+	}
+
+	if *asJSON {
+		result := map[string]any{"trackers": trackers}
+		if dhtNodes >= 0 {
+			result["dht_nodes"] = dhtNodes
+		}
+		writeJSON(result)
+	} else {
+		printTrackers(trackers)
+		if dhtNodes >= 0 {
+			fmt.Println("Known DHT nodes:", dhtNodes)
+		}
+	}
+	if !reachable {
+		return exitFailure
 	}
+	return exitOK
+}
 
-	// Logging message
-	fmt.Println("Served chunk", chunkIndex, "of file", fileName)
+// printDaemonStatus prints what the daemon reports about itself
+func printDaemonStatus(asJSON bool, status daemonStatus) {
+	if asJSON {
+		writeJSON(status)
+		return
+	}
+	fmt.Printf("Peer %s on port %s\n", status.PeerID, status.Port)
+	fmt.Printf("Shares: %d  Uploads: %d  Connections: %d\n", status.Shares, status.Uploads, status.Connections)
+	var downloads []string
+	for _, state := range []string{downloadRunning, downloadQueued, downloadPaused, downloadDone, downloadFailed, downloadNotFound, downloadCancelled} {
+		if n := status.Downloads[state]; n > 0 {
+			downloads = append(downloads, fmt.Sprintf("%d %s", n, state))
+		}
+	}
+	if len(downloads) == 0 {
+		downloads = []string{"none"}
+	}
+	fmt.Println("Downloads:", strings.Join(downloads, ", "))
+	printTrackers(status.Trackers)
+	if status.DHTNodes != nil {
+		fmt.Println("Known DHT nodes:", *status.DHTNodes)
+	}
 }
 
 func main() {
+	// Subcommands run without prompting, for scripts
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := peerCommands[os.Args[1]]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Unknown command:", os.Args[1])
+			fmt.Fprintln(os.Stderr, "Commands: serve, share, unshare, get, list, status, downloads, pause, resume, cancel, priority, keygen, encrypt, decrypt, sign; run without one for the interactive prompt")
+			os.Exit(exitUsage)
+		}
+		os.Exit(command(os.Args[2:]))
+	}
+
+	var options peerOptions
+	options.register(flag.CommandLine)
+	useTUI := flag.Bool("tui", true, "Use the full-screen terminal UI when run in a terminal (false = line prompt)")
+	flag.Parse()
 
 	// Creating a new P2P peer
-	peer := NewP2PPeer()
+	peer, err := options.newPeer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	// Shut down gracefully on Ctrl-C or SIGTERM; a second signal exits at once
+	var screen atomic.Pointer[terminalUI]
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals.Done()
+		stopSignals()
+		if ui := screen.Load(); ui != nil {
+			ui.close()
+		}
+		fmt.Println("\nShutting down...")
+		peer.shutdown(options.shutdownLimit)
+		os.Exit(0)
+	}()
 
 	reader := bufio.NewReader(os.Stdin) // User input
 
@@ -281,19 +8044,63 @@ func main() {
 	fmt.Print("Enter my server port: ")
 	port, _ := reader.ReadString('\n')
 	port = strings.TrimSpace(port)
+	peer.port = port
 
-	// Start the peer server in a separate goroutine
-	go peer.startPeerServer(port)
+	// Start the peer server in a separate goroutine, unless nobody could connect to it
+	if peer.reachable {
+		peer.port, err = peer.startPeerServer(port)
+		if err != nil {
+			fmt.Println("Error starting my server:", err.Error())
+			return
+		}
+		if peer.lan != nil && peer.swarm == nil {
+			go peer.advertiseLAN()
+		}
+	} else {
+		fmt.Println("Not accepting connections; peers will reach me through the trackers")
+		go peer.choker.run()
+	}
 
 	time.Sleep(1 * time.Second) // Delay so that messages will not overlap
 
-	fmt.Print("Enter tracker IP: ") // Prompt for tracker IP
-	trackerHost, _ := reader.ReadString('\n')
-	trackerHost = strings.TrimSpace(trackerHost)
+	if options.trackers != "" {
+		// Trackers were configured on the command line
+		list, err := parseTrackerList(options.trackers)
+		if err != nil {
+			fmt.Println("Error parsing tracker list:", err.Error())
+			return
+		}
+		peer.trackers = list
+	} else {
+		// Prompt for tracker IP, which is optional when the DHT or LAN discovery is enabled
+		switch {
+		case peer.lan != nil:
+			fmt.Print("Enter tracker IP (leave empty to find one on the local network): ")
+		case peer.dht != nil:
+			fmt.Print("Enter tracker IP (leave empty to use only the DHT): ")
+		default:
+			fmt.Print("Enter tracker IP: ")
+		}
+		trackerHost, _ := reader.ReadString('\n')
+		trackerHost = strings.TrimSpace(trackerHost)
 
-	fmt.Print("Enter tracker port: ") // Prompt for tracker port
-	trackerPort, _ := reader.ReadString('\n')
-	trackerPort = strings.TrimSpace(trackerPort)
+		if trackerHost == "" && peer.lan != nil {
+			// Use every tracker announcing itself, as one tier
+			found := peer.useLANTrackers()
+			if len(found) == 0 {
+				fmt.Println("No tracker found on the local network")
+			}
+			for _, address := range found {
+				fmt.Println("Using tracker", address)
+			}
+		} else if trackerHost != "" || peer.dht == nil {
+			fmt.Print("Enter tracker port: ") // Prompt for tracker port
+			trackerPort, _ := reader.ReadString('\n')
+			trackerPort = strings.TrimSpace(trackerPort)
+			peer.trackers.tiers = [][]*trackerEndpoint{{{host: trackerHost, port: trackerPort}}}
+		}
+	}
+	peer.trackers.announceAll = options.announceAll
 
 	// Pick a random file from a specified directory
 	selectedFile, err := peer.pickRandomFile("files")
@@ -305,8 +8112,65 @@ func main() {
 	fmt.Println("My initial selected file:", selectedFile)
 	fileName := selectedFile
 
-	// Initiate connection to tracker
-	peer.connectToTracker(trackerHost, trackerPort, fileName, port)
+	// Serve the selected file from the directory it was picked from
+	shared, err := peer.shareFile(filepath.Join("files", fileName))
+	if err != nil {
+		fmt.Println("Error sharing my file:", err.Error())
+		return
+	}
+	fmt.Println("My file hash:", shared.getHash())
+
+	// Initiate connection to the trackers, and keep the registrations from expiring
+	peer.announce(fileName)
+	go peer.reannounce()
+	if !peer.reachable {
+		peer.waitForConnectBack()
+	}
+
+	// Join the DHT and announce the file there as well
+	if peer.dht != nil {
+		options.joinDHT(peer)
+		go peer.dht.announce(shared)
+		go peer.dht.republish()
+	}
+
+	// Downloads run in the background so the prompt stays free
+	peer.queue, err = newDownloadQueue(peer, options.maxDownloads, options.queueFile)
+	if err != nil {
+		fmt.Println("Error loading the download queue:", err.Error())
+		peer.shutdown(options.shutdownLimit)
+		return
+	}
+	go peer.queue.run()
+
+	// Browse and download in the full-screen UI when we have a terminal
+	if *useTUI && isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		ui, err := newTerminalUI(peer)
+		if err == nil {
+			screen.Store(ui)
+			if options.logFile == "" {
+				// Logs show on the bottom line instead of scribbling over the screen
+				var level slog.Level
+				level.UnmarshalText([]byte(options.logLevel))
+				SetLogger(slog.New(slog.NewTextHandler(ui, &slog.HandlerOptions{Level: level})))
+			}
+			ui.run()
+			ui.close()
+			fmt.Println("Sending exit message to trackers and exiting.")
+			peer.shutdown(options.shutdownLimit)
+			return
+		}
+		fmt.Println("Can't start the terminal UI, using the prompt:", err.Error())
+	}
+
+	fmt.Println("Bandwidth commands: LIMIT <UP|DOWN|PEER-UP|PEER-DOWN> <KB/s>, SLOTS <max uploads> [max queued]")
+	fmt.Println("Type PEERS to see the choke state of connected peers, TRACKERS to see tracker health, CONNECTIONS to see connection limits")
+	fmt.Println("Type TRANSPORT <TCP|UTP> to choose the transport for new connections (now " + strings.ToUpper(peer.transport) + ")")
+	fmt.Printf("Requested files download in the background, %d at a time; type DOWNLOADS to see them\n", options.maxDownloads)
+	fmt.Println("Queue commands: PAUSE <id>, RESUME <id>, CANCEL <id>, PRIORITY <id> <priority>; PROGRESS shows rates and ETAs")
+	if peer.dht != nil {
+		fmt.Println("Files can also be requested by content hash; type DHT to see the routing table size")
+	}
 
 	// Loop to request files
 	for {
@@ -315,43 +8179,79 @@ func main() {
 		requestedFile, _ := reader.ReadString('\n')
 		requestedFile = strings.TrimSpace(requestedFile)
 
-		// Check if the user wants to exit the loop
-		if strings.ToUpper(requestedFile) == "EXIT" {
-			fmt.Println("Sending exit message to tracker and exiting file request loop.")
-			conn, err := net.Dial("tcp", trackerHost+":"+trackerPort)
-			if err != nil {
-				fmt.Println("Error connecting to tracker:", err.Error())
-			} else {
-				requestMessage := "EXIT"                    // Exit the network
-				_, err = conn.Write([]byte(requestMessage)) // Inform the tracker that peer is leaving
-				if err != nil {
-					fmt.Println("Error sending exit message to tracker:", err.Error())
-				}
-				conn.Close()
+		// Check if the user is changing bandwidth limits
+		command := strings.ToUpper(requestedFile)
+		if strings.HasPrefix(command, "LIMIT ") || strings.HasPrefix(command, "SLOTS ") {
+			peer.handleLimitCommand(requestedFile)
+			continue
+		}
+
+		// Check if the user is looking at or changing the download queue, or watching its progress
+		if command == "PROGRESS" {
+			for _, e := range peer.progress.current() {
+				fmt.Println(formatProgress(e))
 			}
-			break
+			continue
+		}
+		if command == "DOWNLOADS" || strings.HasPrefix(command, "PAUSE ") || strings.HasPrefix(command, "RESUME ") ||
+			strings.HasPrefix(command, "CANCEL ") || strings.HasPrefix(command, "PRIORITY ") {
+			peer.queue.handleDownloadCommand(requestedFile)
+			continue
 		}
 
-		fileName := requestedFile
-		totalChunks := 10 // Number of chunks for each file... Potentially revise
+		// Check if the user wants to see the peers we trade with
+		if command == "PEERS" {
+			peer.printPeers()
+			continue
+		}
 
-		// Message tracker for information about the peer who possesses the file
-		peerInfo := peer.requestFileFromTracker(trackerHost, trackerPort, fileName)
-		fmt.Println("Here is the information for the peer who has the file you are requesting:", peerInfo)
-		if peerInfo != "" {
-			hostPort := strings.Split(peerInfo, ":")
-			// Connect to peer with the file
-			peerConn, err := net.Dial("tcp", hostPort[0]+":"+hostPort[1])
-			if err != nil {
-				fmt.Println("Error connecting to peer:", err.Error())
+		// Check if the user is switching transports for new connections
+		if strings.HasPrefix(command, "TRANSPORT ") {
+			transport := strings.TrimSpace(strings.TrimPrefix(command, "TRANSPORT "))
+			if transport != "TCP" && transport != "UTP" {
+				fmt.Println("Usage: TRANSPORT <TCP|UTP>")
 				continue
 			}
-			// Download the file from the peer
-			peer.downloadFile(peerConn, fileName, totalChunks)
-			peerConn.Close()
-		} else {
-			// Most likely file does not exist in the network
-			fmt.Println("No peer information available for the requested file.")
+			peer.transportLock.Lock()
+			peer.transport = strings.ToLower(transport)
+			peer.transportLock.Unlock()
+			fmt.Println("New connections will use", transport)
+			continue
+		}
+
+		// Check if the user wants to see the connection limits at work
+		if command == "CONNECTIONS" {
+			active, rejectedFull, rejectedPerIP, timedOut := peer.connLimits.stats()
+			fmt.Printf("Active: %d  Rejected at limit: %d  Rejected per IP: %d  Timed out: %d\n",
+				active, rejectedFull, rejectedPerIP, timedOut)
+			continue
+		}
+
+		// Check if the user wants to see tracker health
+		if command == "TRACKERS" {
+			peer.trackers.print()
+			continue
+		}
+
+		// Check if the user wants to see the DHT routing table size
+		if command == "DHT" && peer.dht != nil {
+			fmt.Println("Known DHT nodes:", peer.dht.size())
+			continue
+		}
+
+		// Check if the user wants to exit the loop
+		if strings.ToUpper(requestedFile) == "EXIT" {
+			fmt.Println("Sending exit message to trackers and exiting file request loop.")
+			peer.shutdown(options.shutdownLimit)
+			break
 		}
+
+		if requestedFile == "" {
+			continue
+		}
+
+		// Queue the file; the queue finds the peers that have it and downloads it
+		item := peer.queue.add(requestedFile, "", 0)
+		fmt.Printf("Queued download %d of %s\n", item.ID, requestedFile)
 	}
 }
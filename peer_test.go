@@ -0,0 +1,1532 @@
+// peer_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startDHTPeer runs a peer with the DHT on a free loopback port until the test ends
+func startDHTPeer(t *testing.T) *P2PPeer {
+	t.Helper()
+	peer := NewP2PPeer()
+	peer.dht = newDHTNode(peer)
+	port, err := peer.startPeerServer("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.port = port
+	t.Cleanup(peer.stop)
+	return peer
+}
+
+func TestDHTFindsValueFromDistantNode(t *testing.T) {
+	// More nodes than a bucket holds, so a value isn't stored on every node
+	peers := make([]*P2PPeer, dhtBucketSize+6)
+	for i := range peers {
+		peers[i] = startDHTPeer(t)
+	}
+	first := net.JoinHostPort("127.0.0.1", peers[0].port)
+	for _, peer := range peers[1:] {
+		peer.dht.bootstrap([]string{first})
+	}
+
+	// The publisher stores itself on the nodes closest to the key, as announce does
+	publisher := peers[1]
+	sum := sha256.Sum256([]byte("song.mp3 content"))
+	hash := hex.EncodeToString(sum[:])
+	key := nameKey("song.mp3")
+	contacts, _ := publisher.dht.lookup(key, false)
+	if len(contacts) == 0 {
+		t.Fatal("lookup found no nodes to store on")
+	}
+	for _, contact := range contacts {
+		_, err := publisher.dht.call(contact.address, "STORE", hex.EncodeToString(key), hash, "song.mp3")
+		if err != nil {
+			t.Fatalf("STORE on %s: %v", contact.address, err)
+		}
+	}
+
+	// Search from the node farthest from the key that doesn't hold the value itself
+	var searcher *P2PPeer
+	for _, peer := range peers[2:] {
+		if len(peer.dht.providers(hex.EncodeToString(key))) > 0 {
+			continue
+		}
+		if searcher == nil || bytes.Compare(dhtDistance(peer.dht.self, key), dhtDistance(searcher.dht.self, key)) > 0 {
+			searcher = peer
+		}
+	}
+	if searcher == nil {
+		t.Fatal("every node holds the value")
+	}
+
+	name, found, addresses := searcher.findInDHT("song.mp3")
+	want := net.JoinHostPort("127.0.0.1", publisher.port)
+	if name != "song.mp3" || found != hash || len(addresses) != 1 || addresses[0] != want {
+		t.Errorf("findInDHT returned %q, %q, %v; want song.mp3, %s, [%s]", name, found, addresses, hash, want)
+	}
+
+	// The content hash finds nothing, since it was never stored under its own key
+	if providers := searcher.dht.findProviders(hash); len(providers) != 0 {
+		t.Errorf("findProviders by hash returned %v", providers)
+	}
+}
+
+// fakeTracker stands in for tracker.go, which can't be built into the same test binary.
+// It passes connect-back requests on to the peers holding a LISTEN connection, and
+// records registrations and departures without keeping track of them.
+type fakeTracker struct {
+	address   string
+	lock      sync.Mutex
+	listeners map[string]net.Conn // LISTEN connections, by the peer's registered address
+	requests  []string            // CONNECT_BACK, REGISTER, UNREGISTER and EXIT requests received
+}
+
+// startFakeTracker runs a fake tracker on a loopback port until the test ends
+func startFakeTracker(t *testing.T) *fakeTracker {
+	t.Helper()
+	return startFakeTrackerAt(t, "127.0.0.1:0")
+}
+
+// startFakeTrackerAt runs a fake tracker on the given address until the test ends
+func startFakeTrackerAt(t *testing.T, address string) *fakeTracker {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	tracker := &fakeTracker{address: listener.Addr().String(), listeners: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go tracker.handle(conn)
+		}
+	}()
+	return tracker
+}
+
+func (f *fakeTracker) handle(conn net.Conn) {
+	buffer := make([]byte, 1024)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	request := string(buffer[:n])
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if port, ok := strings.CutPrefix(request, "LISTEN:"); ok {
+		f.lock.Lock()
+		f.listeners[net.JoinHostPort(host, port)] = conn
+		f.lock.Unlock()
+		return
+	}
+	defer conn.Close()
+	for _, prefix := range []string{"REGISTER:", "UNREGISTER:", "EXIT:"} {
+		if strings.HasPrefix(request, prefix) {
+			f.lock.Lock()
+			f.requests = append(f.requests, request)
+			f.lock.Unlock()
+			conn.Write([]byte("OK"))
+			return
+		}
+	}
+	fields := strings.SplitN(strings.TrimPrefix(request, "CONNECT_BACK:"), " ", 4)
+	if len(fields) != 4 {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+	replyHost, replyPort, _ := net.SplitHostPort(fields[1])
+	if replyHost == "" {
+		fields[1] = net.JoinHostPort(host, replyPort)
+	}
+
+	f.lock.Lock()
+	f.requests = append(f.requests, request)
+	listener := f.listeners[fields[0]]
+	f.lock.Unlock()
+	if listener == nil {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+	listener.Write([]byte("CONNECT " + fields[1] + " " + fields[2] + "\n"))
+	conn.Write([]byte("OK"))
+}
+
+// received waits until the tracker has received a request, failing the test if it never does
+func (f *fakeTracker) received(t *testing.T, request string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		f.lock.Lock()
+		found := slices.Contains(f.requests, request)
+		f.lock.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("tracker %s never received %q", f.address, request)
+}
+
+// listening waits until a peer holds a LISTEN connection to the tracker
+func (f *fakeTracker) listening(t *testing.T, address string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		f.lock.Lock()
+		_, ok := f.listeners[address]
+		f.lock.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("%s never listened for connect-back requests", address)
+}
+
+// startPeer runs a peer using the tracker until the test ends. Unreachable peers get a
+// port nothing listens on, and wait for connect-back requests.
+func startPeer(t *testing.T, tracker *fakeTracker, reachable bool) *P2PPeer {
+	t.Helper()
+	peer := NewP2PPeer()
+	peer.trackers, _ = parseTrackerList(tracker.address)
+	peer.reachable = reachable
+	t.Cleanup(peer.stop)
+	if reachable {
+		port, err := peer.startPeerServer("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.port = port
+		return peer
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, peer.port, _ = net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	peer.waitForConnectBack()
+	tracker.listening(t, net.JoinHostPort("127.0.0.1", peer.port))
+	return peer
+}
+
+// shareTestFile shares a small file from a peer and returns its name
+func shareTestFile(t *testing.T, peer *P2PPeer) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "poem.txt")
+	err := os.WriteFile(path, []byte("Roses are red\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = peer.shareFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "poem.txt"
+}
+
+// checkReached asks the peer behind NAT for a file's chunks, the way a download starts
+func checkReached(t *testing.T, downloader *P2PPeer, sharer *P2PPeer, fileName string) {
+	t.Helper()
+	address := net.JoinHostPort("127.0.0.1", sharer.port)
+	session, size, bitfield, err := downloader.connectForDownload(address, fileName)
+	if err != nil {
+		t.Fatalf("connecting to the peer behind NAT: %v", err)
+	}
+	defer session.conn.Close()
+	if session.peerID != sharer.id || size != int64(len("Roses are red\n")) || len(bitfield) == 0 {
+		t.Errorf("reached peer %s with size %d and bitfield %v", shortID(session.peerID), size, bitfield)
+	}
+}
+
+func TestConnectBackToUnreachablePeer(t *testing.T) {
+	tracker := startFakeTracker(t)
+	sharer := startPeer(t, tracker, false)
+	fileName := shareTestFile(t, sharer)
+	downloader := startPeer(t, tracker, true)
+
+	checkReached(t, downloader, sharer, fileName)
+
+	// The request names the file, so the tracker can check the peer shares it
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	want := "CONNECT_BACK:127.0.0.1:" + sharer.port + " :" + downloader.port
+	if len(tracker.requests) != 1 || !strings.HasPrefix(tracker.requests[0], want) || !strings.HasSuffix(tracker.requests[0], " poem.txt") {
+		t.Errorf("tracker got %q", tracker.requests)
+	}
+}
+
+func TestRelayBetweenUnreachablePeers(t *testing.T) {
+	tracker := startFakeTracker(t)
+	sharer := startPeer(t, tracker, false)
+	fileName := shareTestFile(t, sharer)
+	relay := startPeer(t, tracker, true)
+	relay.relay = true
+	downloader := startPeer(t, tracker, false)
+	downloader.relays = []string{net.JoinHostPort("127.0.0.1", relay.port)}
+
+	checkReached(t, downloader, sharer, fileName)
+
+	// Neither can reach the other, so the sharer is asked to connect to the relay
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	want := "CONNECT_BACK:127.0.0.1:" + sharer.port + " 127.0.0.1:" + relay.port
+	if len(tracker.requests) != 1 || !strings.HasPrefix(tracker.requests[0], want) {
+		t.Errorf("tracker got %q", tracker.requests)
+	}
+}
+
+func TestUTPFinWaitsForData(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	u := newUTPConn(socket, socket.LocalAddr().(*net.UDPAddr), 7)
+	defer u.Close()
+
+	packet := func(kind byte, seq uint32, data string) []byte {
+		p := make([]byte, utpHeaderSize, utpHeaderSize+len(data))
+		p[0] = kind
+		binary.LittleEndian.PutUint32(p[1:5], 7)
+		binary.LittleEndian.PutUint32(p[5:9], seq)
+		return append(p, data...)
+	}
+
+	// The FIN overtakes the last data packet, which is still read before the stream ends
+	u.handlePacket(packet(utpData, 0, "hello "))
+	u.handlePacket(packet(utpFin, 2, ""))
+	go u.handlePacket(packet(utpData, 1, "world"))
+
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(u)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("read %q, %v; want \"hello world\"", data, err)
+	}
+}
+
+func TestBandwidthLimiterDropsIdleBuckets(t *testing.T) {
+	l := newBandwidthLimiter()
+	l.setPeerUploadLimit(1 << 30)
+	for i := range 100 {
+		l.waitUpload(newPeerID(), ChunkSize)
+		l.waitDownload(strconv.Itoa(i), 1)
+	}
+
+	// Once their tokens are back, the buckets of peers that went quiet are dropped
+	time.Sleep(10 * time.Millisecond)
+	l.swept = time.Time{}
+	l.waitUpload("last", 1)
+	if len(l.uploads) != 1 || len(l.downloads) != 0 {
+		t.Errorf("kept %d upload and %d download buckets", len(l.uploads), len(l.downloads))
+	}
+}
+
+func TestFitWidthDefusesControlCharacters(t *testing.T) {
+	for _, tt := range []struct {
+		text  string
+		width int
+		want  string
+	}{
+		{"plain.txt", 20, "plain.txt"},
+		{"\x1b[2J\x1b]0;owned\afile", 40, "?[2J?]0;owned?file"},
+		{"tab\there\nnext", 40, "tab?here?next"},
+		{"héllo wörld", 5, "héllo"},
+		{"\x1b[31mred", 3, "?[3"},
+	} {
+		if got := fitWidth(tt.text, tt.width); got != tt.want {
+			t.Errorf("fitWidth(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestBandwidthLimiterKeysPeersByHost(t *testing.T) {
+	l := newBandwidthLimiter()
+	l.setPeerUploadLimit(4 * ChunkSize)
+
+	// A peer reconnecting under a new ID draws on the same allowance
+	first := chokerSession(t, newPeerID(), "10.0.0.1")
+	renamed := chokerSession(t, newPeerID(), "10.0.0.1")
+	l.waitUpload(first.remoteHost(), 4*ChunkSize)
+	if bucket := l.uploads[renamed.remoteHost()]; bucket == nil || bucket.full() {
+		t.Error("a new peer ID from the same host got a fresh allowance")
+	}
+
+	// Another host has its own
+	other := chokerSession(t, first.peerID, "10.0.0.2")
+	l.waitUpload(other.remoteHost(), 1)
+	if len(l.uploads) != 2 {
+		t.Errorf("kept %d upload buckets for two hosts", len(l.uploads))
+	}
+}
+
+// remoteConn is a connection that claims to come from another address
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// chokerSession returns an inbound session from a peer at host whose messages go nowhere
+func chokerSession(t *testing.T, id string, host string) *peerSession {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { ours.Close() })
+	go io.Copy(io.Discard, theirs)
+	s := newPeerSession(remoteConn{ours, &net.TCPAddr{IP: net.ParseIP(host), Port: 4000}})
+	s.peerID = id
+	return s
+}
+
+func TestChokerForgetsPeerWithItsLastSession(t *testing.T) {
+	k := newChoker(4)
+	id := newPeerID()
+	first, second := chokerSession(t, id, "10.0.0.1"), chokerSession(t, id, "10.0.0.1")
+	k.connect(first)
+	k.connect(second)
+	k.disconnect(first)
+	if len(k.snapshot()) != 1 {
+		t.Fatal("the peer was forgotten while it still had a session")
+	}
+	k.disconnect(second)
+	if states := k.snapshot(); len(states) != 0 {
+		t.Errorf("the peer is still known after its last session: %+v", states)
+	}
+	if !k.isChoking(second) || len(k.snapshot()) != 0 {
+		t.Error("asking about a gone peer brought it back")
+	}
+}
+
+func TestChokerKeepsServingOlderSessions(t *testing.T) {
+	k := newChoker(4)
+	id := newPeerID()
+	first, second := chokerSession(t, id, "10.0.0.1"), chokerSession(t, id, "10.0.0.1")
+	k.connect(first)
+	k.setInterested(first, true)
+	k.connect(second)
+	k.setInterested(second, true)
+
+	// A download finishing on the newer session leaves the older one unchoked
+	k.setInterested(second, false)
+	k.disconnect(second)
+	if k.isChoking(first) {
+		t.Fatal("the peer was choked while it still wanted data")
+	}
+
+	// The older session's interest still counts
+	k.setInterested(first, false)
+	if !k.isChoking(first) {
+		t.Error("the peer kept its slot without wanting data")
+	}
+	k.setInterested(first, true)
+	if k.isChoking(first) {
+		t.Error("the older session's interest was ignored")
+	}
+}
+
+func TestChokerKeepsPeersWithTheSameIDApart(t *testing.T) {
+	k := newChoker(0) // Only the optimistic slot
+	id := newPeerID()
+	victim := chokerSession(t, id, "10.0.0.1")
+	k.connect(victim)
+	k.setInterested(victim, true)
+
+	// Another host claiming the ID neither takes the slot nor loses it for the victim
+	impostor := chokerSession(t, id, "10.0.0.2")
+	k.connect(impostor)
+	k.setInterested(impostor, true)
+	if !k.isChoking(impostor) {
+		t.Error("an impostor shared the victim's slot")
+	}
+	k.setInterested(impostor, false)
+	k.disconnect(impostor)
+	if k.isChoking(victim) {
+		t.Error("an impostor leaving choked the victim")
+	}
+}
+
+func TestPeerExchangeCapsFiles(t *testing.T) {
+	x := newPeerExchange()
+	for i := range pexMaxFiles + 10 {
+		x.add("file"+strconv.Itoa(i), []string{"127.0.0.1:4001"})
+		x.add("keep.txt", []string{"127.0.0.1:4000"})
+	}
+	if len(x.known) != pexMaxFiles {
+		t.Errorf("remembered %d files", len(x.known))
+	}
+	if _, ok := x.known["file0"]; ok {
+		t.Error("the file heard of longest ago was kept")
+	}
+	if len(x.list("keep.txt", "", pexMaxPeers)) != 1 {
+		t.Error("a file heard of recently was dropped")
+	}
+}
+
+func TestShutdownDropsTrackerConnection(t *testing.T) {
+	tracker := startFakeTracker(t)
+	peer := startPeer(t, tracker, false)
+
+	tracker.lock.Lock()
+	held := tracker.listeners[net.JoinHostPort("127.0.0.1", peer.port)]
+	tracker.lock.Unlock()
+
+	peer.shutdown(time.Second)
+	held.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := held.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the held connection wasn't closed: %v", err)
+	}
+}
+
+// startQueue runs a download queue on a peer with no trackers that knows of a seeder of
+// movie.bin, and returns the file's content. Downloads are slowed down so they can be
+// paused mid-way.
+func startQueue(t *testing.T, statePath string) (*downloadQueue, []byte) {
+	t.Helper()
+	seeder := startDHTPeer(t)
+	seeder.dht = nil
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16*ChunkSize/16)
+	path := filepath.Join(t.TempDir(), "movie.bin")
+	err := os.WriteFile(path, content, 0644)
+	if err == nil {
+		_, err = seeder.shareFile(path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloader := NewP2PPeer()
+	t.Cleanup(func() { downloader.shutdown(5 * time.Second) })
+	downloader.limiter.setDownloadLimit(8 * ChunkSize)
+	downloader.pex.add("movie.bin", []string{net.JoinHostPort("127.0.0.1", seeder.port)})
+	q, err := newDownloadQueue(downloader, 2, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go q.run()
+	return q, content
+}
+
+// waitForState waits until a download reaches a state
+func waitForState(t *testing.T, q *downloadQueue, id int, state string) queuedDownload {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		item, _ := q.get(id)
+		if item.State == state {
+			return item
+		}
+	}
+	item, _ := q.get(id)
+	t.Fatalf("download %d is %s, not %s", id, item.State, state)
+	return item
+}
+
+func TestQueuePauseAndResumeWhileRunning(t *testing.T) {
+	q, content := startQueue(t, "")
+	target := filepath.Join(t.TempDir(), "movie.bin")
+	item := q.add("movie.bin", target, 0)
+	waitForState(t, q, item.ID, downloadRunning)
+
+	// Resuming before the paused download has stopped must not start it twice
+	for range 3 {
+		if _, err := q.pause(item.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.resume(item.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForState(t, q, item.ID, downloadDone)
+	data, _ := os.ReadFile(target)
+	if !bytes.Equal(data, content) {
+		t.Errorf("downloaded %d bytes that don't match the %d shared", len(data), len(content))
+	}
+}
+
+func TestQueueCancelWhilePausing(t *testing.T) {
+	q, _ := startQueue(t, "")
+	target := filepath.Join(t.TempDir(), "movie.bin")
+	item := q.add("movie.bin", target, 0)
+	waitForState(t, q, item.ID, downloadRunning)
+
+	q.pause(item.ID)
+	if _, err := q.cancel(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.resume(item.ID); err == nil {
+		t.Error("a cancelled download was resumed")
+	}
+
+	// Once the download has stopped, what arrived of it is deleted
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		q.lock.Lock()
+		stopped := q.running == 0
+		q.lock.Unlock()
+		if stopped {
+			break
+		}
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("the partial file is still there: %v", err)
+	}
+}
+
+func TestQueueRunsOneDownloadPerPath(t *testing.T) {
+	q, content := startQueue(t, "")
+	target := filepath.Join(t.TempDir(), "movie.bin")
+	first := q.add("movie.bin", target, 0)
+	second := q.add("movie.bin", target, 0)
+	waitForState(t, q, first.ID, downloadRunning)
+	if item, _ := q.get(second.ID); item.State != downloadQueued {
+		t.Errorf("a second download to the same path is %s", item.State)
+	}
+
+	waitForState(t, q, first.ID, downloadDone)
+	waitForState(t, q, second.ID, downloadDone)
+	data, _ := os.ReadFile(target)
+	if !bytes.Equal(data, content) {
+		t.Error("the downloaded file doesn't match")
+	}
+}
+
+func TestQueueRestoresSavedState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "queue.json")
+	saved := `[{"id": 3, "request": "a.txt", "path": "a.txt", "state": "running"},
+		{"id": 7, "request": "b.txt", "path": "b.txt", "state": "paused", "priority": 5},
+		{"id": 4, "request": "c.txt", "path": "c.txt", "state": "done"}]`
+	if err := os.WriteFile(statePath, []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := newDownloadQueue(NewP2PPeer(), 1, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := q.list()
+	if len(items) != 3 || items[0].State != downloadQueued || items[1].State != downloadPaused || items[1].Priority != 5 || items[2].State != downloadDone {
+		t.Errorf("restored %+v", items)
+	}
+	if added := q.add("d.txt", "", 0); added.ID != 8 {
+		t.Errorf("a new download got ID %d after the saved ones", added.ID)
+	}
+
+	// Changes are saved for the next start
+	q.pause(3)
+	again, err := newDownloadQueue(NewP2PPeer(), 1, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := again.get(3); item.State != downloadPaused {
+		t.Errorf("a download paused before a restart is %s", item.State)
+	}
+	if len(again.list()) != 4 {
+		t.Errorf("%d downloads after a restart", len(again.list()))
+	}
+
+	if err := os.WriteFile(statePath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDownloadQueue(NewP2PPeer(), 1, statePath); err == nil {
+		t.Error("a broken queue file was accepted")
+	}
+}
+
+// startSwarmPeer runs a reachable peer in a private swarm until the test ends
+func startSwarmPeer(t *testing.T, swarm *swarmCredentials) *P2PPeer {
+	t.Helper()
+	peer := NewP2PPeer()
+	peer.swarm = swarm
+	port, err := peer.startPeerServer("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.port = port
+	t.Cleanup(peer.stop)
+	return peer
+}
+
+func TestPrivateSwarmPeersTurnAwayOutsiders(t *testing.T) {
+	ownerToken := swarmToken("team", "secret", time.Now().Add(time.Hour))
+	sharer := startSwarmPeer(t, &swarmCredentials{id: "team", key: "secret"})
+	fileName := shareTestFile(t, sharer)
+	address := net.JoinHostPort("127.0.0.1", sharer.port)
+
+	outsiders := map[string]*swarmCredentials{
+		"public peer":   nil,
+		"other swarm":   {id: "qa", key: "secret"},
+		"wrong key":     {id: "team", key: "guess"},
+		"expired token": {id: "team", token: swarmToken("team", "secret", time.Now().Add(-time.Minute))},
+	}
+	for name, swarm := range outsiders {
+		outsider := startSwarmPeer(t, swarm)
+		session, _, _, err := outsider.connectForDownload(address, fileName)
+		if err == nil {
+			session.conn.Close()
+			t.Errorf("%s was served by a private swarm's peer", name)
+		}
+	}
+
+	// Members with the key or a token from it get in, and the token holder serves whoever
+	// shows the same token
+	for name, swarm := range map[string]*swarmCredentials{
+		"key holder":   {id: "team", key: "secret"},
+		"token holder": {id: "team", token: ownerToken},
+	} {
+		member := startSwarmPeer(t, swarm)
+		checkReached(t, member, sharer, fileName)
+		if name == "token holder" {
+			shareTestFile(t, member)
+			checkReached(t, startSwarmPeer(t, &swarmCredentials{id: "team", key: "secret", token: ownerToken}), member, fileName)
+		}
+	}
+
+	// Nor does a swarm member fetch from a peer outside it
+	public := startSwarmPeer(t, nil)
+	shareTestFile(t, public)
+	member := startSwarmPeer(t, &swarmCredentials{id: "team", key: "secret"})
+	session, _, _, err := member.connectForDownload(net.JoinHostPort("127.0.0.1", public.port), fileName)
+	if err == nil {
+		session.conn.Close()
+		t.Error("a swarm member fetched from a public peer")
+	}
+}
+
+// pipeSessions returns an outgoing session reading in the background and the remote end
+// of its connection, both closed when the test ends
+func pipeSessions(t *testing.T) (*peerSession, *peerSession) {
+	t.Helper()
+	local, remote := net.Pipe()
+	session := newPeerSession(local)
+	session.startReading()
+	t.Cleanup(func() {
+		session.conn.Close()
+		remote.Close()
+	})
+	return session, newPeerSession(remote)
+}
+
+func TestRequestBitfieldChecksSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		bitfield []byte
+		ok       bool
+	}{
+		{"3000", []byte{0xe0}, true},
+		{"0", []byte{}, true},
+		{"-1", []byte{}, false},
+		{strconv.FormatInt(maxFileSize+1, 10), make([]byte, maxMessageSize), false},
+		{"1 << 62", []byte{0xe0}, false},
+		{"3000", []byte{0xe0, 0}, false},
+		{"9000", []byte{0xe0}, false},
+	}
+	peer := NewP2PPeer()
+	for _, tt := range tests {
+		session, remote := pipeSessions(t)
+		go func() {
+			remote.receive()
+			remote.send("BITFIELD", tt.bitfield, "movie.bin", tt.size)
+		}()
+		_, _, err := peer.requestBitfield(session, "movie.bin")
+		if (err == nil) != tt.ok {
+			t.Errorf("size %s with a %d byte bitfield: err = %v", tt.size, len(tt.bitfield), err)
+		}
+	}
+}
+
+func TestRequestChunkChecksLength(t *testing.T) {
+	peer := NewP2PPeer()
+	d := &activeDownload{fileName: "movie.bin", size: 2*ChunkSize + 100}
+	tests := []struct {
+		chunk  int
+		length int
+		ok     bool
+	}{
+		{0, ChunkSize, true},
+		{2, 100, true},
+		{0, ChunkSize - 1, false},
+		{1, 0, false},
+		{2, ChunkSize, false},
+	}
+	for _, tt := range tests {
+		session, remote := pipeSessions(t)
+		session.choked = false
+		go func() {
+			remote.receive()
+			remote.send("PIECE", make([]byte, tt.length), "movie.bin", strconv.Itoa(tt.chunk))
+		}()
+		_, err := peer.requestChunk(session, d, tt.chunk)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d bytes for chunk %d: err = %v", tt.length, tt.chunk, err)
+		}
+	}
+}
+
+func TestClosedSessionStopsReading(t *testing.T) {
+	session, remote := pipeSessions(t)
+
+	// The peer keeps pushing messages nobody reads until the session is closed
+	go func() {
+		for remote.send("HAVE", nil, "movie.bin", "1") == nil {
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	session.conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-session.incoming:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("reading went on after the session was closed")
+		}
+	}
+}
+
+func TestChunkSchedulerPicksRarestFirst(t *testing.T) {
+	s := newChunkScheduler(3)
+	s.addPeer("a", []bool{true, true, true})
+	s.addPeer("b", []bool{true, true, false})
+	s.addPeer("c", []bool{true, false, false})
+
+	// Only a has chunk 2, then chunk 1 is the rarer of what is left
+	for _, want := range []int{2, 1, 0} {
+		chunk, ok := s.next("a")
+		if !ok || chunk != want {
+			t.Fatalf("a was asked for chunk %d, %v; want %d", chunk, ok, want)
+		}
+	}
+}
+
+func TestChunkSchedulerEndgame(t *testing.T) {
+	s := newChunkScheduler(2)
+	s.addPeer("a", []bool{true, true})
+	s.addPeer("b", []bool{true, true})
+	first, _ := s.next("a")
+	second, _ := s.next("a")
+
+	// Every chunk is on its way, so b is asked for the same chunks instead of idling
+	duplicate, ok := s.next("b")
+	if !ok || (duplicate != first && duplicate != second) {
+		t.Fatalf("b was asked for chunk %d, %v in endgame", duplicate, ok)
+	}
+	if !s.finish(duplicate) || s.finish(duplicate) {
+		t.Error("a chunk delivered twice was finished twice")
+	}
+	s.finish(first + second - duplicate)
+	if !s.complete() {
+		t.Error("download not complete with every chunk finished")
+	}
+	if _, ok := s.next("b"); ok {
+		t.Error("b was asked for a chunk of a complete download")
+	}
+}
+
+func TestChunkSchedulerStallsWithoutPeers(t *testing.T) {
+	s := newChunkScheduler(2)
+	s.addPeer("a", []bool{true, false})
+	if s.stalled() {
+		t.Fatal("stalled while a has a chunk we need")
+	}
+	chunk, _ := s.next("a")
+
+	// Once a leaves, its request is released and nobody has what is missing
+	s.removePeer("a")
+	if !s.stalled() {
+		t.Error("not stalled with no peer holding a missing chunk")
+	}
+	s.addPeer("b", []bool{true, true})
+	if next, ok := s.next("b"); !ok || s.stalled() {
+		t.Errorf("b was asked for chunk %d, %v after a gave up chunk %d", next, ok, chunk)
+	}
+}
+
+func TestDHTStoreChecksAnnouncements(t *testing.T) {
+	node := startDHTPeer(t)
+	sender := startDHTPeer(t)
+	address := net.JoinHostPort("127.0.0.1", node.port)
+	sum := sha256.Sum256([]byte("song.mp3 content"))
+	hash := hex.EncodeToString(sum[:])
+	byName := hex.EncodeToString(nameKey("song.mp3"))
+
+	tests := []struct {
+		key, hash, name string
+		stored          bool
+	}{
+		{byName, hash, "song.mp3", true},
+		{hex.EncodeToString(contentKey(hash)), hash, "song.mp3", true},
+		{byName, "song.mp3", "song.mp3", false},
+		{hex.EncodeToString(nameKey("other.mp3")), hash, "song.mp3", false},
+		{hex.EncodeToString(nameKey("a\nb")), hash, "a\nb", false},
+		{hex.EncodeToString(nameKey("../song.mp3")), hash, "../song.mp3", false},
+	}
+	for _, tt := range tests {
+		reply, err := sender.dht.call(address, "STORE", tt.key, tt.hash, tt.name)
+		if err != nil || (reply.kind == "STORED") != tt.stored {
+			t.Errorf("STORE %q under %s: %s, %v", tt.name, tt.key[:8], reply.kind, err)
+		}
+	}
+}
+
+func TestDHTStoreCaps(t *testing.T) {
+	d := newDHTNode(NewP2PPeer())
+	provider := func(host string, port int) dhtProvider {
+		return dhtProvider{address: net.JoinHostPort(host, strconv.Itoa(port)), expires: time.Now().Add(time.Hour)}
+	}
+
+	// One host can only fill its share, though refreshing what it stored still works
+	for i := range dhtMaxHostValues {
+		if !d.store(strconv.Itoa(i), provider("10.0.0.1", 1000)) {
+			t.Fatalf("store %d from one host refused", i)
+		}
+	}
+	if d.store("more", provider("10.0.0.1", 1000)) {
+		t.Error("a host stored more than its share")
+	}
+	if !d.store("0", provider("10.0.0.1", 1000)) {
+		t.Error("refreshing a stored provider was refused")
+	}
+
+	// A key holds only so many providers
+	for i := range dhtMaxKeyProviders {
+		d.store("popular", provider(fmt.Sprintf("10.1.%d.%d", i/256, i%256), 1000))
+	}
+	if d.store("popular", provider("10.2.0.1", 1000)) {
+		t.Error("a key stored more than its share")
+	}
+
+	// Expired providers make room
+	expired := provider("10.0.0.1", 1000)
+	expired.expires = time.Now().Add(-time.Second)
+	d.values["0"][expired.address] = expired
+	if !d.store("more", provider("10.0.0.1", 1000)) {
+		t.Error("an expired provider didn't make room")
+	}
+}
+
+func TestChunkHashesNeedAMajority(t *testing.T) {
+	honest := bytes.Repeat([]byte{1}, sha256.Size)
+	forged := bytes.Repeat([]byte{2}, sha256.Size)
+	tests := []struct {
+		name  string
+		lists [][]byte // nil for a peer without the hashes
+		want  []byte
+	}{
+		{"one list", [][]byte{honest}, honest},
+		{"majority", [][]byte{honest, honest, forged}, honest},
+		{"majority of those answering", [][]byte{honest, honest, nil, forged}, honest},
+		{"tie", [][]byte{honest, forged}, nil},
+		{"no majority", [][]byte{honest, forged, nil, bytes.Repeat([]byte{3}, sha256.Size)}, nil},
+		{"nobody has them", [][]byte{nil, nil}, nil},
+	}
+	peer := NewP2PPeer()
+	for _, tt := range tests {
+		var sessions []*peerSession
+		var bitfields [][]byte
+		for _, list := range tt.lists {
+			session, remote := pipeSessions(t)
+			go func() {
+				remote.receive()
+				if list == nil {
+					remote.send("NO_HASHES", nil, "movie.bin")
+					return
+				}
+				remote.send("HASHES", list, "movie.bin")
+			}()
+			sessions = append(sessions, session)
+			bitfields = append(bitfields, []byte{0x80})
+		}
+		got := peer.agreeOnChunkHashes("movie.bin", sessions, bitfields, 1)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: agreed on %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// encryptTestFile encrypts size bytes of content and returns the plaintext and the path
+// of the encrypted file
+func encryptTestFile(t *testing.T, size int, secret fileSecret) ([]byte, string) {
+	t.Helper()
+	dir := t.TempDir()
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	src := filepath.Join(dir, "plain.bin")
+	err := os.WriteFile(src, content, 0644)
+	if err == nil {
+		err = encryptFile(src, src+encryptedSuffix, secret)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, src + encryptedSuffix
+}
+
+// checkDecryptFails decrypts a file expecting an error and nothing left behind
+func checkDecryptFails(t *testing.T, what string, path string, secret fileSecret) {
+	t.Helper()
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	if err := decryptFile(path, dst, secret); err == nil {
+		t.Errorf("%s decrypted", what)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("%s left a file behind", what)
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := fileSecret{key: bytes.Repeat([]byte{7}, 32)}
+	for _, size := range []int{0, 1, encryptedRecord, 3*encryptedRecord + 5} {
+		content, encrypted := encryptTestFile(t, size, key)
+		dst := filepath.Join(t.TempDir(), "out.bin")
+		err := decryptFile(encrypted, dst, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		decrypted, _ := os.ReadFile(dst)
+		if !bytes.Equal(decrypted, content) {
+			t.Errorf("%d bytes came back as %d different ones", size, len(decrypted))
+		}
+	}
+
+	content, encrypted := encryptTestFile(t, 100, fileSecret{passphrase: "correct horse"})
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	err := decryptFile(encrypted, dst, fileSecret{passphrase: "correct horse"})
+	decrypted, _ := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(decrypted, content) {
+		t.Errorf("passphrase round trip: %v", err)
+	}
+}
+
+func TestDecryptionNeedsTheSecret(t *testing.T) {
+	key := fileSecret{key: bytes.Repeat([]byte{7}, 32)}
+	_, byKey := encryptTestFile(t, 100, key)
+	_, byPassphrase := encryptTestFile(t, 100, fileSecret{passphrase: "correct horse"})
+
+	checkDecryptFails(t, "a wrong key", byKey, fileSecret{key: bytes.Repeat([]byte{8}, 32)})
+	checkDecryptFails(t, "a passphrase for a key", byKey, fileSecret{passphrase: "correct horse"})
+	checkDecryptFails(t, "a wrong passphrase", byPassphrase, fileSecret{passphrase: "battery staple"})
+	checkDecryptFails(t, "a key for a passphrase", byPassphrase, key)
+}
+
+func TestDecryptionCatchesTampering(t *testing.T) {
+	key := fileSecret{key: bytes.Repeat([]byte{7}, 32)}
+	headerSize := len(encryptedMagic) + 1 + 4 + 16
+	sealedRecord := encryptedRecord + 16
+	_, encrypted := encryptTestFile(t, 2*encryptedRecord+5, key)
+	data, _ := os.ReadFile(encrypted)
+	tampered := func(name string, data []byte) string {
+		path := filepath.Join(t.TempDir(), name)
+		os.WriteFile(path, data, 0644)
+		return path
+	}
+
+	// Cut after a full record, which isn't flagged as the last
+	checkDecryptFails(t, "a truncated file", tampered("cut", data[:headerSize+sealedRecord]), key)
+	checkDecryptFails(t, "a file cut inside a record", tampered("cut", data[:len(data)-3]), key)
+
+	// Records in another order
+	swapped := append([]byte{}, data[:headerSize]...)
+	swapped = append(swapped, data[headerSize+sealedRecord:headerSize+2*sealedRecord]...)
+	swapped = append(swapped, data[headerSize:headerSize+sealedRecord]...)
+	swapped = append(swapped, data[headerSize+2*sealedRecord:]...)
+	checkDecryptFails(t, "reordered records", tampered("swapped", swapped), key)
+
+	// The header of another file encrypted with the same key
+	_, other := encryptTestFile(t, 2*encryptedRecord+5, key)
+	otherData, _ := os.ReadFile(other)
+	mixed := append(append([]byte{}, otherData[:headerSize]...), data[headerSize:]...)
+	checkDecryptFails(t, "a swapped header", tampered("mixed", mixed), key)
+
+	// A flipped bit
+	flipped := append([]byte{}, data...)
+	flipped[headerSize+10] ^= 1
+	checkDecryptFails(t, "a flipped bit", tampered("flipped", flipped), key)
+}
+
+func TestPassphrasePromptsShareInput(t *testing.T) {
+	// Both lines arrive at once, as when typed ahead or pasted
+	stdin := bufio.NewReader(strings.NewReader("correct horse\ncorrect horse\n"))
+	first, err := readPassphrase(stdin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := readPassphrase(stdin, "")
+	if err != nil || first != "correct horse" || again != first {
+		t.Errorf("read %q then %q, %v", first, again, err)
+	}
+}
+
+// signedManifest returns a manifest of a file signed with key, encoded as peers send it
+func signedManifest(t *testing.T, key ed25519.PrivateKey, name string, content string) (*fileManifest, []byte) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	m := &fileManifest{Name: name, Size: int64(len(content)), Hash: hex.EncodeToString(sum[:]), Publisher: "Release Eng"}
+	m.sign(key)
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, data
+}
+
+func TestCheckManifest(t *testing.T) {
+	_, trustedKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	m, _ := signedManifest(t, trustedKey, "app.tar", "release")
+	peer := NewP2PPeer()
+	peer.trusted = map[string]string{m.Key: "Release Eng"}
+
+	if err := peer.checkManifest(m, "app.tar", "", m.Size); err != nil {
+		t.Errorf("requested by name: %v", err)
+	}
+	if err := peer.checkManifest(m, "renamed.tar", m.Hash, m.Size); err != nil {
+		t.Errorf("requested by hash: %v", err)
+	}
+
+	untrusted, _ := signedManifest(t, otherKey, "app.tar", "release")
+	if peer.checkManifest(untrusted, "app.tar", "", untrusted.Size) == nil {
+		t.Error("accepted a manifest from an untrusted key")
+	}
+	if peer.checkManifest(m, "other.tar", "", m.Size) == nil {
+		t.Error("accepted a manifest for another file name")
+	}
+	if peer.checkManifest(m, "app.tar", strings.Repeat("0", 64), m.Size) == nil {
+		t.Error("accepted a manifest for another hash")
+	}
+	if peer.checkManifest(m, "app.tar", "", m.Size+1) == nil {
+		t.Error("accepted a manifest for another size")
+	}
+
+	// Changing anything signed breaks the signature
+	for field, tamper := range map[string]func(m *fileManifest){
+		"name":      func(m *fileManifest) { m.Name = "evil.tar" },
+		"size":      func(m *fileManifest) { m.Size++ },
+		"hash":      func(m *fileManifest) { m.Hash = strings.Repeat("0", 64) },
+		"publisher": func(m *fileManifest) { m.Publisher = "Someone Else" },
+	} {
+		forged := *m
+		tamper(&forged)
+		data, _ := json.Marshal(forged)
+		if _, err := parseManifest(data); err == nil {
+			t.Errorf("a manifest with a tampered %s verified", field)
+		}
+	}
+}
+
+func TestTrustedDownloadChecksContentHash(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	for _, tt := range []struct {
+		signed string // Content the manifest was signed for
+		ok     bool
+	}{
+		{"Roses are red\n", true},
+		{"Roses are RED\n", false}, // Same size and name, other content
+	} {
+		seeder := startSwarmPeer(t, nil)
+		fileName := shareTestFile(t, seeder)
+		m, data := signedManifest(t, key, fileName, tt.signed)
+		seeder.lookupFile(fileName).setManifest(data)
+
+		downloader := startSwarmPeer(t, nil)
+		downloader.trusted = map[string]string{m.Key: "Release Eng"}
+		path := filepath.Join(t.TempDir(), fileName)
+		_, err := downloader.downloadFile(downloader.ctx, fileName, path, []string{net.JoinHostPort("127.0.0.1", seeder.port)}, "")
+		if (err == nil) != tt.ok {
+			t.Errorf("manifest signed for %q: err = %v", tt.signed, err)
+		}
+		if _, statErr := os.Stat(path); !tt.ok && !os.IsNotExist(statErr) {
+			t.Error("a download that doesn't match its signed hash was kept")
+		}
+	}
+}
+
+func TestPublisherLabels(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	peer := NewP2PPeer()
+	fileName := shareTestFile(t, peer)
+	m, data := signedManifest(t, key, fileName, "Roses are red\n")
+	signer := publisherIdentity(m.Publisher, m.Key)
+	listed := []string{signer, "Mallory (0123456789abcdef)"}
+
+	if got := peer.publisherLabels(fileName, listed); got != signer+" (unverified), Mallory (0123456789abcdef) (unverified)" {
+		t.Errorf("without a manifest: %q", got)
+	}
+	peer.lookupFile(fileName).setManifest(data)
+	if got := peer.publisherLabels(fileName, listed); got != signer+", Mallory (0123456789abcdef) (unverified)" {
+		t.Errorf("with our checked manifest: %q", got)
+	}
+}
+
+func TestTrackerFailoverAndBackoff(t *testing.T) {
+	// The first tracker of the tier is down, so the peer fails over to the second
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddress := listener.Addr().String()
+	listener.Close()
+	backup := startFakeTracker(t)
+	down := &trackerEndpoint{}
+	down.host, down.port, _ = net.SplitHostPort(downAddress)
+	up := &trackerEndpoint{}
+	up.host, up.port, _ = net.SplitHostPort(backup.address)
+
+	peer := NewP2PPeer()
+	peer.port = "7000"
+	peer.trackers = &trackerList{tiers: [][]*trackerEndpoint{{down, up}}}
+	peer.announce("poem.txt")
+	backup.received(t, "REGISTER:poem.txt:7000")
+
+	// The failed tracker backs off, and the one that answered is tried first
+	if candidates := peer.trackers.candidates(0); len(candidates) != 1 || candidates[0] != up {
+		t.Errorf("candidates while the first tracker backs off: %v", candidates)
+	}
+	if health := peer.trackers.health(); len(health) != 2 || !health[0].Reachable || health[1].Reachable {
+		t.Errorf("health while the first tracker backs off: %+v", health)
+	}
+	firstRetry := down.retryAt
+	peer.trackers.failed(down, errors.New("still down"))
+	if !down.retryAt.After(firstRetry) || down.failures != 2 {
+		t.Errorf("backoff didn't grow: failures %d, retry at %v after %v", down.failures, down.retryAt, firstRetry)
+	}
+
+	// Trackers that are backing off still hear that the peer stops sharing and leaves,
+	// as they may have listed it before they failed
+	revived := startFakeTrackerAt(t, downAddress)
+	peer.unshare("poem.txt")
+	peer.leaveTrackers()
+	for _, tracker := range []*fakeTracker{backup, revived} {
+		tracker.received(t, "UNREGISTER:poem.txt:7000")
+		tracker.received(t, "EXIT:7000")
+	}
+
+	// Once it answers again, the tracker is healthy
+	peer.trackers.succeeded(0, down)
+	if candidates := peer.trackers.candidates(0); len(candidates) != 2 || candidates[0] != down {
+		t.Errorf("candidates after the first tracker recovers: %v", candidates)
+	}
+}
+
+func TestLANDiscoveryForgetsSilentHosts(t *testing.T) {
+	l := newLANDiscovery()
+	if addrs := l.waitForTrackers(20 * time.Millisecond); addrs != nil {
+		t.Fatalf("found trackers before any announced: %v", addrs)
+	}
+
+	// A tracker is new only the first time it announces itself, and wakes up waiters
+	found := make(chan []string)
+	go func() { found <- l.waitForTrackers(5 * time.Second) }()
+	if !l.addTracker("192.168.1.5:8080") || l.addTracker("192.168.1.5:8080") {
+		t.Error("addTracker didn't report only the first announcement as new")
+	}
+	if addrs := <-found; len(addrs) != 1 || addrs[0] != "192.168.1.5:8080" {
+		t.Errorf("waitForTrackers returned %v", addrs)
+	}
+
+	// Hosts that stopped announcing themselves are dropped
+	l.addPeer("192.168.1.7:6000")
+	l.addPeer("192.168.1.8:6000")
+	l.lock.Lock()
+	l.peers["192.168.1.8:6000"] = time.Now().Add(-discoveryTTL - time.Second)
+	l.trackers["192.168.1.5:8080"] = time.Now().Add(-discoveryTTL - time.Second)
+	l.lock.Unlock()
+	if addrs := l.peerAddresses(); len(addrs) != 1 || addrs[0] != "192.168.1.7:6000" {
+		t.Errorf("peerAddresses returned %v", addrs)
+	}
+	if addrs := l.trackerAddresses(); len(addrs) != 0 {
+		t.Errorf("trackerAddresses returned %v", addrs)
+	}
+	if len(l.peers) != 1 || len(l.trackers) != 0 {
+		t.Errorf("kept %d peers and %d trackers", len(l.peers), len(l.trackers))
+	}
+}
+
+func TestTrackerAddressesPerFamily(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		want []string
+	}{
+		{"127.0.0.1", []string{"127.0.0.1:31000"}},
+		{"::1", []string{"[::1]:31000"}},
+		{"no-such-tracker.invalid", []string{"no-such-tracker.invalid:31000"}}, // Dialing reports the error
+	} {
+		if got := trackerAddresses(tt.host, "31000"); !slices.Equal(got, tt.want) {
+			t.Errorf("trackerAddresses(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadOverIPv6(t *testing.T) {
+	if listener, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback on this host")
+	} else {
+		listener.Close()
+	}
+	sharer := startSwarmPeer(t, nil)
+	fileName := shareTestFile(t, sharer)
+	downloader := startSwarmPeer(t, nil)
+
+	path := filepath.Join(t.TempDir(), fileName)
+	_, err := downloader.downloadFile(downloader.ctx, fileName, path, []string{net.JoinHostPort("::1", sharer.port)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "Roses are red\n" {
+		t.Errorf("downloaded %q", data)
+	}
+}
+
+func TestParseCommandLineTakesFlagsAnywhere(t *testing.T) {
+	fs := commandFlags("get", "[flags] <file>")
+	fs.SetOutput(io.Discard)
+	output := fs.String("o", "", "")
+	asJSON := fs.Bool("json", false, "")
+
+	positional, err := parseCommandLine(fs, []string{"-json", "poem.txt", "-o", "out.txt", "extra"})
+	if err != nil || !slices.Equal(positional, []string{"poem.txt", "extra"}) || *output != "out.txt" || !*asJSON {
+		t.Errorf("parsed %v, -o %q, -json %v, err %v", positional, *output, *asJSON, err)
+	}
+	if _, err := parseCommandLine(fs, []string{"poem.txt", "-nope"}); usageError(err) != exitUsage {
+		t.Errorf("an unknown flag gave %v", err)
+	}
+	if _, err := parseCommandLine(fs, []string{"-h"}); usageError(err) != exitOK {
+		t.Errorf("-h gave %v", err)
+	}
+}
+
+// captureStdout runs fn and returns what it printed
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	printed := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-printed)
+}
+
+func TestKeygenCommand(t *testing.T) {
+	var code int
+	printed := captureStdout(t, func() { code = runKeygen(nil) })
+	if key, err := hex.DecodeString(strings.TrimSpace(printed)); code != exitOK || err != nil || len(key) != 32 {
+		t.Errorf("keygen exited %d and printed %q", code, printed)
+	}
+
+	// A signing key goes to the file, and its public key is printed for peers to trust
+	path := filepath.Join(t.TempDir(), "publisher.key")
+	printed = captureStdout(t, func() { code = runKeygen([]string{"-sign", "-o", path}) })
+	seed, err := os.ReadFile(path)
+	if code != exitOK || err != nil {
+		t.Fatalf("keygen -sign exited %d, reading the key: %v", code, err)
+	}
+	seed, _ = hex.DecodeString(strings.TrimSpace(string(seed)))
+	public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if strings.TrimSpace(printed) != hex.EncodeToString(public) {
+		t.Errorf("keygen -sign printed %q", printed)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode is %v", info.Mode().Perm())
+	}
+
+	for _, args := range [][]string{{"-sign"}, {"extra"}, {"-bogus"}} {
+		stderr := os.Stderr
+		os.Stderr, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0) // Usage goes here
+		code = runKeygen(args)
+		os.Stderr.Close()
+		os.Stderr = stderr
+		if code != exitUsage {
+			t.Errorf("keygen %v exited %d", args, code)
+		}
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	peer := startSwarmPeer(t, nil)
+	queue, err := newDownloadQueue(peer, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listenControl("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &controlServer{peer: peer, queue: queue, token: "s3cret"}
+	go server.serve(listener)
+	base := "http://" + listener.Addr().String()
+
+	call := func(method string, path string, body string, change func(r *http.Request)) (int, string) {
+		t.Helper()
+		r, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		if method != "GET" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		if change != nil {
+			change(r)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		answer, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(answer)
+	}
+
+	// Requests from other users, other sites and rebound host names are turned away
+	for name, change := range map[string]func(r *http.Request){
+		"no token":       func(r *http.Request) { r.Header.Del("Authorization") },
+		"a wrong token":  func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") },
+		"a foreign host": func(r *http.Request) { r.Host = "evil.example:80" },
+	} {
+		if code, _ := call("GET", "/status", "", change); code != http.StatusUnauthorized && code != http.StatusForbidden {
+			t.Errorf("a request with %s got %d", name, code)
+		}
+	}
+	form := func(r *http.Request) { r.Header.Set("Content-Type", "application/x-www-form-urlencoded") }
+	if code, _ := call("POST", "/shares", `{"path": "/etc/passwd"}`, form); code != http.StatusUnsupportedMediaType {
+		t.Errorf("a form post got %d", code)
+	}
+
+	// Sharing, listing and unsharing a file
+	path := filepath.Join(t.TempDir(), "poem.txt")
+	os.WriteFile(path, []byte("Roses are red\n"), 0644)
+	body, _ := json.Marshal(map[string]string{"path": path})
+	if code, answer := call("POST", "/shares", string(body), nil); code != http.StatusOK || !strings.Contains(answer, `"name":"poem.txt"`) {
+		t.Errorf("POST /shares got %d %s", code, answer)
+	}
+	var status daemonStatus
+	_, answer := call("GET", "/status", "", nil)
+	if json.Unmarshal([]byte(answer), &status) != nil || status.Shares != 1 || status.PeerID != peer.id {
+		t.Errorf("GET /status got %s", answer)
+	}
+	if code, _ := call("DELETE", "/shares/poem.txt", "", nil); code != http.StatusNoContent || peer.lookupFile("poem.txt") != nil {
+		t.Errorf("DELETE /shares/poem.txt got %d", code)
+	}
+	if code, _ := call("DELETE", "/shares/poem.txt", "", nil); code != http.StatusNotFound {
+		t.Errorf("deleting an unshared file got %d", code)
+	}
+
+	// Queueing a download, and asking for one that doesn't exist
+	if code, answer := call("POST", "/downloads", `{"file": "song.mp3", "priority": 2}`, nil); code != http.StatusCreated || !strings.Contains(answer, `"priority":2`) {
+		t.Errorf("POST /downloads got %d %s", code, answer)
+	}
+	if code, _ := call("POST", "/downloads", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("a download without a file got %d", code)
+	}
+	if code, _ := call("GET", "/downloads/99", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET /downloads/99 got %d", code)
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	for _, tt := range []struct {
+		event progressEvent
+		want  string
+	}{
+		{progressEvent{File: "movie.bin", Bytes: 0, Size: 4 << 20, ETA: -1},
+			"movie.bin [>                   ]   0% 0B/4.0MB 0B/s ETA --:-- 0 peers"},
+		{progressEvent{File: "movie.bin", Bytes: 1 << 20, Size: 4 << 20, Rate: 512 << 10, ETA: 6, Peers: []string{"a", "b"}},
+			"movie.bin [=====>              ]  25% 1.0MB/4.0MB 512.0KB/s ETA 00:06 2 peers"},
+		{progressEvent{File: "movie.bin", Bytes: 4 << 20, Size: 4 << 20, ETA: 0},
+			"movie.bin [====================] 100% 4.0MB/4.0MB 0B/s ETA 00:00 0 peers"},
+		{progressEvent{File: "empty", ETA: 3725},
+			"empty [====================] 100% 0B/0B 0B/s ETA 62:05 0 peers"},
+	} {
+		if got := formatProgress(tt.event); got != tt.want {
+			t.Errorf("formatProgress(%+v)\n got %q\nwant %q", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestProgressHubKeepsRunningDownloads(t *testing.T) {
+	h := newProgressHub()
+	events, stop := h.watch(4)
+
+	h.publish(progressEvent{Path: "/b", State: progressRunning, Bytes: 1})
+	h.publish(progressEvent{Path: "/a", State: progressRunning, Bytes: 2})
+	h.publish(progressEvent{Path: "/b", State: progressRunning, Bytes: 3})
+	if current := h.current(); len(current) != 2 || current[0].Path != "/a" || current[1].Bytes != 3 {
+		t.Errorf("current is %+v", current)
+	}
+
+	// Finished downloads are dropped, and the watcher saw every event but the one that didn't fit
+	h.publish(progressEvent{Path: "/a", State: progressComplete})
+	h.publish(progressEvent{Path: "/b", State: progressStopped})
+	if _, ok := h.get("/a"); ok || len(h.current()) != 0 {
+		t.Errorf("kept finished downloads: %+v", h.current())
+	}
+	stop()
+	var seen []int64
+	for e := range events {
+		seen = append(seen, e.Bytes)
+	}
+	if !slices.Equal(seen, []int64{1, 2, 3, 0}) {
+		t.Errorf("watcher received bytes %v", seen)
+	}
+	stop() // Stopping twice is harmless
+}
+
+func TestDownloadReportsProgress(t *testing.T) {
+	seeder := startSwarmPeer(t, nil)
+	fileName := shareTestFile(t, seeder)
+	downloader := startSwarmPeer(t, nil)
+	events, stop := downloader.progress.watch(64)
+	defer stop()
+
+	path := filepath.Join(t.TempDir(), fileName)
+	_, err := downloader.downloadFile(downloader.ctx, fileName, path, []string{net.JoinHostPort("127.0.0.1", seeder.port)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Path != path || e.State == progressRunning {
+				continue
+			}
+			if e.State != progressComplete || e.Bytes != e.Size || e.Size != int64(len("Roses are red\n")) {
+				t.Errorf("final event %+v", e)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no final progress event")
+		}
+	}
+}
@@ -1,28 +1,214 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	gossipInterval  = 2 * time.Second  // How often the index is exchanged with another tracker
+	registrationTTL = 30 * time.Minute // How long a registration lasts unless the peer registers the file again
+	maxClockSkew    = time.Minute      // How far apart the clocks of a cluster's trackers may be
+
+	discoveryGroup    = "239.255.42.99:29393" // UDP multicast group trackers and peers announce themselves on
+	discoveryInterval = 5 * time.Second       // How often the tracker announces itself on the LAN
+
+	shutdownTimeout = 10 * time.Second    // Default limit on waiting for requests in progress when stopping
+	requestTimeout  = 10 * time.Second    // How long a client may take to send its request and read the answer
+	maxGossipSize   = 16 << 20            // Largest index accepted from another tracker
+	connectBackRate = 30                  // Most connect-back requests passed on for one host per minute
+	reportInterval  = time.Minute         // How often turned away connections are reported
+	recentActivity  = 100                 // Registrations, exits and admin actions kept for the dashboard
+	tokenTTL        = 30 * 24 * time.Hour // Default lifetime of the swarm tokens made with -mint-token
+)
+
+// logger receives everything the tracker logs. It discards until main or an embedding
+// program sets one with SetLogger, so the tracker writes nothing on its own.
+var logger = slog.New(slog.DiscardHandler)
+
+// SetLogger sends the tracker's logs to l. Call it before starting the tracker.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 // Tracker represents a simple peer-to-peer tracker.
 // It maintains a map of peers and the files they have.
 type Tracker struct {
-	peers map[string][]string // Map of peer addresses to their files
-	lock  sync.Mutex          // Mutex for safe concurrent access to the peers map
+	peers         map[string][]string     // Map of peer addresses to their files
+	lock          sync.Mutex              // Mutex for safe concurrent access to the peers map
+	registrations map[string]registration // Latest change to every peer/file pair, for replication
+	cluster       []string                // Addresses of the other trackers this one replicates with
+	clusterSecret []byte                  // Key gossip is authenticated with, if the cluster shares one
+	advertise     bool                    // Announce the tracker on the local network
+	listeners     map[string]net.Conn     // Open connections of peers behind NAT, by their registered address
+	handlers      sync.WaitGroup          // Connections being handled
+	stopTimeout   time.Duration           // How long Start waits for handlers once its context is cancelled
+	connLimits    *connLimiter            // Caps on the connections handled at once
+	access        *accessList             // Hosts allowed and denied by the access file
+	metrics       *metricsRegistry        // Counters and gauges served at /metrics
+	banned        map[string]time.Time    // Hosts refused by the admin, by IP, and when they were banned
+	activity      []activity              // Recent registrations, exits and admin actions, oldest first
+	swarms        map[string]string       // Keys of the private swarms, by swarm ID
+	connectBacks  map[string]requestCount // Connect-back requests in the current minute, by requester IP
+}
+
+// requestCount is how many requests a host made since a minute began
+type requestCount struct {
+	since time.Time
+	count int
+}
+
+// registration is one peer/file pair of the index and when it last changed.
+// Trackers in a cluster merge their indexes pair by pair, and the latest change wins.
+type registration struct {
+	Peer    string `json:"peer"`
+	File    string `json:"file"`
+	Updated int64  `json:"updated"` // Unix time in nanoseconds of the change
+	Removed bool   `json:"removed"` // The peer no longer has the file
+
+	Publisher string `json:"publisher,omitempty"` // Publisher named by the file's signed manifest, if any
+	Key       string `json:"key,omitempty"`       // Publisher's public key, hex encoded
+	Manifest  string `json:"manifest,omitempty"`  // The signed manifest, base64 encoded, so other trackers can check it
 }
 
 // NewTracker creates and returns a new Tracker instance.
 // It initializes the peers map and the mutex lock.
 func NewTracker() *Tracker {
-	return &Tracker{
-		peers: make(map[string][]string),
-		lock:  sync.Mutex{},
+	t := &Tracker{
+		peers:         make(map[string][]string),
+		lock:          sync.Mutex{},
+		registrations: make(map[string]registration),
+		listeners:     make(map[string]net.Conn),
+		banned:        make(map[string]time.Time),
+		swarms:        make(map[string]string),
+		connectBacks:  make(map[string]requestCount),
+		stopTimeout:   shutdownTimeout,
+		connLimits:    newConnLimiter(0, 0),
+		access:        &accessList{temporary: make(map[string]time.Time)},
+		metrics: newMetricsRegistry(
+			metricFamily{"tracker_registered_peers", "gauge", "Peers with at least one registered file.", ""},
+			metricFamily{"tracker_files", "gauge", "Distinct files registered by peers.", ""},
+			metricFamily{"tracker_requests_total", "counter", "Requests handled, by type.", "type"},
+			metricFamily{"tracker_request_duration_seconds", "histogram", "Time taken to answer requests, by type.", "type"},
+			metricFamily{"tracker_errors_total", "counter", "Errors, by kind.", "kind"},
+			metricFamily{"tracker_connections_active", "gauge", "Connections being handled.", ""},
+			metricFamily{"tracker_connections_rejected_total", "counter", "Connections turned away, by reason.", "reason"},
+			metricFamily{"tracker_connections_timed_out_total", "counter", "Connections closed for missing a deadline.", ""},
+		),
+	}
+	t.metrics.collect = t.collectMetrics
+	return t
+}
+
+// collectMetrics sets the gauges derived from the index and the connection limiter
+func (t *Tracker) collectMetrics() {
+	t.lock.Lock()
+	files := make(map[string]bool)
+	for _, peerFiles := range t.peers {
+		for _, f := range peerFiles {
+			files[f] = true
+		}
+	}
+	peers := len(t.peers)
+	t.lock.Unlock()
+
+	active, rejectedFull, rejectedPerIP, timedOut := t.connLimits.stats()
+	t.metrics.set("tracker_registered_peers", float64(peers))
+	t.metrics.set("tracker_files", float64(len(files)))
+	t.metrics.set("tracker_connections_active", float64(active))
+	t.metrics.set("tracker_connections_rejected_total", float64(rejectedFull), label("reason", "limit"))
+	t.metrics.set("tracker_connections_rejected_total", float64(rejectedPerIP), label("reason", "per_ip"))
+	t.metrics.set("tracker_connections_timed_out_total", float64(timedOut))
+}
+
+// swarmRequests gives how many fields the requests that can be made in a private swarm
+// have. In a swarm they end with two more: the swarm ID and a token for it.
+var swarmRequests = map[string]int{"REGISTER": 3, "PUBLISH": 4, "UNREGISTER": 3, "REQUEST_FILE": 2, "REQUEST_PEERS": 2, "LIST_FILES": 1}
+
+// swarmFile returns the name a file of a swarm is indexed under. Files of private swarms
+// are kept apart as "<swarm>/<file>", and those of the public swarm keep their name.
+func swarmFile(swarm string, fileName string) string {
+	if swarm == "" {
+		return fileName
+	}
+	return swarm + "/" + fileName
+}
+
+// authorizeSwarm reports whether a token lets its bearer into a private swarm
+func (t *Tracker) authorizeSwarm(swarm string, token string) bool {
+	key, ok := t.swarms[swarm]
+	expiry, _, found := strings.Cut(token, ".")
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || !found || err != nil || time.Now().Unix() > seconds {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(swarmToken(swarm, key, time.Unix(seconds, 0))))
+}
+
+// readSwarms reads the private swarms from a file of "<swarm ID> <key>" lines. Blank
+// lines and lines starting with # are skipped.
+func readSwarms(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	swarms := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || strings.ContainsAny(fields[0], ":/") {
+			return nil, fmt.Errorf("%s: line %d: expected a swarm ID without : or / and a key", path, n+1)
+		}
+		swarms[fields[0]] = fields[1]
+	}
+	return swarms, nil
+}
+
+// decodeManifest reads a signed manifest sent base64 encoded, checking its signature
+func decodeManifest(encoded string) (*fileManifest, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var m fileManifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, m.verify()
+}
+
+// requestKind names a request for metrics, keeping unknown ones from adding series
+func requestKind(message string) string {
+	kind, _, _ := strings.Cut(message, ":")
+	switch kind {
+	case "REGISTER", "PUBLISH", "UNREGISTER", "REQUEST_FILE", "REQUEST_PEERS", "LIST_FILES", "LISTEN", "CONNECT_BACK", "EXIT", "GOSSIP":
+		return kind
 	}
+	return "UNKNOWN"
 }
 
 // handleConnection manages a single peer connection.
@@ -31,39 +217,139 @@ func (t *Tracker) handleConnection(conn net.Conn) {
 	defer conn.Close()                     // Ensure the connection is closed after the function returns
 	peerAddr := conn.RemoteAddr().String() // Get the address of the connected peer
 
-	buffer := make([]byte, 1024) // Buffer to store incoming data
+	// Clients that send or read slowly are cut off rather than tying up the tracker
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	buffer := make([]byte, 1024) // Buffer to store incoming data, which also caps the request size
 	n, err := conn.Read(buffer)  // Read data from the connection
 	if err != nil {
-		fmt.Println("Error reading:", err.Error())
+		t.connLimits.countTimeout(err)
+		t.metrics.add("tracker_errors_total", 1, label("kind", "read"))
+		logger.Error("Error reading request", "peer", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	message := string(buffer[:n]) // Convert the buffer bytes into a string
+
+	// Count the request and time the answer; held connections aren't timed
+	kind := requestKind(message)
+	start := time.Now()
+	defer func() {
+		t.metrics.add("tracker_requests_total", 1, label("type", kind))
+		if kind != "LISTEN" {
+			t.metrics.observe("tracker_request_duration_seconds", time.Since(start), label("type", kind))
+		}
+	}()
+
+	// Index exchanges from other trackers carry JSON, so handle them before splitting on ":"
+	if strings.HasPrefix(message, "GOSSIP:") {
+		t.handleGossip(conn, buffer[len("GOSSIP:"):n])
+		return
+	}
+
+	// Connect-back requests carry addresses, so they are split on spaces instead
+	if strings.HasPrefix(message, "CONNECT_BACK:") {
+		t.handleConnectBack(conn, peerAddr, message[len("CONNECT_BACK:"):])
 		return
 	}
 
-	message := string(buffer[:n])        // Convert the buffer bytes into a string
 	parts := strings.Split(message, ":") // Split the message into parts using ":" as the delimiter
 
-	// Handle message based on its type
-	if parts[0] == "REGISTER" && len(parts) == 3 {
-		fileName := parts[1] // Extract the file name
-		peerPort := parts[2] // Extract the peer's server port
+	// Requests made in a private swarm end with the swarm ID and a token for it
+	swarm := ""
+	if fields, ok := swarmRequests[parts[0]]; ok && len(parts) == fields+2 {
+		swarm = parts[fields]
+		if !t.authorizeSwarm(swarm, parts[fields+1]) {
+			t.metrics.add("tracker_errors_total", 1, label("kind", "swarm"))
+			logger.Warn("Refused a request for a private swarm", "peer", peerAddr, "swarm", swarm, "request", parts[0])
+			conn.Write([]byte("DENIED"))
+			return
+		}
+		parts = parts[:fields]
+	}
+
+	// Files of private swarms are indexed as "<swarm>/<file>", so a file name with a "/"
+	// would reach into a swarm without its token
+	if fields := swarmRequests[parts[0]]; fields > 1 && len(parts) > 1 && strings.ContainsAny(parts[1], "/:") {
+		t.metrics.add("tracker_errors_total", 1, label("kind", "file_name"))
+		conn.Write([]byte("INVALID"))
+		return
+	}
+
+	// Registered names are listed to every peer, so they must be names a peer could save
+	// a file under, without control characters that would garble its terminal
+	if (parts[0] == "REGISTER" || parts[0] == "PUBLISH") && len(parts) > 1 && !isFileName(parts[1]) {
+		t.metrics.add("tracker_errors_total", 1, label("kind", "file_name"))
+		conn.Write([]byte("INVALID"))
+		return
+	}
 
-		// Store the peer's IP address and port as a single string
-		peerIP := strings.Split(peerAddr, ":")[0]
-		peerInfo := peerIP + ":" + peerPort
+	// Handle message based on its type.
+	// PUBLISH is REGISTER with the file's signed manifest, which names its publisher.
+	if parts[0] == "REGISTER" && len(parts) == 3 || parts[0] == "PUBLISH" && len(parts) == 4 {
+		fileName := swarmFile(swarm, parts[1]) // Extract the file name
+		peerPort := parts[2]                   // Extract the peer's server port
 
-		// Update the tracker's peers map with the new information
+		// Store the peer's IP address and port as a single string; IPv6 hosts get brackets
+		peerIP, _, _ := net.SplitHostPort(peerAddr)
+		peerInfo := net.JoinHostPort(peerIP, peerPort)
+
+		r := registration{Peer: peerInfo, File: fileName, Updated: time.Now().UnixNano()}
+		if parts[0] == "PUBLISH" {
+			m, err := decodeManifest(parts[3])
+			if err == nil && m.Name != parts[1] {
+				err = errors.New("manifest is for another file")
+			}
+			if err != nil {
+				t.metrics.add("tracker_errors_total", 1, label("kind", "manifest"))
+				logger.Warn("Refused a file with a bad manifest", "peer", peerInfo, "file", fileName, "err", err)
+				conn.Write([]byte("INVALID"))
+				return
+			}
+			r.Publisher, r.Key, r.Manifest = m.Publisher, m.Key, parts[3]
+		}
+
+		// Update the tracker's peers map with the new information. Peers register their
+		// files again every few minutes to keep them from expiring, which isn't news.
 		t.lock.Lock()
-		t.peers[peerInfo] = append(t.peers[peerInfo], fileName)
+		current, known := t.registrations[peerInfo+"|"+fileName]
+		refreshed := known && !current.Removed
+		t.apply(r)
+		if !refreshed {
+			t.record("registered", peerInfo, fileName)
+		}
 		t.lock.Unlock()
 
 		// Log the new registration
-		fmt.Println("Peer", peerInfo, "has file:", fileName)
+		if refreshed {
+			logger.Debug("Peer registered a file again", "peer", peerInfo, "file", fileName)
+		} else if r.Publisher != "" {
+			logger.Info("Peer registered a file", "peer", peerInfo, "file", fileName, "publisher", publisherIdentity(r.Publisher, r.Key))
+		} else {
+			logger.Info("Peer registered a file", "peer", peerInfo, "file", fileName)
+		}
 
 		// Send a response back to the peer
 		conn.Write([]byte("OK"))
 	}
 
+	if parts[0] == "UNREGISTER" && len(parts) == 3 {
+		// The peer stopped sharing one file but keeps the rest
+		peerIP, _, _ := net.SplitHostPort(peerAddr)
+		peerInfo := net.JoinHostPort(peerIP, parts[2])
+		fileName := swarmFile(swarm, parts[1])
+
+		t.lock.Lock()
+		t.apply(registration{Peer: peerInfo, File: fileName, Updated: time.Now().UnixNano(), Removed: true})
+		t.record("unregistered", peerInfo, fileName)
+		t.lock.Unlock()
+
+		logger.Info("Peer unregistered a file", "peer", peerInfo, "file", fileName)
+		conn.Write([]byte("OK"))
+	}
+
 	if parts[0] == "REQUEST_FILE" && len(parts) == 2 {
-		fileName := parts[1]                     // Extract the file name
+		fileName := swarmFile(swarm, parts[1])   // Extract the file name
 		peerList := t.getPeersWithFile(fileName) // Get a list of peers that have the file
 		if len(peerList) > 0 {
 			rand.Seed(time.Now().UnixNano())          // Seed the random number generator
@@ -74,15 +360,145 @@ func (t *Tracker) handleConnection(conn net.Conn) {
 		}
 	}
 
-	if parts[0] == "EXIT" {
+	if parts[0] == "REQUEST_PEERS" && len(parts) == 2 {
+		fileName := swarmFile(swarm, parts[1])   // Extract the file name
+		peerList := t.getPeersWithFile(fileName) // Get a list of peers that have the file
+		if len(peerList) > 0 {
+			conn.Write([]byte(strings.Join(peerList, ","))) // Send every peer so the chunks can be fetched from all of them
+		} else {
+			conn.Write([]byte("NO_PEER")) // Send a response indicating no peer has the file
+		}
+	}
+
+	if parts[0] == "LIST_FILES" && len(parts) == 1 {
+		// One "<file>:<number of peers>[:<publisher>,...]" line per file of the swarm, for peers to browse
+		conn.Write([]byte(strings.Join(t.fileCounts(swarm), "\n")))
+	}
+
+	if parts[0] == "LISTEN" && len(parts) == 2 {
+		// A peer behind NAT keeps this connection open so we can ask it to connect out
+		peerIP, _, _ := net.SplitHostPort(peerAddr)
+		peerInfo := net.JoinHostPort(peerIP, parts[1])
+
+		t.lock.Lock()
+		t.listeners[peerInfo] = conn
+		t.lock.Unlock()
+		logger.Info("Peer is waiting for connect-back requests", "peer", peerInfo)
+
+		// Hold the connection until the peer goes away
+		conn.SetDeadline(time.Time{})
+		io.Copy(io.Discard, conn)
+
+		t.lock.Lock()
+		if t.listeners[peerInfo] == conn {
+			delete(t.listeners, peerInfo)
+		}
+		t.lock.Unlock()
+		return
+	}
+
+	if parts[0] == "EXIT" && len(parts) == 2 {
+		// The connection comes from an ephemeral port, so the peer names its server port
+		peerIP, _, _ := net.SplitHostPort(peerAddr)
+		peerInfo := net.JoinHostPort(peerIP, parts[1])
+
 		// Handle peer exit
 		t.lock.Lock()
-		delete(t.peers, peerAddr) // Remove the peer from the tracker's map
+		t.removePeer(peerInfo) // Remove the peer from the tracker's map
+		t.record("exited", peerInfo, "")
 		t.lock.Unlock()
 
 		// Log the peer's exit
-		fmt.Println("Peer", peerAddr, "has exited")
+		logger.Info("Peer has exited", "peer", peerInfo)
+	}
+}
+
+// handleConnectBack passes a request to connect back on to a peer behind NAT.
+// The request is "<target> <reply address> <token> <file>", where the file may end with
+// ":<swarm ID>:<token>" like other requests; a reply address without a host means the
+// requester's own host. Only peers registered for the file are asked, so the tracker can't
+// be used to make any peer connect anywhere, and each host gets a few requests a minute.
+// We answer OK once the request is passed on.
+func (t *Tracker) handleConnectBack(conn net.Conn, peerAddr string, request string) {
+	fields := strings.SplitN(request, " ", 4)
+	if len(fields) != 4 {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+	target, replyAddress, token := fields[0], fields[1], fields[2]
+
+	// The file names the swarm it is in like the other requests do
+	parts := strings.Split(fields[3], ":")
+	swarm := ""
+	switch len(parts) {
+	case 1:
+	case 3:
+		swarm = parts[1]
+		if !t.authorizeSwarm(swarm, parts[2]) {
+			t.metrics.add("tracker_errors_total", 1, label("kind", "swarm"))
+			conn.Write([]byte("DENIED"))
+			return
+		}
+	default:
+		conn.Write([]byte("NO_PEER"))
+		return
 	}
+	fileName := swarmFile(swarm, parts[0])
+
+	host, port, err := net.SplitHostPort(replyAddress)
+	if err != nil {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+	requester, _, _ := net.SplitHostPort(peerAddr)
+	if host == "" {
+		host = requester
+		replyAddress = net.JoinHostPort(host, port)
+	}
+
+	t.lock.Lock()
+	allowed := t.countConnectBack(requester)
+	listener := t.listeners[target]
+	if !slices.Contains(t.peers[target], fileName) {
+		listener = nil
+	}
+	t.lock.Unlock()
+	if !allowed {
+		t.metrics.add("tracker_errors_total", 1, label("kind", "connect_back_rate"))
+		logger.Warn("Too many connect-back requests", "peer", requester)
+		conn.Write([]byte("DENIED"))
+		return
+	}
+	if listener == nil {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+
+	_, err = listener.Write([]byte("CONNECT " + replyAddress + " " + token + "\n"))
+	if err != nil {
+		conn.Write([]byte("NO_PEER"))
+		return
+	}
+	logger.Info("Asked peer to connect back", "peer", target, "to", replyAddress)
+	conn.Write([]byte("OK"))
+}
+
+// countConnectBack counts a connect-back request from a host and reports whether it is
+// within the host's allowance for the minute. Caller must hold the lock.
+func (t *Tracker) countConnectBack(host string) bool {
+	now := time.Now()
+	for h, c := range t.connectBacks {
+		if now.Sub(c.since) >= time.Minute {
+			delete(t.connectBacks, h)
+		}
+	}
+	c, ok := t.connectBacks[host]
+	if !ok {
+		c.since = now
+	}
+	c.count++
+	t.connectBacks[host] = c
+	return c.count <= connectBackRate
 }
 
 // getPeersWithFile returns a slice of peers that have the specified file.
@@ -92,6 +508,9 @@ func (t *Tracker) getPeersWithFile(fileName string) []string {
 
 	var peerList []string // Initialize an empty slice for peers with the file
 	for peer, files := range t.peers {
+		if !t.access.allowsAddress(peer) {
+			continue // Denied since it registered
+		}
 		for _, f := range files {
 			if f == fileName {
 				peerList = append(peerList, peer) // Add the peer to the list if they have the file
@@ -102,36 +521,960 @@ func (t *Tracker) getPeersWithFile(fileName string) []string {
 	return peerList
 }
 
-// Start begins the tracker server on the specified host and port.
-// It listens for incoming connections and handles them.
-func (t *Tracker) Start(host string, port string) {
-	listener, err := net.Listen("tcp", host+":"+port) // Start listening on the specified host and port
+// fileCounts returns "<file>:<number of peers>" for every file registered in a swarm,
+// ordered by name. Files with signed manifests get ":<publisher>,..." added.
+func (t *Tracker) fileCounts(swarm string) []string {
+	t.lock.Lock()
+	counts := make(map[string]int)
+	publishers := make(map[string][]string)
+	for _, files := range t.peers {
+		for _, f := range files {
+			in, name, private := strings.Cut(f, "/")
+			if !private {
+				in, name = "", f
+			}
+			if in == swarm && counts[name] == 0 {
+				publishers[name] = t.publishers(f)
+			}
+			if in == swarm {
+				counts[name]++
+			}
+		}
+	}
+	t.lock.Unlock()
+
+	lines := make([]string, 0, len(counts))
+	for file, count := range counts {
+		line := file + ":" + strconv.Itoa(count)
+		if len(publishers[file]) > 0 {
+			line += ":" + strings.Join(publishers[file], ",")
+		}
+		lines = append(lines, line)
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// manifestNames reports whether the registration carries a valid manifest of its file,
+// signed by the publisher it names
+func manifestNames(r registration) bool {
+	if r.Manifest == "" {
+		return false
+	}
+	m, err := decodeManifest(r.Manifest)
+	if err != nil {
+		return false
+	}
+	_, name, private := strings.Cut(r.File, "/")
+	if !private {
+		name = r.File
+	}
+	return m.Name == name && m.Publisher == r.Publisher && m.Key == r.Key
+}
+
+// publishers returns who the peers sharing a file say published it, by the signed
+// manifests they registered it with. Caller must hold the lock.
+func (t *Tracker) publishers(file string) []string {
+	var publishers []string
+	for peer, files := range t.peers {
+		r, ok := t.registrations[peer+"|"+file]
+		if ok && r.Publisher != "" && slices.Contains(files, file) {
+			identity := publisherIdentity(r.Publisher, r.Key)
+			if !slices.Contains(publishers, identity) {
+				publishers = append(publishers, identity)
+			}
+		}
+	}
+	slices.Sort(publishers)
+	return publishers
+}
+
+// apply merges a change into the index if it is newer than what we have.
+// A removal wins over a registration made at the same instant. Registrations of banned
+// and denied hosts are ignored, including those from other trackers, and so are expired
+// ones and changes dated further ahead than the clocks may be apart. Caller must hold the lock.
+func (t *Tracker) apply(r registration) bool {
+	if !r.Removed && (t.isBanned(r.Peer) || !t.access.allowsAddress(r.Peer)) {
+		return false
+	}
+	now := time.Now()
+	if r.Updated > now.Add(maxClockSkew).UnixNano() || (!r.Removed && r.Updated < now.Add(-registrationTTL).UnixNano()) {
+		return false
+	}
+	key := r.Peer + "|" + r.File
+	current, ok := t.registrations[key]
+	if ok && (r.Updated < current.Updated || (r.Updated == current.Updated && (current.Removed || !r.Removed))) {
+		return false
+	}
+
+	// A publisher is only kept if the manifest it came with is signed by it, for this file
+	if r.Removed || !manifestNames(r) {
+		r.Publisher, r.Key, r.Manifest = "", "", ""
+	}
+	t.registrations[key] = r
+	t.index(r)
+	return true
+}
+
+// index brings the peers map in line with a change. Caller must hold the lock.
+func (t *Tracker) index(r registration) {
+	files := t.peers[r.Peer]
+	for i, f := range files {
+		if f == r.File {
+			files = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	if !r.Removed {
+		files = append(files, r.File)
+	}
+	if len(files) == 0 {
+		delete(t.peers, r.Peer)
+	} else {
+		t.peers[r.Peer] = files
+	}
+}
+
+// removePeer records that a peer left, so the removal also reaches the other trackers.
+// Caller must hold the lock.
+func (t *Tracker) removePeer(peer string) {
+	now := time.Now().UnixNano()
+	for _, file := range append([]string(nil), t.peers[peer]...) {
+		t.apply(registration{Peer: peer, File: file, Updated: now, Removed: true})
+	}
+}
+
+// snapshot returns every registration and removal the tracker knows of
+func (t *Tracker) snapshot() []registration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	changes := make([]registration, 0, len(t.registrations))
+	for _, r := range t.registrations {
+		changes = append(changes, r)
+	}
+	return changes
+}
+
+// merge applies changes received from another tracker and returns how many were new
+func (t *Tracker) merge(changes []registration) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	applied := 0
+	for _, r := range changes {
+		if t.apply(r) {
+			applied++
+		}
+	}
+	return applied
+}
+
+// expire drops registrations the peer didn't renew within registrationTTL. Every replica
+// drops them at the same time, so removals only have to be remembered until the
+// registrations they remove have expired everywhere: for registrationTTL, plus the time
+// another tracker's clock may lag behind ours. A replica cut off for longer can't bring
+// a removed registration back, since apply refuses expired ones.
+func (t *Tracker) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for key, r := range t.registrations {
+		if r.Removed && r.Updated < now.Add(-registrationTTL-maxClockSkew).UnixNano() {
+			delete(t.registrations, key)
+		}
+		if !r.Removed && r.Updated < now.Add(-registrationTTL).UnixNano() {
+			delete(t.registrations, key)
+			t.index(registration{Peer: r.Peer, File: r.File, Removed: true})
+		}
+	}
+}
+
+// isClusterMember reports whether a host is one of the trackers of the cluster,
+// looking up their names again in case their addresses changed
+func (t *Tracker) isClusterMember(host string) bool {
+	for _, address := range t.cluster {
+		memberHost, _, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupHost(memberHost)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip).Equal(net.ParseIP(host)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sealGossip prepares an index for another tracker. With a cluster secret it is
+// preceded by its HMAC-SHA256, hex encoded, and a ":".
+func (t *Tracker) sealGossip(index []byte) []byte {
+	if t.clusterSecret == nil {
+		return index
+	}
+	mac := hmac.New(sha256.New, t.clusterSecret)
+	mac.Write(index)
+	return append([]byte(hex.EncodeToString(mac.Sum(nil))+":"), index...)
+}
+
+// openGossip decodes an index from another tracker, checking its HMAC if the cluster
+// shares a secret
+func (t *Tracker) openGossip(data []byte) ([]registration, error) {
+	if t.clusterSecret != nil {
+		sum, index, ok := strings.Cut(string(data), ":")
+		mac := hmac.New(sha256.New, t.clusterSecret)
+		mac.Write([]byte(index))
+		given, err := hex.DecodeString(sum)
+		if !ok || err != nil || !hmac.Equal(given, mac.Sum(nil)) {
+			return nil, errors.New("gossip is not signed with the cluster secret")
+		}
+		data = []byte(index)
+	}
+	var changes []registration
+	err := json.Unmarshal(data, &changes)
+	return changes, err
+}
+
+// handleGossip merges the index another tracker pushed and answers with our own,
+// so both sides end up with the union of their changes.
+// Only the trackers named by -cluster may gossip, since their changes are taken as is.
+func (t *Tracker) handleGossip(conn net.Conn, start []byte) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !t.isClusterMember(host) {
+		t.metrics.add("tracker_errors_total", 1, label("kind", "gossip"))
+		logger.Warn("Refused gossip from a host outside the cluster", "host", host)
+		conn.Write([]byte("DENIED"))
+		return
+	}
+
+	// The sender closes its side once the whole index is written
+	rest, err := io.ReadAll(io.LimitReader(conn, maxGossipSize))
+	if err != nil {
+		t.connLimits.countTimeout(err)
+		t.metrics.add("tracker_errors_total", 1, label("kind", "gossip"))
+		logger.Error("Error reading gossip", "tracker", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	changes, err := t.openGossip(append(start, rest...))
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+		t.metrics.add("tracker_errors_total", 1, label("kind", "gossip"))
+		logger.Error("Error decoding gossip", "tracker", conn.RemoteAddr().String(), "err", err)
+		conn.Write([]byte("DENIED"))
 		return
 	}
-	defer listener.Close() // Ensure the listener is closed when the function returns
+	if applied := t.merge(changes); applied > 0 {
+		logger.Debug("Replicated changes", "tracker", conn.RemoteAddr().String(), "changes", applied)
+	}
+
+	reply, _ := json.Marshal(t.snapshot())
+	conn.Write(t.sealGossip(reply))
+}
+
+// syncWith exchanges indexes with another tracker in the cluster
+func (t *Tracker) syncWith(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	// Log that the tracker is running
-	fmt.Println("Tracker running on " + host + ":" + port)
+	payload, _ := json.Marshal(t.snapshot())
+	_, err = conn.Write(append([]byte("GOSSIP:"), t.sealGossip(payload)...))
+	if err != nil {
+		return err
+	}
+	conn.(*net.TCPConn).CloseWrite() // Tell the other tracker the index is complete
+
+	reply, err := io.ReadAll(io.LimitReader(conn, maxGossipSize))
+	if err != nil {
+		return err
+	}
+	if string(reply) == "DENIED" {
+		return errors.New("tracker refused our gossip")
+	}
+	changes, err := t.openGossip(reply)
+	if err != nil {
+		return err
+	}
+	if applied := t.merge(changes); applied > 0 {
+		logger.Debug("Replicated changes", "tracker", address, "changes", applied)
+	}
+	return nil
+}
 
+// gossip periodically expires stale registrations and syncs with a random tracker of
+// the cluster so that every tracker converges on the same index and can answer any request
+func (t *Tracker) gossip(ctx context.Context) {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.expire()
+		if len(t.cluster) == 0 {
+			continue
+		}
+		address := t.cluster[rand.Intn(len(t.cluster))]
+		err := t.syncWith(address)
+		if err != nil {
+			t.metrics.add("tracker_errors_total", 1, label("kind", "gossip"))
+			logger.Warn("Error syncing with tracker", "tracker", address, "err", err)
+		}
+	}
+}
+
+// Start begins the tracker server on the specified host and port.
+// It listens for incoming connections and handles them until ctx is cancelled, then
+// closes its listeners and waits a while for the requests in progress.
+// The host may be a comma separated list, and a name is listened on at every address
+// it resolves to, so one tracker can serve IPv4 and IPv6 peers alike.
+func (t *Tracker) Start(ctx context.Context, host string, port string) {
+	var listeners []net.Listener
+	for _, address := range listenAddresses(host) {
+		listener, err := net.Listen("tcp", net.JoinHostPort(address, port)) // Start listening on the specified host and port
+		if err != nil {
+			logger.Error("Error listening", "address", net.JoinHostPort(address, port), "err", err)
+			continue
+		}
+		defer listener.Close() // Ensure the listener is closed when the function returns
+		listeners = append(listeners, listener)
+
+		// Log that the tracker is running
+		logger.Info("Tracker running", "address", net.JoinHostPort(address, port))
+	}
+	if len(listeners) == 0 {
+		return
+	}
+
+	// Keep the index in sync with the rest of the cluster
+	if len(t.cluster) > 0 {
+		logger.Info("Replicating with trackers", "trackers", strings.Join(t.cluster, ","))
+	}
+	go t.gossip(ctx)
+	go t.reportRejections(ctx)
+	go t.access.watch(ctx)
+
+	// Let peers on the local network find the tracker without being told its address
+	if t.advertise {
+		go t.advertiseLAN(ctx, port)
+	}
+
+	// Closing the listeners ends the accept loops
+	go func() {
+		<-ctx.Done()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	var accepting sync.WaitGroup
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			t.acceptConnections(listener)
+		}(listener)
+	}
+	accepting.Wait()
+	t.stop()
+}
+
+// stop waits for the connections being handled once the listeners are closed.
+// Peers behind NAT hold their connections open, so those are closed first.
+func (t *Tracker) stop() {
+	t.lock.Lock()
+	for _, conn := range t.listeners {
+		conn.Close()
+	}
+	t.lock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.handlers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		logger.Info("Tracker stopped")
+	case <-time.After(t.stopTimeout):
+		logger.Warn("Tracker stopped with requests still in progress", "timeout", t.stopTimeout)
+	}
+}
+
+// listenAddresses expands the -host flag into the addresses to listen on. An empty
+// host stays empty, which listens on every interface of both IP families.
+func listenAddresses(host string) []string {
+	var addrs []string
+	for _, name := range strings.Split(host, ",") {
+		name = strings.TrimSpace(name)
+		resolved, err := net.LookupHost(name)
+		if name == "" || err != nil {
+			addrs = append(addrs, name)
+			continue
+		}
+		addrs = append(addrs, resolved...)
+	}
+	return addrs
+}
+
+// acceptConnections handles every connection made to one listener
+func (t *Tracker) acceptConnections(listener net.Listener) {
 	for {
 		conn, err := listener.Accept() // Accept new connections
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("Error accepting connection", "err", err)
+			continue
+		}
+
+		// Turn away banned hosts
+		t.lock.Lock()
+		banned := t.isBanned(conn.RemoteAddr().String())
+		t.lock.Unlock()
+		if banned {
+			t.metrics.add("tracker_connections_rejected_total", 1, label("reason", "banned"))
+			conn.Close()
+			continue
+		}
+		if !t.access.allowsAddress(conn.RemoteAddr().String()) {
+			t.metrics.add("tracker_connections_rejected_total", 1, label("reason", "denied"))
+			conn.Close()
+			continue
+		}
+
+		// Turn away connections beyond the limits rather than letting them pile up
+		if !t.connLimits.admit(conn) {
+			conn.Close()
 			continue
 		}
-		go t.handleConnection(conn) // Handle the connection
+
+		t.handlers.Add(1)
+		go func() {
+			defer t.handlers.Done()
+			defer t.connLimits.release(conn)
+			t.handleConnection(conn) // Handle the connection
+		}()
+	}
+}
+
+// reportRejections periodically logs the connections turned away or timed out, if any
+func (t *Tracker) reportRejections(ctx context.Context) {
+	var lastFull, lastPerIP, lastTimedOut int64
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		active, rejectedFull, rejectedPerIP, timedOut := t.connLimits.stats()
+		if rejectedFull == lastFull && rejectedPerIP == lastPerIP && timedOut == lastTimedOut {
+			continue
+		}
+		logger.Warn("Connections turned away", "active", active, "rejected_at_limit", rejectedFull-lastFull,
+			"rejected_per_ip", rejectedPerIP-lastPerIP, "timed_out", timedOut-lastTimedOut, "interval", reportInterval)
+		lastFull, lastPerIP, lastTimedOut = rejectedFull, rejectedPerIP, timedOut
+	}
+}
+
+// activity is one entry of the tracker's recent activity, shown on the admin dashboard
+type activity struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"` // registered, unregistered, exited, banned, unbanned or removed
+	Peer  string    `json:"peer"`
+	File  string    `json:"file,omitempty"`
+}
+
+// record adds an entry to the recent activity, dropping the oldest beyond recentActivity.
+// Caller must hold the lock.
+func (t *Tracker) record(event string, peer string, file string) {
+	t.activity = append(t.activity, activity{Time: time.Now(), Event: event, Peer: peer, File: file})
+	if len(t.activity) > recentActivity {
+		t.activity = t.activity[len(t.activity)-recentActivity:]
+	}
+}
+
+// isBanned reports whether a peer address or a bare IP is banned. Caller must hold the lock.
+func (t *Tracker) isBanned(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	_, banned := t.banned[host]
+	return banned
+}
+
+// ban refuses further connections from a host and drops every peer registered from it
+func (t *Tracker) ban(host string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.banned[host] = time.Now()
+	for peer := range t.peers {
+		if t.isBanned(peer) {
+			t.removePeer(peer)
+		}
+	}
+	for peer, conn := range t.listeners {
+		if t.isBanned(peer) {
+			conn.Close()
+		}
+	}
+	t.record("banned", host, "")
+	logger.Warn("Host banned", "host", host)
+}
+
+// unban lets a host connect again; it returns false if the host wasn't banned
+func (t *Tracker) unban(host string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.banned[host]; !ok {
+		return false
+	}
+	delete(t.banned, host)
+	t.record("unbanned", host, "")
+	logger.Info("Host unbanned", "host", host)
+	return true
+}
+
+// remove drops a peer's entries from the index, so stale peers stop being handed out;
+// it returns false if the peer had none
+func (t *Tracker) remove(peer string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.peers[peer]) == 0 {
+		return false
+	}
+	t.removePeer(peer)
+	t.record("removed", peer, "")
+	logger.Info("Peer removed by admin", "peer", peer)
+	return true
+}
+
+// adminPeer is a registered peer as shown on the admin dashboard
+type adminPeer struct {
+	Address    string    `json:"address"`
+	Files      []string  `json:"files"`
+	Registered time.Time `json:"registered"` // When the peer last registered a file
+	Listening  bool      `json:"listening"`  // Behind NAT and holding a connection for connect-back requests
+}
+
+// adminBan is a banned host as shown on the admin dashboard
+type adminBan struct {
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+// adminState is everything the admin dashboard shows
+type adminState struct {
+	Peers    []adminPeer `json:"peers"`
+	Files    []adminFile `json:"files"`
+	Banned   []adminBan  `json:"banned"`
+	Activity []activity  `json:"activity"` // Newest first
+	Trackers []string    `json:"trackers"` // Other trackers of the cluster
+}
+
+// adminFile is a file and the size of its swarm
+type adminFile struct {
+	Name       string   `json:"name"`
+	Peers      int      `json:"peers"`
+	Publishers []string `json:"publishers"` // Publishers named by the file's signed manifests; the content isn't checked against them
+}
+
+// adminState gathers the dashboard's view of the index
+func (t *Tracker) adminState() adminState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state := adminState{Peers: []adminPeer{}, Files: []adminFile{}, Banned: []adminBan{}, Activity: []activity{}, Trackers: append([]string{}, t.cluster...)}
+	swarms := make(map[string]int)
+	for peer, files := range t.peers {
+		p := adminPeer{Address: peer, Files: slices.Sorted(slices.Values(files))}
+		for _, f := range files {
+			swarms[f]++
+			if r, ok := t.registrations[peer+"|"+f]; ok && r.Updated > p.Registered.UnixNano() {
+				p.Registered = time.Unix(0, r.Updated)
+			}
+		}
+		_, p.Listening = t.listeners[peer]
+		state.Peers = append(state.Peers, p)
+	}
+	slices.SortFunc(state.Peers, func(a, b adminPeer) int { return strings.Compare(a.Address, b.Address) })
+	for name, count := range swarms {
+		state.Files = append(state.Files, adminFile{Name: name, Peers: count, Publishers: append([]string{}, t.publishers(name)...)})
+	}
+	slices.SortFunc(state.Files, func(a, b adminFile) int { return strings.Compare(a.Name, b.Name) })
+	for host, since := range t.banned {
+		state.Banned = append(state.Banned, adminBan{Host: host, Since: since})
+	}
+	slices.SortFunc(state.Banned, func(a, b adminBan) int { return strings.Compare(a.Host, b.Host) })
+	for i := len(t.activity) - 1; i >= 0; i-- {
+		state.Activity = append(state.Activity, t.activity[i])
+	}
+	return state
+}
+
+// adminServer serves the tracker's admin dashboard and the JSON API behind it
+type adminServer struct {
+	tracker *Tracker
+	token   string // Required with every request when set
+}
+
+// listenAdmin opens the dashboard's listener. Without a token it only listens on loopback
+// addresses, as anyone who can reach it can ban peers.
+func listenAdmin(address string, token string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("the admin dashboard needs -admin-token to listen on %s, which is not a loopback address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serve answers dashboard requests until ctx is cancelled
+func (s *adminServer) serve(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.page)
+	mux.HandleFunc("GET /api/state", s.state)
+	mux.HandleFunc("POST /api/peers/{peer}/ban", s.banPeer)
+	mux.HandleFunc("DELETE /api/peers/{peer}", s.removePeer)
+	mux.HandleFunc("POST /api/bans", s.addBan)
+	mux.HandleFunc("DELETE /api/bans/{host}", s.removeBan)
+
+	server := &http.Server{Handler: s.authorize(mux), ReadHeaderTimeout: requestTimeout}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("Serving admin dashboard", "address", listener.Addr().String())
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Error serving admin dashboard", "err", err)
+	}
+}
+
+// authorize checks the token, given as "Authorization: Bearer <token>" or, so the page
+// can be opened in a browser, as ?token=<token>. Without a token the dashboard is on
+// loopback, and requests must name a loopback host so pages whose name was rebound to
+// 127.0.0.1 can't reach it. Changes also need the X-Tracker-Admin header, which other
+// sites can't make a browser send.
+func (s *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				adminReply(w, http.StatusForbidden, map[string]string{"error": "requests must name a loopback host"})
+				return
+			}
+		} else {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if given == "" {
+				given = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+				adminReply(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong admin token"})
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Header.Get("X-Tracker-Admin") == "" {
+			adminReply(w, http.StatusForbidden, map[string]string{"error": "changes need the X-Tracker-Admin header"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminReply writes a JSON answer
+func adminReply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// page serves the dashboard itself
+func (s *adminServer) page(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, adminPage)
+}
+
+// state reports the peers, files, bans and recent activity
+func (s *adminServer) state(w http.ResponseWriter, r *http.Request) {
+	adminReply(w, http.StatusOK, s.tracker.adminState())
+}
+
+// banPeer bans the host of a registered peer
+func (s *adminServer) banPeer(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.PathValue("peer"))
+	if err != nil {
+		adminReply(w, http.StatusBadRequest, map[string]string{"error": "expected a peer address, host:port"})
+		return
+	}
+	s.tracker.ban(host)
+	adminReply(w, http.StatusOK, map[string]string{"banned": host})
+}
+
+// removePeer drops a stale peer from the index
+func (s *adminServer) removePeer(w http.ResponseWriter, r *http.Request) {
+	if !s.tracker.remove(r.PathValue("peer")) {
+		adminReply(w, http.StatusNotFound, map[string]string{"error": "no such peer"})
+		return
+	}
+	adminReply(w, http.StatusOK, map[string]string{"removed": r.PathValue("peer")})
+}
+
+// addBan bans a host by IP: {"host": "..."}
+func (s *adminServer) addBan(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Host string `json:"host"`
+	}
+	if json.NewDecoder(r.Body).Decode(&request) != nil || net.ParseIP(request.Host) == nil {
+		adminReply(w, http.StatusBadRequest, map[string]string{"error": `expected {"host": "<IP>"}`})
+		return
+	}
+	host := net.ParseIP(request.Host).String()
+	s.tracker.ban(host)
+	adminReply(w, http.StatusOK, map[string]string{"banned": host})
+}
+
+// removeBan lifts a ban
+func (s *adminServer) removeBan(w http.ResponseWriter, r *http.Request) {
+	if !s.tracker.unban(r.PathValue("host")) {
+		adminReply(w, http.StatusNotFound, map[string]string{"error": "host is not banned"})
+		return
+	}
+	adminReply(w, http.StatusOK, map[string]string{"unbanned": r.PathValue("host")})
+}
+
+// adminPage is the dashboard. It polls /api/state and calls the API for the admin
+// actions, passing on the token it was opened with.
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tracker</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; font-size: 0.9em; }
+th { background: #f4f4f4; }
+button { font-size: 0.8em; }
+.muted { color: #888; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Tracker</h1>
+<p id="summary" class="muted"></p>
+<p id="error"></p>
+<h2>Peers</h2>
+<table><thead><tr><th>Peer</th><th>Files</th><th>Registered</th><th>NAT</th><th></th></tr></thead><tbody id="peers"></tbody></table>
+<h2>Swarms</h2>
+<table><thead><tr><th>File</th><th>Peers</th><th>Publisher (unverified)</th></tr></thead><tbody id="files"></tbody></table>
+<h2>Banned hosts</h2>
+<form id="ban"><input id="host" placeholder="IP address"> <button>Ban</button></form>
+<table><thead><tr><th>Host</th><th>Since</th><th></th></tr></thead><tbody id="banned"></tbody></table>
+<h2>Recent activity</h2>
+<table><thead><tr><th>Time</th><th>Event</th><th>Peer</th><th>File</th></tr></thead><tbody id="activity"></tbody></table>
+<script>
+const token = new URLSearchParams(location.search).get("token") || "";
+const headers = {"X-Tracker-Admin": "1"};
+if (token) headers["Authorization"] = "Bearer " + token;
+
+function cell(text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  return td;
+}
+function button(label, action) {
+  const td = document.createElement("td");
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = action;
+  td.appendChild(b);
+  return td;
+}
+function ago(time) {
+  const seconds = Math.round((Date.now() - new Date(time)) / 1000);
+  if (seconds < 60) return seconds + "s ago";
+  if (seconds < 3600) return Math.round(seconds / 60) + "m ago";
+  return Math.round(seconds / 3600) + "h ago";
+}
+function fill(id, rows) {
+  const body = document.getElementById(id);
+  body.replaceChildren(...rows.map(cells => {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    return tr;
+  }));
+}
+async function call(method, path, body) {
+  const response = await fetch(path, {method, headers, body: body && JSON.stringify(body)});
+  if (!response.ok) {
+    document.getElementById("error").textContent = (await response.json()).error;
+  }
+  refresh();
+}
+async function refresh() {
+  const response = await fetch("/api/state", {headers});
+  const state = await response.json();
+  if (!response.ok) {
+    document.getElementById("error").textContent = state.error;
+    return;
+  }
+  document.getElementById("summary").textContent = state.peers.length + " peers, " + state.files.length + " files" +
+    (state.trackers && state.trackers.length ? ", replicating with " + state.trackers.join(", ") : "");
+  fill("peers", state.peers.map(p => [cell(p.address), cell(p.files.join(", ")), cell(ago(p.registered)),
+    cell(p.listening ? "connect-back" : ""),
+    button("Remove", () => call("DELETE", "/api/peers/" + encodeURIComponent(p.address))),
+    button("Ban", () => call("POST", "/api/peers/" + encodeURIComponent(p.address) + "/ban"))]));
+  fill("files", state.files.map(f => [cell(f.name), cell(f.peers), cell(f.publishers.join(", "))]));
+  fill("banned", state.banned.map(b => [cell(b.host), cell(ago(b.since)),
+    button("Unban", () => call("DELETE", "/api/bans/" + encodeURIComponent(b.host)))]));
+  fill("activity", state.activity.map(a => [cell(new Date(a.time).toLocaleTimeString()), cell(a.event), cell(a.peer), cell(a.file || "")]));
+}
+document.getElementById("ban").onsubmit = event => {
+  event.preventDefault();
+  call("POST", "/api/bans", {host: document.getElementById("host").value});
+};
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
+
+// advertiseLAN multicasts "P2P TRACKER <port>" so peers on the local network can find
+// the tracker; they take its address from the datagram's sender
+func (t *Tracker) advertiseLAN(ctx context.Context, port string) {
+	conn, err := net.Dial("udp4", discoveryGroup)
+	if err != nil {
+		logger.Error("Error announcing on the local network", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	announcement := []byte("P2P TRACKER " + port)
+	for {
+		conn.Write(announcement) // Lost announcements are simply repeated next time
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryInterval):
+		}
 	}
 }
 
 func main() {
+	// Feel free to change the tracker IP and tracker port based on your machine
+	trackerIP := flag.String("host", "localhost", "Comma separated addresses the tracker listens on (empty for every IPv4 and IPv6 interface)")
+	trackerPort := flag.String("port", "29392", "Port the tracker listens on")
+	cluster := flag.String("cluster", "", "Comma separated host:port list of the other trackers to replicate with")
+	clusterSecretFile := flag.String("cluster-secret-file", "", "File holding a secret shared by the cluster, which gossip is authenticated with")
+	lan := flag.Bool("lan", true, "Announce the tracker on the local network over UDP multicast")
+	maxConns := flag.Int("max-conns", 1024, "Most connections handled at once (0 = unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 32, "Most connections handled at once from one IP (0 = unlimited)")
+	swarmsFile := flag.String("swarms", "", "File of private swarms, one \"<swarm ID> <key>\" per line")
+	mintToken := flag.String("mint-token", "", "Print a token for this private swarm and exit")
+	mintTTL := flag.Duration("token-ttl", tokenTTL, "How long tokens made with -mint-token are good for")
+	accessFile := flag.String("access-file", "", "File of allow and deny rules for IPs and CIDRs, reloaded when it changes or on SIGHUP")
+	metricsAddress := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9100 (empty = off)")
+	adminAddress := flag.String("admin-addr", "", "Address to serve the admin dashboard on, e.g. 127.0.0.1:9200 (empty = off)")
+	adminToken := flag.String("admin-token", "", "Token the admin dashboard requires; needed to serve it on a non-loopback address")
+	stopTimeout := flag.Duration("shutdown-timeout", shutdownTimeout, "How long to wait for requests in progress when stopping")
+	logLevel := flag.String("log-level", "info", "Least severe log messages written: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logFile := flag.String("log-file", "", "File to append logs to (empty = stderr)")
+	flag.Parse()
+
+	l, err := newLogger(*logLevel, *logFormat, *logFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error setting up logging:", err.Error())
+		os.Exit(2)
+	}
+	SetLogger(l)
+
 	tracker := NewTracker() // Create a new instance of Tracker
+	tracker.advertise = *lan
+	tracker.stopTimeout = *stopTimeout
+	tracker.connLimits = newConnLimiter(*maxConns, *maxConnsPerIP)
+	tracker.access, err = newAccessList(*accessFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the access file:", err.Error())
+		os.Exit(2)
+	}
+	if *swarmsFile != "" {
+		tracker.swarms, err = readSwarms(*swarmsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading the swarms file:", err.Error())
+			os.Exit(2)
+		}
+	}
 
-	// Feel free to change the tracker IP and tracker port based on your machine
-	trackerIP := "localhost"
-	trackerPort := "29392"
+	// Hand out a token for a swarm without giving away its key
+	if *mintToken != "" {
+		key, ok := tracker.swarms[*mintToken]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "No swarm %q in the swarms file\n", *mintToken)
+			os.Exit(2)
+		}
+		fmt.Println(swarmToken(*mintToken, key, time.Now().Add(*mintTTL)))
+		return
+	}
+	if *cluster != "" {
+		tracker.cluster = strings.Split(*cluster, ",")
+	}
+	if *clusterSecretFile != "" {
+		secret, err := os.ReadFile(*clusterSecretFile)
+		if err == nil && len(strings.TrimSpace(string(secret))) == 0 {
+			err = errors.New("the file is empty")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading the cluster secret:", err.Error())
+			os.Exit(2)
+		}
+		tracker.clusterSecret = []byte(strings.TrimSpace(string(secret)))
+	}
+
+	// Stop gracefully on Ctrl-C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *metricsAddress != "" {
+		go serveMetrics(ctx, *metricsAddress, tracker.metrics)
+	}
+
+	if *adminAddress != "" {
+		listener, err := listenAdmin(*adminAddress, *adminToken)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error starting the admin dashboard:", err.Error())
+			os.Exit(2)
+		}
+		admin := &adminServer{tracker: tracker, token: *adminToken}
+		go admin.serve(ctx, listener)
+	}
 
-	// Start the tracker on the local machine ("localhost") on port "20000"
-	tracker.Start(trackerIP, trackerPort)
+	// Start the tracker on the local machine ("localhost") on port "29392"
+	tracker.Start(ctx, *trackerIP, *trackerPort)
 }
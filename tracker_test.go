@@ -0,0 +1,580 @@
+// tracker_test.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback port nothing is listening on
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// startTracker runs a tracker on a loopback port until the test ends and returns its address
+func startTracker(t *testing.T, tracker *Tracker, port string) string {
+	t.Helper()
+	return startTrackerOn(t, tracker, "127.0.0.1", port)[0]
+}
+
+// startTrackerOn runs a tracker on the comma separated hosts until the test ends and
+// returns its address on each
+func startTrackerOn(t *testing.T, tracker *Tracker, hosts string, port string) []string {
+	t.Helper()
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.Start(ctx, hosts, port)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-done
+	})
+
+	var addresses []string
+	for _, host := range strings.Split(hosts, ",") {
+		address := net.JoinHostPort(host, port)
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("tracker on %s didn't start", address)
+			}
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// ask sends a request to the tracker and returns its answer
+func ask(t *testing.T, address string, request string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite() // Gossip is read until the sender is done
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(answer)
+}
+
+// eventually fails the test unless done returns true within a few gossip rounds
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*gossipInterval; time.Sleep(50 * time.Millisecond) {
+		if done() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+// startCluster runs trackers on loopback that replicate with each other
+func startCluster(t *testing.T, size int, secret string) ([]*Tracker, []string) {
+	t.Helper()
+	ports := make([]string, size)
+	for i := range ports {
+		ports[i] = freePort(t)
+	}
+	trackers := make([]*Tracker, size)
+	addresses := make([]string, size)
+	for i := range trackers {
+		trackers[i] = NewTracker()
+		trackers[i].clusterSecret = []byte(secret)
+		for j, port := range ports {
+			if j != i {
+				trackers[i].cluster = append(trackers[i].cluster, net.JoinHostPort("127.0.0.1", port))
+			}
+		}
+		addresses[i] = startTracker(t, trackers[i], ports[i])
+	}
+	return trackers, addresses
+}
+
+func TestClusterConverges(t *testing.T) {
+	trackers, addresses := startCluster(t, 3, "cluster s3cret")
+
+	if answer := ask(t, addresses[0], "REGISTER:song.mp3:4000"); answer != "OK" {
+		t.Fatalf("REGISTER answered %q", answer)
+	}
+	for _, address := range addresses[1:] {
+		eventually(t, "the registration reaches "+address, func() bool {
+			return ask(t, address, "REQUEST_FILE:song.mp3") == "127.0.0.1:4000"
+		})
+	}
+
+	// A removal on another member reaches every tracker
+	ask(t, addresses[1], "UNREGISTER:song.mp3:4000")
+	for _, address := range addresses {
+		eventually(t, "the removal reaches "+address, func() bool {
+			return ask(t, address, "REQUEST_FILE:song.mp3") == "NO_PEER"
+		})
+	}
+
+	// A registration older than the removal, gossiped late, doesn't bring the peer back
+	var tombstone registration
+	for _, r := range trackers[2].snapshot() {
+		if r.File == "song.mp3" {
+			tombstone = r
+		}
+	}
+	if !tombstone.Removed {
+		t.Fatalf("no tombstone for the removed file, got %+v", tombstone)
+	}
+	stale := []registration{{Peer: "127.0.0.1:4000", File: "song.mp3", Updated: tombstone.Updated - 1}}
+	index, _ := json.Marshal(stale)
+	ask(t, addresses[2], "GOSSIP:"+string(trackers[2].sealGossip(index)))
+	time.Sleep(2 * gossipInterval)
+	for _, address := range addresses {
+		if answer := ask(t, address, "REQUEST_FILE:song.mp3"); answer != "NO_PEER" {
+			t.Errorf("a stale registration came back on %s: %q", address, answer)
+		}
+	}
+}
+
+func TestClusterRefusesForgedGossip(t *testing.T) {
+	trackers, addresses := startCluster(t, 2, "cluster s3cret")
+
+	// Without the cluster secret, gossip is refused
+	index, _ := json.Marshal([]registration{{Peer: "127.0.0.1:4000", File: "fake.iso", Updated: time.Now().UnixNano()}})
+	if answer := ask(t, addresses[0], "GOSSIP:"+string(index)); answer != "DENIED" {
+		t.Errorf("unsigned gossip answered %q", answer)
+	}
+	if answer := ask(t, addresses[0], "REQUEST_FILE:fake.iso"); answer != "NO_PEER" {
+		t.Errorf("unsigned gossip was merged: %q", answer)
+	}
+
+	// A publisher without a manifest signed by it is dropped, though the peer is kept
+	forged := []registration{{Peer: "127.0.0.1:4000", File: "app.tar", Updated: time.Now().UnixNano(), Publisher: "Release Eng", Key: "16da1da6ede341e5"}}
+	index, _ = json.Marshal(forged)
+	ask(t, addresses[0], "GOSSIP:"+string(trackers[0].sealGossip(index)))
+	if answer := ask(t, addresses[0], "LIST_FILES"); answer != "app.tar:1" {
+		t.Errorf("LIST_FILES answered %q", answer)
+	}
+}
+
+func TestPrivateSwarmNotReachableByFileName(t *testing.T) {
+	tracker := NewTracker()
+	tracker.swarms = map[string]string{"team": "s3cret"}
+	address := startTracker(t, tracker, freePort(t))
+	token := ":team:" + swarmToken("team", "s3cret", time.Now().Add(time.Hour))
+
+	if answer := ask(t, address, "REGISTER:plans.txt:4000"+token); answer != "OK" {
+		t.Fatalf("REGISTER in the swarm answered %q", answer)
+	}
+
+	// Without a token, naming the file as the tracker indexes it reveals nothing
+	for _, request := range []string{"REQUEST_FILE:team/plans.txt", "REQUEST_PEERS:team/plans.txt", "REQUEST_FILE:plans.txt"} {
+		if answer := ask(t, address, request); strings.Contains(answer, "4000") {
+			t.Errorf("%s answered %q", request, answer)
+		}
+	}
+	if answer := ask(t, address, "LIST_FILES"); strings.Contains(answer, "plans.txt") {
+		t.Errorf("LIST_FILES answered %q", answer)
+	}
+
+	// Nor can the registration be removed that way
+	ask(t, address, "UNREGISTER:team/plans.txt:4000")
+	if answer := ask(t, address, "REQUEST_FILE:plans.txt"+token); answer != "127.0.0.1:4000" {
+		t.Errorf("REQUEST_FILE in the swarm answered %q", answer)
+	}
+
+	if answer := ask(t, address, "REQUEST_FILE:plans.txt:team:1.abc"); answer != "DENIED" {
+		t.Errorf("REQUEST_FILE with a bad token answered %q", answer)
+	}
+}
+
+func TestConnectBackOnlyForRegisteredFile(t *testing.T) {
+	address := startTracker(t, NewTracker(), freePort(t))
+
+	// A peer behind NAT registers a file and waits for connect-back requests
+	if answer := ask(t, address, "REGISTER:poem.txt:5000"); answer != "OK" {
+		t.Fatalf("REGISTER answered %q", answer)
+	}
+	listener, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Write([]byte("LISTEN:5000"))
+	requests := bufio.NewReader(listener)
+
+	eventually(t, "the peer is listening", func() bool {
+		return ask(t, address, "CONNECT_BACK:127.0.0.1:5000 :6000 t0 poem.txt") == "OK"
+	})
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, _ := requests.ReadString('\n'); line != "CONNECT 127.0.0.1:6000 t0\n" {
+		t.Errorf("the peer was asked %q", line)
+	}
+
+	// Requests for files the peer doesn't share, or without a file, aren't passed on
+	for _, request := range []string{"CONNECT_BACK:127.0.0.1:5000 :6000 t1 other.txt", "CONNECT_BACK:127.0.0.1:5000 :6000 t2"} {
+		if answer := ask(t, address, request); answer != "NO_PEER" {
+			t.Errorf("%s answered %q", request, answer)
+		}
+	}
+
+	// A host asking too often is refused
+	answer := ""
+	for range connectBackRate + 1 {
+		answer = ask(t, address, "CONNECT_BACK:127.0.0.1:5000 :6000 t3 poem.txt")
+	}
+	if answer != "DENIED" {
+		t.Errorf("CONNECT_BACK over the rate limit answered %q", answer)
+	}
+}
+
+func TestAdminNeedsLoopbackHost(t *testing.T) {
+	admin := &adminServer{tracker: NewTracker()}
+	handler := admin.authorize(http.HandlerFunc(admin.state))
+
+	for host, want := range map[string]int{"127.0.0.1:9200": http.StatusOK, "localhost:9200": http.StatusOK, "[::1]:9200": http.StatusOK, "rebound.example:9200": http.StatusForbidden} {
+		r := httptest.NewRequest("GET", "/api/state", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("Host %s answered %d, want %d", host, w.Code, want)
+		}
+	}
+}
+
+func TestParseAccessRules(t *testing.T) {
+	id := strings.Repeat("ab", 20)
+	allow, deny, err := parseAccessRules("# office\nallow 10.0.0.0/8\n\nallow peer " + id + "\ndeny 10.1.2.3\ndeny ::1\n")
+	if err != nil || len(allow) != 2 || len(deny) != 2 {
+		t.Fatalf("got %d allow and %d deny rules, %v", len(allow), len(deny), err)
+	}
+	if allow[1].peerID != id || !deny[0].network.Contains(net.ParseIP("10.1.2.3")) || deny[0].network.Contains(net.ParseIP("10.1.2.4")) {
+		t.Errorf("rules parsed as %+v and %+v", allow, deny)
+	}
+
+	for _, bad := range []string{"allow", "allow 10.0.0.0/33", "allow example.com", "permit 10.0.0.1", "deny peer", "deny 10.0.0.1 10.0.0.2"} {
+		if _, _, err := parseAccessRules("allow 10.0.0.1\n" + bad); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: err = %v", bad, err)
+		}
+	}
+}
+
+func TestAccessListReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.txt")
+	write := func(rules string, modified time.Time) {
+		err := os.WriteFile(path, []byte(rules), 0644)
+		if err == nil {
+			err = os.Chtimes(path, modified, modified)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("deny 10.0.0.1\n", start)
+	l, err := newAccessList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.allowsAddress("10.0.0.1:4000") || !l.allowsAddress("10.0.0.2:4000") {
+		t.Fatal("deny rule not applied")
+	}
+
+	// Allow rules only let in what they match
+	write("allow 10.0.0.0/24\n", start.Add(time.Minute))
+	if err := l.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !l.allowsAddress("10.0.0.1:4000") || l.allowsAddress("10.0.1.1:4000") {
+		t.Error("reloaded rules not applied")
+	}
+
+	// A broken file leaves the rules in force
+	write("allow 10.0.0.0/24\nallow nonsense\n", start.Add(2*time.Minute))
+	if err := l.reload(); err == nil {
+		t.Error("broken rules loaded")
+	}
+	if !l.allowsAddress("10.0.0.1:4000") || l.allowsAddress("10.0.1.1:4000") {
+		t.Error("a broken file changed the rules")
+	}
+}
+
+func TestAccessListBansExpire(t *testing.T) {
+	l, _ := newAccessList("")
+	id := strings.Repeat("cd", 20)
+	l.banFor("10.0.0.1", 50*time.Millisecond)
+	l.banFor(id, 50*time.Millisecond)
+	if l.allowsAddress("10.0.0.1:4000") || l.allowsPeer(id) {
+		t.Fatal("ban not applied")
+	}
+	if !l.allowsAddress("10.0.0.2:4000") || !l.allowsPeer(strings.Repeat("ef", 20)) {
+		t.Error("ban applied to others")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !l.allowsAddress("10.0.0.1:4000") || !l.allowsPeer(id) || len(l.temporary) != 0 {
+		t.Error("expired ban still applied or remembered")
+	}
+}
+
+func TestRegistrationsExpire(t *testing.T) {
+	tracker := NewTracker()
+	ago := func(d time.Duration) int64 { return time.Now().Add(-d).UnixNano() }
+
+	// The tracker isn't started, so apply is called without the lock. A registration not renewed in time is dropped, on every replica alike
+	tracker.apply(registration{Peer: "10.0.0.1:4000", File: "old.iso", Updated: ago(registrationTTL - time.Second)})
+	tracker.apply(registration{Peer: "10.0.0.1:4000", File: "new.iso", Updated: ago(time.Minute)})
+	time.Sleep(1100 * time.Millisecond)
+	tracker.expire()
+	if files := tracker.peers["10.0.0.1:4000"]; len(files) != 1 || files[0] != "new.iso" {
+		t.Errorf("files after expiry: %q", files)
+	}
+
+	// Removals outlive what they removed by the clock skew allowed, and no longer
+	tracker.apply(registration{Peer: "10.0.0.2:4000", File: "a.iso", Updated: ago(registrationTTL + maxClockSkew/2), Removed: true})
+	tracker.apply(registration{Peer: "10.0.0.2:4000", File: "b.iso", Updated: ago(registrationTTL + 2*maxClockSkew), Removed: true})
+	tracker.expire()
+	if _, ok := tracker.registrations["10.0.0.2:4000|a.iso"]; !ok {
+		t.Error("a removal was forgotten while a lagging replica may still list the file")
+	}
+	if _, ok := tracker.registrations["10.0.0.2:4000|b.iso"]; ok {
+		t.Error("a removal was kept after what it removed expired everywhere")
+	}
+
+	// A replica cut off for longer can't bring back an expired registration, and a
+	// change dated in the future can't outlive everything else
+	if tracker.apply(registration{Peer: "10.0.0.2:4000", File: "b.iso", Updated: ago(registrationTTL + time.Second)}) {
+		t.Error("an expired registration was applied")
+	}
+	if tracker.apply(registration{Peer: "10.0.0.3:4000", File: "c.iso", Updated: ago(-2 * maxClockSkew)}) {
+		t.Error("a registration from the future was applied")
+	}
+}
+
+func TestRegisterRefusesUnsafeFileNames(t *testing.T) {
+	address := startTracker(t, NewTracker(), freePort(t))
+
+	for _, name := range []string{"\x1b[2Jclear.txt", "bell\a.txt", "two\rlines.txt", "..", "back\\slash.txt"} {
+		for _, request := range []string{"REGISTER:" + name + ":4000", "PUBLISH:" + name + ":4000:e30="} {
+			if answer := ask(t, address, request); answer != "INVALID" {
+				t.Errorf("%q answered %q", request, answer)
+			}
+		}
+	}
+	if answer := ask(t, address, "LIST_FILES"); answer != "" {
+		t.Errorf("LIST_FILES answered %q", answer)
+	}
+	if answer := ask(t, address, "REGISTER:café menu.txt:4000"); answer != "OK" {
+		t.Errorf("REGISTER of a plain name answered %q", answer)
+	}
+}
+
+func TestMetricsServerStopsWithContext(t *testing.T) {
+	tracker := NewTracker()
+	address := net.JoinHostPort("127.0.0.1", freePort(t))
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveMetrics(ctx, address, tracker.metrics)
+	}()
+
+	var body []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second && body == nil; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + address + "/metrics")
+		if err != nil {
+			continue
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if !strings.Contains(string(body), "tracker_") {
+		t.Fatalf("/metrics answered %q", body)
+	}
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the metrics server kept running after its context was cancelled")
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Error("the metrics port still takes connections")
+	}
+}
+
+func TestTrackerListsIPv6Peers(t *testing.T) {
+	if listener, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback on this host")
+	} else {
+		listener.Close()
+	}
+	addresses := startTrackerOn(t, NewTracker(), "127.0.0.1,::1", freePort(t))
+
+	// A peer registers over each family, and is listed at both addresses
+	for _, address := range addresses {
+		if answer := ask(t, address, "REGISTER:notes.txt:4000"); answer != "OK" {
+			t.Fatalf("REGISTER over %s answered %q", address, answer)
+		}
+	}
+	answer := ask(t, addresses[0], "REQUEST_PEERS:notes.txt")
+	peers := strings.Split(answer, ",")
+	slices.Sort(peers)
+	if !slices.Equal(peers, []string{"127.0.0.1:4000", "[::1]:4000"}) {
+		t.Errorf("REQUEST_PEERS answered %q", answer)
+	}
+}
+
+func TestTrackerLimitsConnectionsPerIP(t *testing.T) {
+	tracker := NewTracker()
+	tracker.connLimits = newConnLimiter(0, 1)
+	address := startTracker(t, tracker, freePort(t))
+	idle := func() bool {
+		active, _, _, _ := tracker.connLimits.stats()
+		return active == 0
+	}
+	// Refused connections are closed without an answer, or reset
+	answered := func(request string) bool {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(request))
+		answer, _ := io.ReadAll(conn)
+		return string(answer) == "OK"
+	}
+
+	// The startup probe may still hold the slot, so the first requests can be turned away
+	eventually(t, "a request is answered", func() bool { return answered("REGISTER:notes.txt:4000") })
+	eventually(t, "every connection is released", idle)
+	_, _, refused, _ := tracker.connLimits.stats()
+
+	// A client that connects and sends nothing holds the only slot for its IP
+	slow, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	eventually(t, "the slow client is admitted", func() bool { return !idle() })
+	if answered("REGISTER:notes.txt:4000") {
+		t.Error("a second connection from the same IP was answered")
+	}
+	if _, _, perIP, _ := tracker.connLimits.stats(); perIP != refused+1 {
+		t.Errorf("counted %d more connections refused per IP", perIP-refused)
+	}
+
+	// Once it goes, the IP gets in again
+	slow.Close()
+	eventually(t, "the slow client is released", idle)
+	if !answered("REGISTER:notes.txt:4000") {
+		t.Error("the IP was still turned away after its connection closed")
+	}
+}
+
+func TestConnLimiterCaps(t *testing.T) {
+	conn := func(ip string) net.Conn {
+		ours, theirs := net.Pipe()
+		t.Cleanup(func() { ours.Close(); theirs.Close() })
+		return remoteAddrConn{ours, &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}}
+	}
+	l := newConnLimiter(3, 2)
+	a1, a2, a3, b1, c1 := conn("10.0.0.1"), conn("10.0.0.1"), conn("10.0.0.1"), conn("10.0.0.2"), conn("10.0.0.3")
+
+	if !l.admit(a1) || !l.admit(a2) {
+		t.Fatal("refused connections under both caps")
+	}
+	if l.admit(a3) {
+		t.Error("admitted a third connection from one IP")
+	}
+	if !l.admit(b1) {
+		t.Error("refused another IP under the overall cap")
+	}
+	if l.admit(c1) {
+		t.Error("admitted a connection over the overall cap")
+	}
+	l.release(a1)
+	if !l.admit(c1) {
+		t.Error("refused a connection after one was released")
+	}
+	if active, full, perIP, _ := l.stats(); active != 3 || full != 1 || perIP != 1 {
+		t.Errorf("stats are %d active, %d refused when full, %d refused per IP", active, full, perIP)
+	}
+	if len(l.byIP) != 3 || l.byIP["10.0.0.1"] != 1 {
+		t.Errorf("counts by IP are %v", l.byIP)
+	}
+}
+
+// remoteAddrConn is a connection that claims to come from another address
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestNewLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.log")
+	log, err := newLogger("warn", "json", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("Quiet", "peer", "10.0.0.1:4000")
+	log.Warn("Loud", "peer", "10.0.0.1:4000")
+
+	// Only the warning is written, as one JSON object per line, after what was there
+	log, err = newLogger("debug", "text", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Debug("Appended")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log holds %q", data)
+	}
+	var record map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil || record["level"] != "WARN" || record["msg"] != "Loud" || record["peer"] != "10.0.0.1:4000" {
+		t.Errorf("JSON record %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "level=DEBUG") || !strings.Contains(lines[1], "msg=Appended") {
+		t.Errorf("text record %q", lines[1])
+	}
+
+	for _, bad := range [][2]string{{"loud", "text"}, {"info", "xml"}} {
+		if _, err := newLogger(bad[0], bad[1], ""); err == nil {
+			t.Errorf("newLogger accepted level %q and format %q", bad[0], bad[1])
+		}
+	}
+}